@@ -14,20 +14,20 @@ func BalanceHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
 }
 
 func DepositAddressHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
-    coin :=   GetParamRegexp(r, "coin",   RE_COIN,      true)
+    coin :=   GetParamCoin(r, "coin", true)
     addr := LoadOrCreateDepositAddress(user.Id, WALLET_MAIN, coin)
     ReturnJSON(API_OK, addr)
 }
 
 func DepositsHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
-    coin :=     GetParamRegexp(r, "coin",       RE_COIN,    false)
+    coin :=     GetParamCoin(r, "coin", false)
     deposits := LoadDepositsByWalletAndCoin(user.Id, WALLET_MAIN, coin, 10)
     ReturnJSON(API_OK, deposits)
 }
 
 func WithdrawHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
     toAddress :=        GetParamRegexp(r, "to_address",  RE_ADDRESS,    true)
-    coin :=             GetParamRegexp(r, "coin",        RE_COIN,       true)
+    coin :=             GetParamCoin(r, "coin", true)
     amount :=           GetParamUint64(r, "amount")
 
     minWithdraw := bitcoin.MinWithdrawAmount(coin)
@@ -48,7 +48,7 @@ func WithdrawHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
 }
 
 func WithdrawalsHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
-    coin := GetParamRegexp(r, "coin", RE_COIN, true)
+    coin := GetParamCoin(r, "coin", true)
     withdrawals := LoadWithdrawalsByUser(user.Id, coin, 10)
     ReturnJSON(API_OK, withdrawals)
 }
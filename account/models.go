@@ -3,6 +3,7 @@ package account
 import (
     . "ftnox.com/common"
     "ftnox.com/db"
+    "ftnox.com/feed"
     "database/sql"
     "time"
 )
@@ -14,6 +15,10 @@ const (
     WALLET_SWEEP =                  "sweep"
     WALLET_SWEEP_DRY =              "sweep_dry"
     WALLET_CHANGE =                 "change"
+    WALLET_FEES =                   "fees"      // trading fees, only for SYSTEM_USER_ID
+
+    // Owns the exchange's own wallets. Real user ids start at 1.
+    SYSTEM_USER_ID =                0
 )
 
 // BALANCE
@@ -39,6 +44,7 @@ func SaveBalance(c db.MConn, balance *Balance) (*Balance) {
 
 // Adds or subtracts an amount to a user's wallet.
 // nonnegative: panics with INSUFFICIENT_FUNDS_ERROR if resulting balance is negative.
+// The new balance is published to the user's feed once tx commits.
 // Returns the new balance
 func UpdateBalanceByWallet(tx *db.ModelTx, userId int64, wallet string, coin string, diff int64, nonnegative bool) *Balance {
     var balance Balance
@@ -61,6 +67,7 @@ func UpdateBalanceByWallet(tx *db.ModelTx, userId int64, wallet string, coin str
         // Create new balance
         balance := Balance{UserId:userId, Wallet:wallet, Coin:coin, Amount:diff}
         SaveBalance(tx, &balance)
+        publishBalance(tx, &balance)
         return &balance
     }
 
@@ -73,9 +80,32 @@ func UpdateBalanceByWallet(tx *db.ModelTx, userId int64, wallet string, coin str
         balance.Amount, userId, wallet, coin,
     )
     if err != nil { panic(err) }
+    publishBalance(tx, &balance)
     return &balance
 }
 
+// For balances that were changed in SQL, like by exchange_do_trade.
+// Publishes the balance as of tx to the user's feed once tx commits.
+func PublishBalanceByWallet(tx *db.ModelTx, userId int64, wallet string, coin string) {
+    var balance Balance
+    err := tx.QueryRow(
+        `SELECT `+BalanceModel.FieldsSimple+`
+         FROM account_balance WHERE
+         user_id=? AND wallet=? AND coin=?`,
+        userId, wallet, coin,
+    ).Scan(&balance)
+    if err == sql.ErrNoRows { return }
+    if err != nil { panic(err) }
+    publishBalance(tx, &balance)
+}
+
+func publishBalance(tx *db.ModelTx, balance *Balance) {
+    published := *balance
+    tx.OnCommit(func() {
+        feed.Publish(feed.UserChannel(feed.CHANNEL_BALANCES, published.UserId), "balance", &published)
+    })
+}
+
 func LoadBalancesByWallet(userId int64, wallet string) []*Balance {
     rows, err := db.QueryAll(Balance{},
         `SELECT `+BalanceModel.FieldsSimple+`
@@ -18,17 +18,18 @@ var (
 // USER
 
 type User struct {
-    Id          int64  `json:"id"           db:"id,autoinc"`
-    Email       string `json:"email"        db:"email"`
-    EmailCode   string `json:"-"            db:"email_code"`
-    EmailConf   int32  `json:"-"            db:"email_conf"`
-    Password    string `json:"-"`
-    Scrypt      []byte `json:"-"            db:"scrypt"`
-    Salt        []byte `json:"-"            db:"salt"`
-    TOTPKey     []byte `json:"-"            db:"totp_key"`
-    TOTPConf    int32  `json:"totpConf"     db:"totp_conf"`
-    ChainIdx    int32  `json:"-"            db:"chain_idx"`
-    Roles       string `json:"roles"        db:"roles"`
+    Id              int64  `json:"id"                 db:"id,autoinc"`
+    Email           string `json:"email"              db:"email"`
+    EmailCode       string `json:"-"                  db:"email_code"`
+    EmailConf       int32  `json:"-"                  db:"email_conf"`
+    Password        string `json:"-"`
+    Scrypt          []byte `json:"-"                  db:"scrypt"`
+    Salt            []byte `json:"-"                  db:"salt"`
+    TOTPKey         []byte `json:"-"                  db:"totp_key"`
+    TOTPConf        int32  `json:"totpConf"           db:"totp_conf"`
+    ChainIdx        int32  `json:"-"                  db:"chain_idx"`
+    Roles           string `json:"roles"              db:"roles"`
+    SelfTradePolicy string `json:"selfTradePolicy"    db:"stp_policy"` // default for the user's orders, see exchange.ORDER_STP_*
 }
 
 var UserModel = db.GetModelInfo(new(User))
@@ -123,6 +124,16 @@ func UpdateUserSetTOTPConfirmed(userId int64) {
     if err != nil { panic(err) }
 }
 
+func UpdateUserSetSelfTradePolicy(userId int64, policy string) {
+    _, err := db.Exec(
+        `UPDATE auth_user
+         SET stp_policy=?
+         WHERE id=?`,
+        policy, userId,
+    )
+    if err != nil { panic(err) }
+}
+
 func LoadUserByEmail(email string) *User {
     var user User
     err := db.QueryRow(
@@ -0,0 +1,82 @@
+// +build check_journal
+
+package main
+
+import (
+    . "ftnox.com/common"
+    . "ftnox.com/config"
+    "ftnox.com/exchange"
+    "flag"
+    "fmt"
+    "math"
+    "os"
+)
+
+// Rebuilds each market from its matching journal, & reports what doesn't add up
+// within the journal or differs from the DB. Exits with 1 if anything does.
+// Checks start from the latest snapshot in the journal, or its beginning with -all.
+// The markets don't load, so this is safe to run next to the server, but orders
+// it processes in the meantime may show up as differences.
+func main() {
+
+    var market = flag.String("market", "", "Market to check, e.g. LTC/BTC, or all if empty")
+    var depth  = flag.Int("depth", 10, "Price levels of the rebuilt book to print on each side")
+    var all    = flag.Bool("all", false, "Check the whole journal instead of from the latest snapshot")
+
+    flag.Parse()
+
+    found, failed := false, false
+    for _, mcfg := range Config.Markets {
+        if *market != "" && mcfg.Name() != *market { continue }
+        found = true
+
+        var check *exchange.JournalCheck
+        if *all {
+            check = exchange.CheckJournalSince(mcfg.BasisCoin, mcfg.Coin, 0)
+        } else {
+            check = exchange.CheckJournal(mcfg.BasisCoin, mcfg.Coin)
+        }
+        if check.Start == nil {
+            Info("[%v] No journal yet", mcfg.Name())
+            continue
+        }
+        Info("[%v] Checked up to entry %v: %v commands, %v orders, %v trades",
+            mcfg.Name(), check.LastSeq, check.Commands, len(check.Orders), len(check.Trades))
+        printBook(check, *depth)
+
+        problems := append(check.Problems(), check.Diff()...)
+        for _, problem := range problems {
+            fmt.Println(problem)
+        }
+        if len(problems) > 0 {
+            Warn("[%v] %v problems", mcfg.Name(), len(problems))
+            failed = true
+        }
+    }
+    if !found {
+        Warn("Unknown market %v", *market)
+        failed = true
+    }
+    if failed { os.Exit(1) }
+}
+
+// Prints the best depth price levels on each side of the rebuilt book.
+func printBook(check *exchange.JournalCheck, depth int) {
+    for _, orderType := range []string{exchange.ORDER_TYPE_ASK, exchange.ORDER_TYPE_BID} {
+        orders, _ := check.LimitOrders(orderType, len(check.Orders), math.MaxInt64)
+        levels := 0
+        for i := 0; i < len(orders) && levels < depth; levels++ {
+            price, amount, count := orders[i].Price, uint64(0), 0
+            for ; i < len(orders) && orders[i].Price == price; i++ {
+                order := orders[i]
+                if order.Amount > 0 {
+                    amount += order.Amount - order.Filled
+                } else {
+                    amount += exchange.AmountForBasis(order.BasisAmount - order.BasisFilled, price)
+                }
+                count++
+            }
+            fmt.Printf("%v %v: %v in %v orders\n", orderType, exchange.PriceToF64(price), I64ToF64(int64(amount)), count)
+        }
+    }
+}
@@ -12,6 +12,7 @@ import (
     "ftnox.com/treasury"
     "ftnox.com/beta"
     "ftnox.com/solvency"
+    "ftnox.com/feed"
     _ "ftnox.com/daemon"
     "strings"
     "net/http"
@@ -53,11 +54,24 @@ func main() {
     http.HandleFunc("/exchange/markets",            exchange.MarketsHandler)
     http.HandleFunc("/exchange/orderbook",          exchange.OrderBookHandler)
     http.HandleFunc("/exchange/pricelog",           exchange.PriceLogHandler)
+    http.HandleFunc("/exchange/trades",             exchange.TradesHandler)
+    http.HandleFunc("/exchange/ticker",             exchange.TickerHandler)
     http.HandleFunc("/exchange/add_order",          auth.RequireAuth(exchange.AddOrderHandler))
+    http.HandleFunc("/exchange/add_bracket",        auth.RequireAuth(exchange.AddBracketHandler))
     http.HandleFunc("/exchange/cancel_order",       auth.RequireAuth(exchange.CancelOrderHandler))
+    http.HandleFunc("/exchange/amend_order",        auth.RequireAuth(exchange.AmendOrderHandler))
+    http.HandleFunc("/exchange/batch_orders",       auth.RequireAuth(exchange.BatchOrdersHandler))
+    http.HandleFunc("/exchange/cancel_all",         auth.RequireAuth(exchange.CancelAllHandler))
+    http.HandleFunc("/exchange/heartbeat",          auth.RequireAuth(exchange.HeartbeatHandler))
+    http.HandleFunc("/exchange/auto_cancels",       auth.RequireAuth(exchange.AutoCancelsHandler))
     http.HandleFunc("/exchange/pending_orders",     auth.RequireAuth(exchange.GetPendingOrdersHandler))
+    http.HandleFunc("/exchange/self_trade_policy",  auth.RequireAuth(exchange.SelfTradePolicyHandler))
+    http.HandleFunc("/exchange/fees",               auth.RequireAuth(exchange.FeesHandler))
     http.HandleFunc("/exchange/trade_history",      auth.RequireAuth(exchange.TradeHistoryHandler))
 
+    // Feed (websocket)
+    http.HandleFunc("/feed",                        feed.FeedHandler)
+
     // Treasury
     http.HandleFunc("/treasury/",                   auth.RequireAuth(treasury.StaticHandler))
     http.HandleFunc("/treasury/mpk",                auth.RequireAuth(treasury.StorePrivateKeyHandler))
@@ -65,6 +79,9 @@ func main() {
     http.HandleFunc("/treasury/resume_withdrawal",  auth.RequireAuth(treasury.ResumeWithdrawalHandler))
     http.HandleFunc("/treasury/deposits",           auth.RequireAuth(treasury.GetDepositsHandler))
     http.HandleFunc("/treasury/credit_user",        auth.RequireAuth(treasury.CreditUserHandler))
+    http.HandleFunc("/treasury/fee_revenue",        auth.RequireAuth(treasury.GetFeeRevenueHandler))
+    http.HandleFunc("/treasury/markets",            auth.RequireAuth(treasury.GetMarketStatesHandler))
+    http.HandleFunc("/treasury/market_state",       auth.RequireAuth(treasury.SetMarketStateHandler))
 
     // Beta signup
     http.HandleFunc("/beta",                        beta.SignupHandler)
@@ -4,6 +4,7 @@ package main
 
 import (
     . "ftnox.com/common"
+    "ftnox.com/account"
     "ftnox.com/bitcoin"
     "ftnox.com/db"
     "encoding/json"
@@ -34,6 +35,7 @@ func main() {
 
 func computeLiabilities() {
     allBalances := map[string]map[int64]int64{}
+    feeBalances := map[string]int64{}
 
     Info("Computing Liabilities...")
 
@@ -42,7 +44,7 @@ func computeLiabilities() {
         if err != nil { panic(err) }
         rows, err := tx.Query(
             `SELECT user_id, wallet, coin, amount FROM account_balance
-             WHERE wallet='main' OR wallet='reserved_o' OR wallet='reserved_w'
+             WHERE wallet='main' OR wallet='reserved_o' OR wallet='reserved_w' OR wallet='fees'
              ORDER BY user_id ASC`)
         if err != nil { panic(err) }
         for rows.Next() {
@@ -52,6 +54,12 @@ func computeLiabilities() {
             var amount int64
             err := rows.Scan(&userId, &wallet, &coin, &amount)
             if err != nil { panic(err) }
+            // Collected fees belong to the exchange, not to users.
+            if wallet == account.WALLET_FEES {
+                if userId != account.SYSTEM_USER_ID { panic(NewError("Fees wallet for non-system user %v", userId)) }
+                feeBalances[coin] += amount
+                continue
+            }
             if allBalances[coin] == nil { allBalances[coin] = map[int64]int64{} }
             allBalances[coin][userId] += amount
         }
@@ -66,6 +74,9 @@ func computeLiabilities() {
             userBalances = append(userBalances, UserBalance{fmt.Sprintf("%v", userId), amount})
         }
         fmt.Printf("Total %v:\t%v\n", coin, sum)
+        // Assets should cover the users' balances plus the collected fees.
+        fmt.Printf("Fees %v:\t%v\n", coin, feeBalances[coin])
+        fmt.Printf("Total %v with fees:\t%v\n", coin, sum + feeBalances[coin])
         dirPath := os.Getenv("HOME")+"/.ftnox.com/solvency/"+coin
         filePath := dirPath+"/accounts.json"
         writeToFile(filePath, userBalances)
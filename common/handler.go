@@ -1,7 +1,10 @@
 package common
 
 import (
+    "bufio"
+    "errors"
     "log"
+    "net"
     "fmt"
     "time"
     "strings"
@@ -115,6 +118,14 @@ func (w *ResponseWriterWrapper) WriteHeader(status int) {
     w.ResponseWriter.WriteHeader(status)
 }
 
+// For websockets.
+func (w *ResponseWriterWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    hijacker, ok := w.ResponseWriter.(http.Hijacker)
+    if !ok { return nil, nil, errors.New("ResponseWriter can't be hijacked") }
+    w.Status = http.StatusSwitchingProtocols
+    return hijacker.Hijack()
+}
+
 // Stick it as a deferred statement in gouroutines to prevent the program from crashing.
 func Recover(daemonName string) {
     if e := recover(); e != nil {
@@ -1,6 +1,7 @@
 package common
 
 import (
+    "math/big"
     "strconv"
 )
 
@@ -49,6 +50,31 @@ func MinInt32(a, b int32) int32 {
     return b
 }
 
+// Returns a*b/c rounded down, and the remainder, without overflowing on a*b.
+// Panics if the result doesn't fit in a uint64.
+func MulDivUint64(a, b, c uint64) (uint64, uint64) {
+    if c == 0 { panic("MulDivUint64 division by zero") }
+    x := new(big.Int).SetUint64(a)
+    x.Mul(x, new(big.Int).SetUint64(b))
+    q, r := x.QuoRem(x, new(big.Int).SetUint64(c), new(big.Int))
+    if q.BitLen() > 64 { panic(NewError("MulDivUint64 overflow: %v*%v/%v", a, b, c)) }
+    return q.Uint64(), r.Uint64()
+}
+
+// Returns a*b/c rounded half up.
+func MulDivRoundUint64(a, b, c uint64) uint64 {
+    q, r := MulDivUint64(a, b, c)
+    if r >= c - r { q++ }
+    return q
+}
+
+// Returns a*b/c rounded up.
+func MulDivCeilUint64(a, b, c uint64) uint64 {
+    q, r := MulDivUint64(a, b, c)
+    if r > 0 { q++ }
+    return q
+}
+
 func F64ToI64(f float64) (int64) {
     return RoundFloat64(f * 100000000.0)
 }
@@ -13,3 +13,17 @@ func TestConversions(t *testing.T) {
         }
     }
 }
+
+func TestMulDiv(t *testing.T) {
+    testMulDiv := func(a, b, c, q, r, round, ceil uint64) {
+        q_, r_ := MulDivUint64(a, b, c)
+        if q_ != q || r_ != r                   { t.Errorf("MulDivUint64(%v, %v, %v): expected %v r %v but got %v r %v", a, b, c, q, r, q_, r_) }
+        if MulDivRoundUint64(a, b, c) != round  { t.Errorf("MulDivRoundUint64(%v, %v, %v): expected %v", a, b, c, round) }
+        if MulDivCeilUint64(a, b, c) != ceil    { t.Errorf("MulDivCeilUint64(%v, %v, %v): expected %v", a, b, c, ceil) }
+    }
+    testMulDiv(10, 10, 4,   25, 0,  25, 25)
+    testMulDiv(10, 10, 8,   12, 4,  13, 13)
+    testMulDiv(10, 10, 7,   14, 2,  14, 15)
+    // a*b overflows uint64 but the result doesn't.
+    testMulDiv(100000*USATOSHI, 100000*USATOSHI, USATOSHI, 10000000000*USATOSHI, 0, 10000000000*USATOSHI, 10000000000*USATOSHI)
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+    "ftnox.com/config"
     "net/http"
     "fmt"
     "regexp"
@@ -19,9 +20,13 @@ var (
     RE_HOST =       regexp.MustCompile(`^(?i)(`+domain+`)$`)
 
     RE_ID12 =       regexp.MustCompile(`^[a-zA-Z0-9]{12}$`)
-    RE_COIN =       regexp.MustCompile(`^(BTC|LTC|USD)$`) // HACK
     RE_USER_TX_ID = regexp.MustCompile(`^[a-zA-Z0-9]{32}$`)
     RE_ORDER_TYPE = regexp.MustCompile(`^[AB]$`)
+    RE_ORDER_KIND = regexp.MustCompile(`^[LMST]$`)
+    RE_TIME_IN_FORCE = regexp.MustCompile(`^[GIFPT]$`)
+    RE_SELF_TRADE_POLICY = regexp.MustCompile(`^[NOBD]$`)
+    RE_MARKET_STATE = regexp.MustCompile(`^[OACHD]$`)
+    RE_CLIENT_ID = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,36}$`)
 )
 
 func panicAPI(err error) {
@@ -86,7 +91,7 @@ func GetParamRegexpSafe(r *http.Request, param string, re *regexp.Regexp) (strin
 }
 func GetParamRegexp(r *http.Request, param string, re *regexp.Regexp, required bool) string {
     s, err := GetParamRegexpSafe(r, param, re)
-    if (required || s != "") && err != nil { panicAPI(err) }
+    if (required || GetParam(r, param) != "") && err != nil { panicAPI(err) }
     return s
 }
 
@@ -101,3 +106,15 @@ func GetParamFloat64(r *http.Request, param string) float64 {
     if err != nil { panicAPI(err) }
     return f
 }
+
+// Coins must be one of config.Config.Coins.
+func GetParamCoinSafe(r *http.Request, param string) (string, error) {
+    s := GetParam(r, param)
+    if config.Config.GetCoin(s) == nil { return "", errorF(param, "Unknown coin %v", s) }
+    return s, nil
+}
+func GetParamCoin(r *http.Request, param string, required bool) string {
+    s, err := GetParamCoinSafe(r, param)
+    if (required || GetParam(r, param) != "") && err != nil { panicAPI(err) }
+    return s
+}
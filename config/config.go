@@ -39,6 +39,92 @@ type ConfigType struct {
     GMailPassword string
 
     Coins []*bitcoin.Coin
+
+    // The markets to trade, in the order they're listed to users.
+    Markets []*MarketConfig
+
+    // Trading fee tiers by basis coin, in ascending MinVolume.
+    // Markets whose basis coin isn't listed don't charge fees.
+    FeeSchedule map[string][]*FeeTier
+
+    // Candle intervals for the price log, in ascending Interval.
+    // The first is the basis that the longer ones get rolled up from.
+    CandleIntervals []*CandleInterval
+
+    // Markets rebuild their books from the matching journal when they load,
+    // instead of from the pending orders in the DB. See exchange/journal.go.
+    RecoverBookFromJournal bool
+}
+
+// Represents a market of Coin priced in BasisCoin, e.g. BTC/USD or LTC/BTC.
+// Any coin can be the basis.
+type MarketConfig struct {
+    Coin            string
+    BasisCoin       string
+    TickSize        uint64              // prices must be a multiple of this, see PRICE_SCALE
+    MinTrade        uint64              // in Coin, 0 for the coin's MinTrade
+    BasisMinTrade   uint64              // in BasisCoin, 0 for the basis coin's MinTrade
+    FeeTiers        []*FeeTier          // overrides FeeSchedule for the basis coin
+    CandleIntervals []*CandleInterval   // overrides CandleIntervals
+    Disabled        bool                // not loaded at all
+    Halted          bool                // loaded, but halted whatever its saved state
+
+    // Trades must be within PriceBandPct percent of the last trade price,
+    // or of ReferencePrice before the first trade. 0 for no band.
+    PriceBandPct    float64
+    ReferencePrice  uint64
+    CircuitBreaker  *CircuitBreaker     // nil for none
+    // Seconds of call auction when the market resumes from a halt or cancel-only.
+    // 0 to uncross right away.
+    AuctionDuration int64
+}
+
+// Halts the market for Halt seconds when the price moves
+// more than MovePct percent within Window seconds.
+type CircuitBreaker struct {
+    MovePct         float64
+    Window          int64
+    Halt            int64
+}
+
+func (mcfg *MarketConfig) Name() string {
+    return MarketName(mcfg.Coin, mcfg.BasisCoin)
+}
+
+// The market of coin priced in basisCoin is named "coin/basisCoin",
+// in the API, the feed & the price log alike.
+func MarketName(coin string, basisCoin string) string {
+    return coin+"/"+basisCoin
+}
+
+// For config files from before Markets.
+var defaultMarkets = []*MarketConfig{
+    &MarketConfig{Coin:"BTC", BasisCoin:"USD", TickSize:1000000}, // $0.01
+    &MarketConfig{Coin:"LTC", BasisCoin:"USD", TickSize:100000},  // $0.001
+}
+
+type CandleInterval struct {
+    Interval    int64   // seconds
+    Retention   int64   // seconds of candles to keep, 0 to keep them all
+}
+
+// For config files from before CandleIntervals.
+var defaultCandleIntervals = []*CandleInterval{
+    &CandleInterval{Interval:60,         Retention:7*24*60*60},  // 1m
+    &CandleInterval{Interval:60*5,       Retention:30*24*60*60}, // 5m
+    &CandleInterval{Interval:60*15,      Retention:90*24*60*60}, // 15m
+    &CandleInterval{Interval:60*60,      Retention:0},           // 1h
+    &CandleInterval{Interval:60*60*4,    Retention:0},           // 4h
+    &CandleInterval{Interval:60*60*24,   Retention:0},           // 1d
+    &CandleInterval{Interval:60*60*24*7, Retention:0},           // 1w, starting Thursdays (unix epoch)
+}
+
+// Fees are a ratio of the trade's basis amount.
+// A negative MakerRatio is a rebate, paid out of the taker's fee.
+type FeeTier struct {
+    MinVolume   uint64  // trailing 30 day volume in the basis coin
+    MakerRatio  float64
+    TakerRatio  float64
 }
 
 func (cfg *ConfigType) validate() error {
@@ -57,9 +143,100 @@ func (cfg *ConfigType) validate() error {
     if cfg.GMailPassword == ""     { return errors.New("GMailPassword must be set") }
     if cfg.Domain == ""            { return errors.New("Domain must be set") }
     if len(cfg.Coins) == 0         { return errors.New("Coins must be set") }
+    for basisCoin, tiers := range cfg.FeeSchedule {
+        err := validateFeeTiers(tiers)
+        if err != nil { return fmt.Errorf("FeeSchedule for %v: %v", basisCoin, err) }
+    }
+    if len(cfg.CandleIntervals) == 0 { cfg.CandleIntervals = defaultCandleIntervals }
+    err := validateCandleIntervals(cfg.CandleIntervals)
+    if err != nil { return fmt.Errorf("CandleIntervals: %v", err) }
+    if len(cfg.Markets) == 0 { cfg.Markets = defaultMarkets }
+    seen := map[string]bool{}
+    for _, mcfg := range cfg.Markets {
+        err := cfg.validateMarket(mcfg)
+        if err != nil { return fmt.Errorf("Markets %v: %v", mcfg.Name(), err) }
+        if seen[mcfg.Name()] { return fmt.Errorf("Markets %v: listed twice", mcfg.Name()) }
+        seen[mcfg.Name()] = true
+    }
+    return nil
+}
+
+func (cfg *ConfigType) validateMarket(mcfg *MarketConfig) error {
+    if cfg.GetCoin(mcfg.Coin) == nil      { return errors.New("Coin is not in Coins") }
+    if cfg.GetCoin(mcfg.BasisCoin) == nil { return errors.New("BasisCoin is not in Coins") }
+    if mcfg.Coin == mcfg.BasisCoin       { return errors.New("Coin and BasisCoin must differ") }
+    if mcfg.TickSize == 0                { return errors.New("TickSize must be set") }
+    if mcfg.FeeTiers != nil {
+        err := validateFeeTiers(mcfg.FeeTiers)
+        if err != nil { return fmt.Errorf("FeeTiers: %v", err) }
+    }
+    if mcfg.CandleIntervals != nil {
+        err := validateCandleIntervals(mcfg.CandleIntervals)
+        if err != nil { return fmt.Errorf("CandleIntervals: %v", err) }
+    }
+    if mcfg.PriceBandPct < 0 || mcfg.PriceBandPct >= 100 { return errors.New("PriceBandPct must be at least 0 and under 100") }
+    if mcfg.CircuitBreaker != nil {
+        cb := mcfg.CircuitBreaker
+        if cb.MovePct <= 0  { return errors.New("CircuitBreaker MovePct must be positive") }
+        if cb.Window <= 0   { return errors.New("CircuitBreaker Window must be positive") }
+        // The move is measured from the 24h ticker.
+        if cb.Window > 24*60*60 { return errors.New("CircuitBreaker Window must be at most a day") }
+        if cb.Halt <= 0     { return errors.New("CircuitBreaker Halt must be positive") }
+    }
+    if mcfg.AuctionDuration < 0 { return errors.New("AuctionDuration must be at least 0") }
     return nil
 }
 
+func validateCandleIntervals(intervals []*CandleInterval) error {
+    if len(intervals) == 0          { return errors.New("must have at least one interval") }
+    basis := intervals[0].Interval
+    if basis <= 0                   { return errors.New("Interval must be positive") }
+    for i, ci := range intervals {
+        if ci.Interval % basis != 0 { return errors.New("intervals must be multiples of the first") }
+        if i > 0 && ci.Interval <= intervals[i-1].Interval { return errors.New("intervals must be in ascending Interval") }
+        if ci.Retention != 0 && ci.Retention < ci.Interval { return errors.New("Retention must be 0 or at least Interval") }
+    }
+    // The 24h ticker is seeded from basis candles.
+    if intervals[0].Retention != 0 && intervals[0].Retention < 24*60*60 { return errors.New("Retention of the first interval must be at least a day") }
+    return nil
+}
+
+func validateFeeTiers(tiers []*FeeTier) error {
+    if len(tiers) == 0             { return errors.New("must have at least one tier") }
+    if tiers[0].MinVolume != 0     { return errors.New("first tier must have MinVolume 0") }
+    minMaker, minTaker := tiers[0].MakerRatio, tiers[0].TakerRatio
+    for i, tier := range tiers {
+        if i > 0 && tier.MinVolume <= tiers[i-1].MinVolume { return errors.New("tiers must be in ascending MinVolume") }
+        if tier.TakerRatio < 0     { return errors.New("TakerRatio cannot be negative") }
+        if tier.MakerRatio < minMaker { minMaker = tier.MakerRatio }
+        if tier.TakerRatio < minTaker { minTaker = tier.TakerRatio }
+    }
+    // Rebates come out of the taker's fee, so the exchange can't lose on a trade.
+    if minMaker + minTaker < 0     { return errors.New("maker rebates cannot exceed the lowest TakerRatio") }
+    return nil
+}
+
+// Returns nil if the market isn't configured, disabled or not.
+func (cfg *ConfigType) GetMarket(name string) *MarketConfig {
+    for _, mcfg := range cfg.Markets {
+        if mcfg.Name() == name { return mcfg }
+    }
+    return nil
+}
+
+func (cfg *ConfigType) GetCandleIntervals(market string) []*CandleInterval {
+    mcfg := cfg.GetMarket(market)
+    if mcfg != nil && mcfg.CandleIntervals != nil { return mcfg.CandleIntervals }
+    return cfg.CandleIntervals
+}
+
+// Returns the fee tiers for the market of coin in basisCoin, or nil if there are no fees.
+func (cfg *ConfigType) GetFeeTiers(basisCoin string, coin string) []*FeeTier {
+    mcfg := cfg.GetMarket(MarketName(coin, basisCoin))
+    if mcfg != nil && mcfg.FeeTiers != nil { return mcfg.FeeTiers }
+    return cfg.FeeSchedule[basisCoin]
+}
+
 func (cfg *ConfigType) GetCoin(name string) *bitcoin.Coin {
     for _, coin := range cfg.Coins {
         if coin.Name == name { return coin }
@@ -117,6 +294,31 @@ var defaultConfig = `
         }
     ],
 
+    "Markets": [
+        {"Coin": "BTC", "BasisCoin": "USD", "TickSize": 1000000},
+        {"Coin": "LTC", "BasisCoin": "USD", "TickSize": 100000},
+        {"Coin": "LTC", "BasisCoin": "BTC", "TickSize": 100}
+    ],
+
+    "FeeSchedule": {
+        "USD": [
+            {"MinVolume": 0,                  "MakerRatio": 0.001,   "TakerRatio": 0.002},
+            {"MinVolume": 1000000000000,      "MakerRatio": 0.0008,  "TakerRatio": 0.0018},
+            {"MinVolume": 10000000000000,     "MakerRatio": 0.0005,  "TakerRatio": 0.0015},
+            {"MinVolume": 100000000000000,    "MakerRatio": -0.0001, "TakerRatio": 0.001}
+        ]
+    },
+
+    "CandleIntervals": [
+        {"Interval": 60,        "Retention": 604800},
+        {"Interval": 300,       "Retention": 2592000},
+        {"Interval": 900,       "Retention": 7776000},
+        {"Interval": 3600,      "Retention": 0},
+        {"Interval": 14400,     "Retention": 0},
+        {"Interval": 86400,     "Retention": 0},
+        {"Interval": 604800,    "Retention": 0}
+    ],
+
     "TwilioSid":            "CHANGEME",
     "TwilioToken":          "CHANGEME",
     "TwilioFrom":           "+CHANGEME",
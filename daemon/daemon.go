@@ -6,8 +6,13 @@ import (
     bitcoin "ftnox.com/bitcoin/types"
     "ftnox.com/treasury"
     "ftnox.com/exchange"
+    "time"
 )
 
+const EXPIRE_ORDERS_INTERVAL = 10 * time.Second
+const PRUNE_PRICE_LOGS_INTERVAL = time.Hour
+const FIRE_HEARTBEATS_INTERVAL = time.Second
+
 // Cache of unconfirmed transaction hashes
 // TODO: set expiry on items, or use redis.
 var unconfirmedTxHashes = NewCMap()
@@ -20,13 +25,56 @@ func init() {
             go treasury.Process(coin.Name)
         }
     }
-    go ProcessOrders()
+    for _, marketName := range exchange.MarketNames {
+        go ProcessOrders(exchange.Markets[marketName])
+    }
+    go ExpireOrders()
+    go FireHeartbeats()
+    go PrunePriceLogs()
+}
+
+// Each market processes its own orders in its own goroutine,
+// so a busy market doesn't stall the others.
+func ProcessOrders(market *exchange.Market) {
+    defer Recover("Daemon::ProcessOrders("+market.Name()+")")
+    for {
+        order := market.ProcessNextOrder()
+        if false {Debug("[%v] Processed order %v, %v more queued", order.MarketName(), order.Id, market.QueueDepth())}
+    }
 }
 
-func ProcessOrders() {
-    defer Recover("Daemon::ProcessOrders")
+// Cancels good till time orders once they expire, see exchange/expire.go.
+// A pass that fails gets alerted, and the next one goes on.
+func ExpireOrders() {
+    expirer := exchange.NewOrderExpirer()
     for {
-        order := exchange.ProcessNextOrder()
-        if false {Debug("[%v] Processed order %v", order.MarketName(), order.Id)}
+        func() {
+            defer Recover("Daemon::ExpireOrders")
+            for marketName, expired := range expirer.ExpireOrders(time.Now().Unix()) {
+                Info("[%v] Expired %v orders", marketName, expired)
+            }
+        }()
+        time.Sleep(EXPIRE_ORDERS_INTERVAL)
+    }
+}
+
+// Cancels the orders of users whose bots missed a heartbeat, see exchange/heartbeat.go.
+func FireHeartbeats() {
+    defer Recover("Daemon::FireHeartbeats")
+    for {
+        exchange.FireHeartbeats(time.Now().Unix())
+        time.Sleep(FIRE_HEARTBEATS_INTERVAL)
+    }
+}
+
+// Deletes price logs that are past their interval's retention.
+func PrunePriceLogs() {
+    defer Recover("Daemon::PrunePriceLogs")
+    for {
+        for _, marketName := range exchange.MarketNames {
+            deleted := exchange.Markets[marketName].PriceLogger.Prune(time.Now().Unix())
+            if deleted > 0 { Info("[%v] Pruned %v price logs", marketName, deleted) }
+        }
+        time.Sleep(PRUNE_PRICE_LOGS_INTERVAL)
     }
 }
@@ -24,6 +24,23 @@ var migrations = []func() error{
     migrateCreateTrade,
     migrateCreatePriceLog,
     migrateCreateBetaSignup,
+    migrateAddOrderKind,
+    migrateAddOrderTimeInForce,
+    migrateAddOrderStopPrice,
+    migrateAddSelfTradePolicy,
+    migrateCreateSelfTrade,
+    migrateCreditTradeFees,
+    migrateFixedPointPrices,
+    migrateAddTradeTakerType,
+    migrateAddPriceLogBasisVolume,
+    migrateAddTradeTimeIndex,
+    migrateAddOrderIceberg,
+    migrateCreateOrderGroup,
+    migrateAddOrderClientId,
+    migrateCreateHeartbeat,
+    migrateCreateJournal,
+    migrateAddOrderGroupReserved,
+    migrateAddJournalStartIndex,
     //migrateCreateBankWithdrawal,
 }
 
@@ -431,6 +448,268 @@ func migrateCreateBetaSignup() error {
     return err
 }
 
+func migrateAddOrderKind() error {
+    _, err := Exec(`ALTER TABLE exchange_order
+        ADD COLUMN kind CHAR(1) NOT NULL DEFAULT 'L';
+    `)
+    return err
+}
+
+func migrateAddOrderTimeInForce() error {
+    _, err := Exec(`ALTER TABLE exchange_order
+        ADD COLUMN time_in_force CHAR(1) NOT NULL DEFAULT 'G',
+        ADD COLUMN expire_time   BIGINT  NOT NULL DEFAULT 0;
+    CREATE INDEX ON exchange_order (expire_time) WHERE status = 0 AND time_in_force = 'T';
+    `)
+    return err
+}
+
+func migrateAddOrderStopPrice() error {
+    _, err := Exec(`ALTER TABLE exchange_order
+        ADD COLUMN stop_price DOUBLE PRECISION NOT NULL DEFAULT 0;
+    `)
+    return err
+}
+
+func migrateAddSelfTradePolicy() error {
+    _, err := Exec(`ALTER TABLE exchange_order
+        ADD COLUMN stp_policy CHAR(1) NOT NULL DEFAULT 'N';
+    ALTER TABLE auth_user
+        ADD COLUMN stp_policy VARCHAR(1) NOT NULL DEFAULT '';
+    `)
+    return err
+}
+
+func migrateCreateSelfTrade() error {
+    _, err := Exec(`CREATE TABLE exchange_self_trade (
+        id              BIGSERIAL,
+        user_id         BIGINT      NOT NULL,
+        order_id        BIGINT      NOT NULL,
+        match_id        BIGINT      NOT NULL,
+        policy          CHAR(1)     NOT NULL,
+        order_canceled  BOOLEAN     NOT NULL,
+        match_canceled  BOOLEAN     NOT NULL,
+        amount          BIGINT      NOT NULL,
+        basis_amount    BIGINT      NOT NULL,
+        time            BIGINT      NOT NULL,
+
+        PRIMARY KEY (id)
+    );
+    ALTER SEQUENCE exchange_self_trade_id_seq START WITH 1;
+    CREATE INDEX ON exchange_self_trade (user_id, time);
+    `)
+    return err
+}
+
+// Same as migrateCreateOrderFunction, but the fees get credited
+// to the system user's (user_id 0) 'fees' wallet.
+// Fees may be negative (maker rebates), but their sum shouldn't be.
+func migrateCreditTradeFees() error {
+    _, err := Exec(`
+    CREATE OR REPLACE FUNCTION exchange_do_trade (
+        bid_order_id BIGINT, bid_user_id BIGINT, bid_basis_fee BIGINT,
+        ask_order_id BIGINT, ask_user_id BIGINT, ask_basis_fee BIGINT,
+        basis_coin VARCHAR(4), basis_amount BIGINT,
+        other_coin VARCHAR(4), other_amount BIGINT) RETURNS VOID AS
+    $$
+        BEGIN
+            -- Subtract coins from both reserve wallets, and ensure that funds exist
+            IF (SELECT amount FROM account_balance WHERE user_id=bid_user_id AND wallet='reserved_o' AND coin=basis_coin) >= (basis_amount + bid_basis_fee) THEN 
+                UPDATE account_balance SET amount = amount - (basis_amount + bid_basis_fee) WHERE user_id=bid_user_id AND wallet='reserved_o' AND coin=basis_coin;
+            ELSE
+                RAISE EXCEPTION 'Not enough funds (needed %) for bid_user_id: (%), bid_order_id: (%), ask_order_id: (%)', (basis_amount + bid_basis_fee), bid_user_id, bid_order_id, ask_order_id;
+            END IF;
+            IF (SELECT amount FROM account_balance WHERE user_id=ask_user_id AND wallet='reserved_o' AND coin=other_coin) >= other_amount THEN 
+                UPDATE account_balance SET amount = amount - other_amount WHERE user_id=ask_user_id AND wallet='reserved_o' AND coin=other_coin;
+            ELSE
+                RAISE EXCEPTION 'Not enough funds (needed %) for ask_user_id: (%), bid_order_id: (%), ask_order_id: (%)', other_amount, ask_user_id, bid_order_id, ask_order_id;
+            END IF;
+
+            -- Add funds to bid_user's main wallet
+            UPDATE account_balance SET amount = amount + other_amount WHERE user_id=bid_user_id AND wallet='main' AND coin=other_coin;
+            IF NOT FOUND THEN
+                INSERT INTO account_balance (user_id, wallet, coin, amount) VALUES (bid_user_id, 'main', other_coin, other_amount);
+            END IF;
+
+            -- Add funds to ask_user's main wallet
+            UPDATE account_balance SET amount = amount + (basis_amount - ask_basis_fee) WHERE user_id=ask_user_id AND wallet='main' AND coin=basis_coin;
+            IF NOT FOUND THEN
+                INSERT INTO account_balance (user_id, wallet, coin, amount) VALUES (ask_user_id, 'main', basis_coin, (basis_amount - ask_basis_fee));
+            END IF;
+
+            -- Add fees to the system user's fees wallet
+            IF (bid_basis_fee + ask_basis_fee) != 0 THEN
+                UPDATE account_balance SET amount = amount + (bid_basis_fee + ask_basis_fee) WHERE user_id=0 AND wallet='fees' AND coin=basis_coin;
+                IF NOT FOUND THEN
+                    INSERT INTO account_balance (user_id, wallet, coin, amount) VALUES (0, 'fees', basis_coin, (bid_basis_fee + ask_basis_fee));
+                END IF;
+            END IF;
+        END;
+    $$
+    LANGUAGE plpgsql;
+    `)
+    return err
+}
+
+// Prices become integers, in basis satoshis per whole coin.
+func migrateFixedPointPrices() error {
+    _, err := Exec(`ALTER TABLE exchange_order
+        ALTER COLUMN price      TYPE BIGINT USING round(price * 100000000),
+        ALTER COLUMN stop_price TYPE BIGINT USING round(stop_price * 100000000);
+    ALTER TABLE exchange_trade
+        ALTER COLUMN price      TYPE BIGINT USING round(price * 100000000);
+    ALTER TABLE exchange_price_log
+        ALTER COLUMN low        TYPE BIGINT USING round(low * 100000000),
+        ALTER COLUMN high       TYPE BIGINT USING round(high * 100000000),
+        ALTER COLUMN open       TYPE BIGINT USING round(open * 100000000),
+        ALTER COLUMN close      TYPE BIGINT USING round(close * 100000000);
+    `)
+    return err
+}
+
+// Old trades didn't record the taker, but it was almost always the later order.
+func migrateAddTradeTakerType() error {
+    _, err := Exec(`ALTER TABLE exchange_trade
+        ADD COLUMN taker_type CHAR(1) NOT NULL DEFAULT 'B';
+    UPDATE exchange_trade SET taker_type = 'A' WHERE ask_order_id > bid_order_id;
+    CREATE INDEX ON exchange_trade (bid_user_id, id);
+    CREATE INDEX ON exchange_trade (ask_user_id, id);
+    CREATE INDEX ON exchange_trade (basis_coin, coin, id);
+    `)
+    return err
+}
+
+// For VWAP. Existing entries get it from their trades.
+func migrateAddPriceLogBasisVolume() error {
+    _, err := Exec(`ALTER TABLE exchange_price_log
+        ADD COLUMN basis_volume BIGINT NOT NULL DEFAULT 0;
+    UPDATE exchange_price_log SET basis_volume = COALESCE((
+        SELECT SUM(trade_basis) FROM exchange_trade
+        WHERE exchange_trade.coin || '/' || exchange_trade.basis_coin = exchange_price_log.market
+          AND exchange_trade.time >= exchange_price_log.time
+          AND exchange_trade.time <  exchange_price_log.time + exchange_price_log.interval
+    ), 0);
+    `)
+    return err
+}
+
+// For replaying trades into the price log at startup.
+func migrateAddTradeTimeIndex() error {
+    _, err := Exec(`CREATE INDEX ON exchange_trade (basis_coin, coin, time);`)
+    return err
+}
+
+// Priority orders the book within a price level. It starts out as the id,
+// and icebergs get a new one from the same sequence whenever their slice refreshes.
+func migrateAddOrderIceberg() error {
+    _, err := Exec(`ALTER TABLE exchange_order
+        ADD COLUMN display_amount BIGINT NOT NULL DEFAULT 0,
+        ADD COLUMN priority       BIGINT NOT NULL DEFAULT 0;
+    UPDATE exchange_order SET priority = id;
+    CREATE INDEX ON exchange_order (basis_coin, coin, type, price, priority) WHERE status = 0 AND kind = 'L';
+    `)
+    return err
+}
+
+func migrateCreateOrderGroup() error {
+    _, err := Exec(`CREATE TABLE exchange_order_group (
+        id              BIGSERIAL,
+        kind            CHAR(1)     NOT NULL,
+        user_id         BIGINT      NOT NULL,
+        coin            VARCHAR(4)  NOT NULL,
+        basis_coin      VARCHAR(4)  NOT NULL,
+        status          INT         NOT NULL,
+        time            BIGINT      NOT NULL,
+        updated         BIGINT      NOT NULL,
+
+        PRIMARY KEY (id)
+    );
+    ALTER SEQUENCE exchange_order_group_id_seq START WITH 1;
+    CREATE INDEX ON exchange_order_group (status, user_id, basis_coin, coin) WHERE status = 0;
+    ALTER TABLE exchange_order
+        ADD COLUMN group_id BIGINT NOT NULL DEFAULT 0;
+    CREATE INDEX ON exchange_order (group_id) WHERE group_id <> 0 AND status = 0;
+    `)
+    return err
+}
+
+func migrateAddOrderClientId() error {
+    _, err := Exec(`ALTER TABLE exchange_order
+        ADD COLUMN client_id VARCHAR(36) NOT NULL DEFAULT '';
+    CREATE UNIQUE INDEX ON exchange_order (user_id, client_id) WHERE client_id <> '';
+    `)
+    return err
+}
+
+func migrateCreateHeartbeat() error {
+    _, err := Exec(`CREATE TABLE exchange_heartbeat (
+        api_key         CHAR(24)    NOT NULL,
+        user_id         BIGINT      NOT NULL,
+        timeout         BIGINT      NOT NULL,
+        deadline        BIGINT      NOT NULL,
+
+        PRIMARY KEY (api_key)
+    );
+    CREATE INDEX ON exchange_heartbeat (deadline);
+    CREATE TABLE exchange_auto_cancel (
+        id              BIGSERIAL,
+        user_id         BIGINT      NOT NULL,
+        api_key         CHAR(24)    NOT NULL,
+        deadline        BIGINT      NOT NULL,
+        canceled        BIGINT      NOT NULL,
+        halted          BIGINT      NOT NULL,
+        time            BIGINT      NOT NULL,
+
+        PRIMARY KEY (id)
+    );
+    ALTER SEQUENCE exchange_auto_cancel_id_seq START WITH 1;
+    CREATE INDEX ON exchange_auto_cancel (user_id, time);
+    `)
+    return err
+}
+
+// The matching journal is append-only, and seq gives its order.
+func migrateCreateJournal() error {
+    _, err := Exec(`CREATE TABLE exchange_journal (
+        seq             BIGSERIAL,
+        market          VARCHAR(12) NOT NULL,
+        kind            CHAR(1)     NOT NULL,
+        ref_id          BIGINT      NOT NULL,
+        priority        BIGINT      NOT NULL,
+        data            TEXT        NOT NULL,
+        time            BIGINT      NOT NULL,
+
+        PRIMARY KEY (seq)
+    );
+    ALTER SEQUENCE exchange_journal_seq_seq START WITH 1;
+    CREATE INDEX ON exchange_journal (market, seq);
+    `)
+    return err
+}
+
+// A group reserves funds once for all of its members, see exchange/groups.go.
+// Groups that are already pending hold what their members reserved each.
+func migrateAddOrderGroupReserved() error {
+    _, err := Exec(`ALTER TABLE exchange_order_group
+        ADD COLUMN reserved BIGINT NOT NULL DEFAULT 0;
+    UPDATE exchange_order_group SET reserved = (
+        SELECT COALESCE(SUM(CASE WHEN type='B'
+            THEN basis_amount - basis_filled + basis_fee - basis_fee_filled
+            ELSE amount - filled END), 0)
+        FROM exchange_order
+        WHERE group_id = exchange_order_group.id AND status = 0
+    ) WHERE status = 0;
+    `)
+    return err
+}
+
+// Journal checks start from the latest snapshot of the market's journal.
+func migrateAddJournalStartIndex() error {
+    _, err := Exec(`CREATE INDEX ON exchange_journal (market, seq) WHERE kind = 'S';
+    `)
+    return err
+}
+
 /*
 func migrateCreateBankWithdrawal() error {
     _, err := Exec(`CREATE TABLE account_bank_withdrawal (
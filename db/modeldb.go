@@ -254,7 +254,7 @@ func Begin(level string) (*ModelTx, error) {
     if level == "" { level = "READ COMMITTED" }
     _, err = tx.Exec(`SET TRANSACTION ISOLATION LEVEL `+level)
     if err != nil { return nil, err }
-    return &ModelTx{tx, false}, nil
+    return &ModelTx{Tx:tx}, nil
 }
 
 // Convenience
@@ -412,6 +412,7 @@ func (sdb *ModelDB) QueryAll(proto interface{}, query string, args ...interface{
 type ModelTx struct {
     Tx          *sql.Tx
     Finalized   bool
+    onCommit    []func()
 }
 
 func (stx *ModelTx) Exec(query string, args ...interface{}) (sql.Result, error) {
@@ -437,7 +438,16 @@ func (stx *ModelTx) Rollback() error {
 
 func (stx *ModelTx) Commit() error {
     stx.Finalized = true
-    return stx.Tx.Commit()
+    err := stx.Tx.Commit()
+    if err != nil { return err }
+    for _, f := range stx.onCommit { f() }
+    return nil
+}
+
+// f gets called after the transaction commits, and not at all if it rolls back.
+// Use this for side effects that shouldn't happen twice when DoBegin retries.
+func (stx *ModelTx) OnCommit(f func()) {
+    stx.onCommit = append(stx.onCommit, f)
 }
 
 func (stx *ModelTx) Finalize() {
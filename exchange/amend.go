@@ -0,0 +1,181 @@
+/*
+Amending changes the price or size of a pending limit (or stop limit) order in place,
+instead of canceling & re-adding it, which would go through the queue twice.
+A size decrease keeps the order's place in its price level & releases what it no
+longer needs. A price change or size increase sends the order to the back, as if it
+were new, so it may trade right away.
+Increases get reserved before the amendment is queued, as new orders do. An amendment
+that no longer applies by the time it's processed gives that back.
+*/
+
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/account"
+    "ftnox.com/db"
+)
+
+// A change to a pending order, see AmendOrder(). Zero fields stay as they are.
+type Amendment struct {
+    Price       uint64
+    Amount      uint64
+    BasisAmount uint64
+    reserved    uint64  // reserved by AmendOrder() on top of the order's own reserve
+}
+
+// A copy of order with amendment applied.
+// Bids reserve fees for their new BasisAmount at the same ratio.
+func (order *Order) Amended(amendment *Amendment) *Order {
+    amended := *order
+    amended.Amend = nil
+    if amendment.Price > 0       { amended.Price = amendment.Price }
+    if amendment.Amount > 0      { amended.Amount = amendment.Amount }
+    if amendment.BasisAmount > 0 { amended.BasisAmount = amendment.BasisAmount }
+    if amended.Type == ORDER_TYPE_BID {
+        amended.BasisFee = ComputeFeeReserve(amended.BasisAmount, amended.BasisFeeRatio)
+    }
+    return &amended
+}
+
+// Whether amended order loses its place in the book.
+func requeues(order *Order, amended *Order) bool {
+    return amended.Price != order.Price ||
+        amended.Amount > order.Amount ||
+        amended.BasisAmount > order.BasisAmount
+}
+
+// Returns why amendment can't apply to order as it is now, or nil if it can.
+func CheckAmendment(order *Order, amendment *Amendment) error {
+    if order.Status != ORDER_STATUS_PENDING {
+        return NewError("[order: %v] Only pending orders can be amended", order.Id)
+    }
+    if order.Kind != ORDER_KIND_LIMIT && order.Kind != ORDER_KIND_STOP_LIMIT {
+        return NewError("[order: %v] Only limit orders can be amended", order.Id)
+    }
+    if amendment.Amount > 0 && order.Amount == 0 {
+        return NewError("[order: %v] Order has no amount to amend", order.Id)
+    }
+    if amendment.BasisAmount > 0 && order.BasisAmount == 0 {
+        return NewError("[order: %v] Order has no basis amount to amend", order.Id)
+    }
+    amended := order.Amended(amendment)
+    if amended.Price == order.Price && amended.Amount == order.Amount &&
+       amended.BasisAmount == order.BasisAmount {
+        return NewError("[order: %v] Amendment changes nothing", order.Id)
+    }
+    // Amending an order down to what's filled would complete it without trading,
+    // which is what canceling is for.
+    if amended.Amount > 0 && amended.Amount <= amended.Filled {
+        return NewError("[order: %v] Amount must be more than the %v filled", order.Id, amended.Filled)
+    }
+    if amended.BasisAmount > 0 && amended.BasisAmount <= amended.BasisFilled {
+        return NewError("[order: %v] Basis amount must be more than the %v filled", order.Id, amended.BasisFilled)
+    }
+    if int64(amended.BasisFee) < amended.BasisFeeFilled {
+        return NewError("[order: %v] Basis amount is too small for the fees paid", order.Id)
+    }
+    return nil
+}
+
+// Moves diff from the user's main wallet into order's reserve,
+// or back from the reserve if negative.
+func reserveFunds(tx *db.ModelTx, order *Order, diff int64) {
+    if diff == 0 { return }
+    coin := order.ReserveCoin()
+    account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_MAIN, coin, -diff, diff > 0)
+    account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_RESERVED_ORDER, coin, diff, diff < 0)
+}
+
+// Main entry for amending existing (saved) orders.
+// Reserves what the amendment adds, then queues it for processing.
+func AmendOrder(order *Order, amendment *Amendment) {
+    market := order.Market()
+    if err := CheckAmendment(order, amendment); err != nil { panic(err) }
+    amended := order.Amended(amendment)
+    if requeues(order, amended) && !market.CanAddOrder() {
+        panic(NewError("[order: %v] Market %v isn't taking orders", order.Id, order.MarketName()))
+    } else if !market.CanCancelOrder() {
+        panic(NewError("[order: %v] Market %v is halted", order.Id, order.MarketName()))
+    }
+
+    if amended.Reserve() > order.Reserve() {
+        amendment.reserved = amended.Reserve() - order.Reserve()
+        err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+            reserveFunds(tx, order, int64(amendment.reserved))
+        })
+        if err != nil { panic(err) }
+    }
+    // A copy, since order may be the one in the mempool.
+    request := *order
+    request.Amend = amendment
+    market.ordersCh <- &request
+}
+
+// Applies the amendment that request carries to the order as it is now.
+// Returns the most up-to-date version of the order.
+func (market *Market) ProcessOrderAmendment(request *Order) (*Order) {
+    amendment := request.Amend
+
+    // reload the order, it might have traded or shrunk since.
+    order := LoadOrder(request.Id)
+    amended := order.Amended(amendment)
+    requeue := requeues(order, amended)
+    err := CheckAmendment(order, amendment)
+    if err == nil && requeue && !market.CanAddOrder() {
+        err = NewError("[order: %v] Market %v isn't taking orders", order.Id, order.MarketName())
+    }
+    if err == nil && amended.Reserve() > order.Reserve() + amendment.reserved {
+        err = NewError("[order: %v] Order shrank since the amendment was requested", order.Id)
+    }
+    if err != nil {
+        Warn("Amendment rejected: %v", err)
+        if amendment.reserved > 0 {
+            err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+                reserveFunds(tx, order, -int64(amendment.reserved))
+            })
+            if err != nil { panic(err) }
+        }
+        return order
+    }
+
+    // Out of the book while it changes.
+    var inBook bool
+    if order.IsStop() {
+        inBook = market.Triggers.Remove(order) != nil
+    } else {
+        inBook = market.DropOrderFromMempool(order) != nil
+    }
+
+    err = db.DoBeginSerializable(func(tx *db.ModelTx) {
+        UpdateOrderAmendment(tx, amended)
+        if requeue && !amended.IsStop() { amended.Priority = RefreshOrderPriority(tx, amended) }
+        if amended.GroupId != 0 {
+            // The group holds what was reserved for it, & releases what it doesn't need.
+            addToGroupReserve(tx, amended, int64(amendment.reserved))
+            syncGroupReserve(tx, amended)
+        } else {
+            reserveFunds(tx, amended, int64(amended.Reserve()) - int64(order.Reserve()) - int64(amendment.reserved))
+        }
+    })
+    if err != nil { panic(err) }
+    publishOrder(amended)
+
+    switch {
+    case amended.IsStop():
+        market.Triggers.Insert(amended)
+    case !requeue:
+        if inBook {
+            market.mempool(amended.Type).InsertNoReplace(amended)
+            market.publishLevel(amended.Type, amended.Price)
+        }
+        if market.State() == MARKET_STATE_AUCTION { market.updateIndicative() }
+    case market.State() == MARKET_STATE_AUCTION:
+        market.ProcessAuctionOrder(amended)
+    default:
+        market.ProcessOrderExecution(amended)
+        market.FireTriggers()
+    }
+    if inBook && requeue { market.LoadMore(amended.Type, market.lastOrderId) }
+    return amended
+}
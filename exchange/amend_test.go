@@ -0,0 +1,27 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "testing"
+)
+
+func TestCheckAmendment(t *testing.T) {
+    ask := &Order{Type:"A", Kind:"L", Amount:100, Filled:40, Price:USATOSHI}
+    if CheckAmendment(ask, &Amendment{Amount:60}) != nil { t.Errorf("Expected a decrease to be allowed") }
+    if CheckAmendment(ask, &Amendment{Amount:40}) == nil { t.Errorf("Expected amending down to the filled amount to fail") }
+    if CheckAmendment(ask, &Amendment{BasisAmount:10}) == nil { t.Errorf("Expected an ask without a basis amount to fail") }
+    if CheckAmendment(ask, &Amendment{Price:USATOSHI}) == nil { t.Errorf("Expected an amendment that changes nothing to fail") }
+
+    // Only size decreases keep the order's place.
+    if requeues(ask, ask.Amended(&Amendment{Amount:60})) { t.Errorf("Expected a decrease to keep its place") }
+    if !requeues(ask, ask.Amended(&Amendment{Amount:160})) { t.Errorf("Expected an increase to requeue") }
+    if !requeues(ask, ask.Amended(&Amendment{Price:2*USATOSHI})) { t.Errorf("Expected a price change to requeue") }
+
+    // Bids reserve fees for the new basis amount.
+    bid := &Order{Type:"B", Kind:"L", BasisAmount:1000, BasisFee:10, BasisFeeRatio:0.01, Price:USATOSHI}
+    if amended := bid.Amended(&Amendment{BasisAmount:500}); amended.Reserve() != 505 {
+        t.Errorf("Expected to reserve 505, got %v", amended.Reserve())
+    }
+    bid.Kind = "M"
+    if CheckAmendment(bid, &Amendment{BasisAmount:500}) == nil { t.Errorf("Expected a market order to fail") }
+}
@@ -0,0 +1,218 @@
+/*
+A call auction (MARKET_STATE_AUCTION) lets orders accumulate in the book without
+matching, so the book may cross. At the uncross, everything that crosses trades at
+the single clearing price that maximizes volume, then continuous trading resumes.
+Markets resume from a halt (or cancel-only) through an auction of AuctionDuration
+seconds. Auctions that admins start explicitly with no AuctionDuration last until
+an admin opens the market.
+While the auction runs, the indicative price & volume get published to the
+"auction" feed channel after every change to the book.
+*/
+
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/kvstore"
+    "github.com/jaekwon/GoLLRB/llrb"
+    "math"
+    "time"
+)
+
+// What the auction would uncross at as of now.
+type Indicative struct {
+    Price       uint64  `json:"price"`
+    Volume      uint64  `json:"volume"`     // in coin
+    End         int64   `json:"end"`        // when the auction uncrosses, 0 if it waits for an admin
+}
+
+// The amount bid would buy at price, which may be better than its own.
+func bidAmountAt(bid *Order, price uint64) uint64 {
+    amount := uint64(math.MaxUint64)
+    if bid.Amount > 0 { amount = bid.Amount - bid.Filled }
+    if bid.BasisAmount > 0 {
+        amount = MinUint64(amount, AmountForBasis(bid.BasisAmount - bid.BasisFilled, price))
+    }
+    return amount
+}
+
+func absDiff(a, b uint64) uint64 {
+    if a > b { return a - b }
+    return b - a
+}
+
+// The price at which the most volume trades, considering the prices of bids & asks.
+// Ties go to the least imbalance between demand & supply, then to the price closest
+// to reference, then to the lower price.
+// Returns zeros if nothing crosses.
+func clearingPrice(bids []*Order, asks []*Order, reference uint64) (price uint64, volume uint64) {
+    var imbalance uint64
+    candidates := []uint64{}
+    for _, bid := range bids { candidates = append(candidates, bid.Price) }
+    for _, ask := range asks { candidates = append(candidates, ask.Price) }
+    for _, p := range candidates {
+        var demand, supply uint64
+        for _, bid := range bids {
+            if p <= bid.Price { demand += bidAmountAt(bid, p) }
+        }
+        for _, ask := range asks {
+            if ask.Price <= p { supply += ask.Amount - ask.Filled }
+        }
+        v := MinUint64(demand, supply)
+        if v == 0 || v < volume { continue }
+        imb := absDiff(demand, supply)
+        if v == volume {
+            if imb > imbalance { continue }
+            if imb == imbalance {
+                d, best := absDiff(p, reference), absDiff(price, reference)
+                if d > best || (d == best && p >= price) { continue }
+            }
+        }
+        price, volume, imbalance = p, v, imb
+    }
+    return
+}
+
+// Whether the best bid is at or above the best ask.
+func (market *Market) Crossed() bool {
+    bestBid, bestAsk := market.BestBidPrice(), market.BestAskPrice()
+    return bestBid > 0 && bestAsk > 0 && bestAsk <= bestBid
+}
+
+// The clearing price & volume of the crossed part of the mempool.
+func (market *Market) ComputeIndicative() (price uint64, volume uint64) {
+    if !market.Crossed() { return 0, 0 }
+    bestBid, bestAsk := market.BestBidPrice(), market.BestAskPrice()
+    var bids, asks []*Order
+    market.Bids.AscendGreaterOrEqual(market.Bids.Min(), func(i llrb.Item) bool {
+        bid := i.(*Order)
+        if bid.Price < bestAsk { return false }
+        bids = append(bids, bid)
+        return true
+    })
+    market.Asks.AscendGreaterOrEqual(market.Asks.Min(), func(i llrb.Item) bool {
+        ask := i.(*Order)
+        if bestBid < ask.Price { return false }
+        asks = append(asks, ask)
+        return true
+    })
+    return clearingPrice(bids, asks, market.BandReferencePrice())
+}
+
+// The auction's indicative price & volume, or nil if there's no auction.
+func (market *Market) Indicative() *Indicative {
+    market.stateMtx.Lock()
+    defer market.stateMtx.Unlock()
+    if market.state != MARKET_STATE_AUCTION { return nil }
+    indicative := Indicative{End:market.auctionEnd}
+    if market.indicative != nil {
+        indicative.Price, indicative.Volume = market.indicative.Price, market.indicative.Volume
+    }
+    return &indicative
+}
+
+// Call this from the market's goroutine after the book changes during an auction.
+func (market *Market) updateIndicative() {
+    price, volume := market.ComputeIndicative()
+    market.stateMtx.Lock()
+    market.indicative = &Indicative{price, volume, market.auctionEnd}
+    indicative := *market.indicative
+    market.stateMtx.Unlock()
+    market.publishAuction("indicative", &indicative)
+}
+
+// During an auction, orders rest without matching until the uncross.
+// Orders that can't rest get canceled, as do expired ones.
+func (market *Market) ProcessAuctionOrder(order *Order) {
+    if !order.CanRest() || order.Expired(time.Now().Unix()) {
+        market.CancelUnfilled(order)
+        return
+    }
+    market.InsertIfInRange(order)
+    market.updateIndicative()
+}
+
+// Sets when the auction uncrosses, AuctionDuration from now.
+// If resuming, an auction with no AuctionDuration uncrosses right away,
+// otherwise it waits for an admin.
+// Must hold market.stateMtx.
+func (market *Market) scheduleUncross(resuming bool) {
+    market.indicative = nil
+    if market.AuctionDuration > 0 {
+        market.auctionEnd = time.Now().Unix() + market.AuctionDuration
+        time.AfterFunc(time.Duration(market.AuctionDuration) * time.Second, market.requestUncross)
+    } else if resuming {
+        market.auctionEnd = time.Now().Unix()
+        market.requestUncross()
+    } else {
+        market.auctionEnd = 0
+    }
+}
+
+// Has the market's goroutine uncross the auction if it's due, see ProcessNextOrder().
+func (market *Market) requestUncross() {
+    select {
+    case market.uncrossCh <- struct{}{}:
+    default: // one is already pending
+    }
+}
+
+// Ends the auction now, from any goroutine.
+func (market *Market) endAuction() {
+    market.stateMtx.Lock()
+    market.auctionEnd = time.Now().Unix()
+    market.stateMtx.Unlock()
+    market.requestUncross()
+}
+
+func (market *Market) uncrossDue(now int64) bool {
+    market.stateMtx.Lock()
+    defer market.stateMtx.Unlock()
+    return market.state == MARKET_STATE_AUCTION && market.auctionEnd != 0 && market.auctionEnd <= now
+}
+
+// Trades the crossed part of the book at the clearing price, then switches
+// an auction to continuous trading.
+// The later of each bid & ask is the taker, as it would have been in continuous trading.
+// Call this from the market's goroutine.
+func (market *Market) Uncross() {
+    price, volume := market.ComputeIndicative()
+    for volume > 0 {
+        bid, _ := market.Bids.Min().(*Order)
+        ask, _ := market.Asks.Min().(*Order)
+        if bid == nil || ask == nil || bid.Price < price || price < ask.Price { break }
+        order, match := bid, ask
+        if bid.Id < ask.Id { order, match = ask, bid }
+
+        if order.UserId == match.UserId {
+            if market.PreventSelfTrade(order, match) {
+                market.DropOrderFromMempool(order)
+                market.LoadMore(order.Type, market.lastOrderId)
+            } else {
+                market.publishLevel(order.Type, order.Price)
+            }
+            continue
+        }
+
+        market.executeTrade(order, match, price)
+        if order.Complete() {
+            market.DropOrderFromMempool(order)
+            market.LoadMore(order.Type, market.lastOrderId)
+        } else {
+            market.publishLevel(order.Type, order.Price)
+        }
+    }
+
+    market.stateMtx.Lock()
+    wasAuction := market.state == MARKET_STATE_AUCTION
+    if wasAuction {
+        kvstore.Set(marketStateKey(market.Name()), MARKET_STATE_OPEN)
+        market.state = MARKET_STATE_OPEN
+        market.auctionEnd = 0
+        market.indicative = nil
+    }
+    market.stateMtx.Unlock()
+    Info("[%v] Uncrossed %v at %v", market.Name(), volume, price)
+    market.publishAuction("uncross", &Indicative{Price:price, Volume:volume})
+    market.FireTriggers()
+}
@@ -0,0 +1,41 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "testing"
+)
+
+func TestClearingPrice(t *testing.T) {
+    bids := []*Order{
+        &Order{Type:ORDER_TYPE_BID, Price:12*USATOSHI, Amount:USATOSHI},
+        &Order{Type:ORDER_TYPE_BID, Price:11*USATOSHI, Amount:USATOSHI},
+        &Order{Type:ORDER_TYPE_BID, Price:10*USATOSHI, Amount:2*USATOSHI},
+    }
+    asks := []*Order{
+        &Order{Type:ORDER_TYPE_ASK, Price:9*USATOSHI,  Amount:USATOSHI},
+        &Order{Type:ORDER_TYPE_ASK, Price:10*USATOSHI, Amount:USATOSHI},
+        &Order{Type:ORDER_TYPE_ASK, Price:11*USATOSHI, Amount:2*USATOSHI},
+    }
+
+    // 10 & 11 both trade 2 with an imbalance of 2.
+    if price, volume := clearingPrice(bids, asks, 0); price != 10*USATOSHI || volume != 2*USATOSHI {
+        t.Errorf("Expected the lower price without a reference, got %v %v", price, volume)
+    }
+    if price, volume := clearingPrice(bids, asks, 11*USATOSHI); price != 11*USATOSHI || volume != 2*USATOSHI {
+        t.Errorf("Expected the price closest to the reference, got %v %v", price, volume)
+    }
+
+    // Bids for a basis amount buy more at lower prices,
+    // so 10 has an imbalance of 3 and 11 wins.
+    bids[2] = &Order{Type:ORDER_TYPE_BID, Price:10*USATOSHI, BasisAmount:30*USATOSHI}
+    if price, volume := clearingPrice(bids, asks, 0); price != 11*USATOSHI || volume != 2*USATOSHI {
+        t.Errorf("Expected the least imbalance, got %v %v", price, volume)
+    }
+
+    if price, volume := clearingPrice(bids, asks[2:], 0); price != 11*USATOSHI || volume != 2*USATOSHI {
+        t.Errorf("Expected 2 at 11, got %v %v", price, volume)
+    }
+    if price, volume := clearingPrice(bids[1:], []*Order{&Order{Type:ORDER_TYPE_ASK, Price:12*USATOSHI, Amount:USATOSHI}}, 0); price != 0 || volume != 0 {
+        t.Errorf("Expected nothing to cross, got %v %v", price, volume)
+    }
+}
@@ -0,0 +1,47 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/alert"
+    "fmt"
+    "math"
+)
+
+// pct percent of price, exact to a ten thousandth of a percent.
+func pctOfPrice(price uint64, pct float64) uint64 {
+    return MulDivRoundUint64(price, uint64(RoundFloat64(pct * 10000)), 100 * 10000)
+}
+
+// The last trade price, or the configured ReferencePrice before the first trade.
+func (market *Market) BandReferencePrice() uint64 {
+    last := market.PriceLogger.LastPrice()
+    if last != 0 { return last }
+    return market.ReferencePrice
+}
+
+// The lowest & highest prices that trades may happen at, inclusive.
+// Returns 0 & math.MaxUint64 if the market has no band, or no reference price.
+func (market *Market) PriceBand() (low uint64, high uint64) {
+    reference := market.BandReferencePrice()
+    if market.PriceBandPct == 0 || reference == 0 { return 0, math.MaxUint64 }
+    delta := pctOfPrice(reference, market.PriceBandPct)
+    return reference - delta, reference + delta
+}
+
+// Whether the range of prices low to high is more than pct percent of low.
+func movedMoreThan(low uint64, high uint64, pct float64) bool {
+    if low == 0 { return false }
+    return high - low > pctOfPrice(low, pct)
+}
+
+// Halts the market if the price moved too much within the circuit breaker's window,
+// as measured by the PriceLogger's ticker. Call this after each trade.
+func (market *Market) CheckCircuitBreaker(now int64) {
+    cb := market.CircuitBreaker
+    if cb == nil { return }
+    low, high := market.PriceLogger.Ticker.Range(now - cb.Window)
+    if !movedMoreThan(low, high, cb.MovePct) { return }
+    if !market.HaltFor(cb.Halt) { return }
+    alert.Alert(fmt.Sprintf("[%v] Circuit breaker tripped, price moved between %v and %v within %vs. Halted for %vs",
+        market.Name(), PriceToF64(low), PriceToF64(high), cb.Window, cb.Halt))
+}
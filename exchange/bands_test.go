@@ -0,0 +1,45 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "math"
+    "testing"
+)
+
+func TestPriceBand(t *testing.T) {
+    market := &Market{PriceLogger:&PriceLogger{}, PriceBandPct:10}
+    if low, high := market.PriceBand(); low != 0 || high != math.MaxUint64 {
+        t.Errorf("Expected no band without a reference price, got %v %v", low, high)
+    }
+    market.ReferencePrice = 100*USATOSHI
+    if low, high := market.PriceBand(); low != 90*USATOSHI || high != 110*USATOSHI {
+        t.Errorf("Expected a band around the reference price, got %v %v", low, high)
+    }
+    market.PriceLogger.current = &PriceLog{Close:200*USATOSHI}
+    if low, high := market.PriceBand(); low != 180*USATOSHI || high != 220*USATOSHI {
+        t.Errorf("Expected a band around the last trade, got %v %v", low, high)
+    }
+}
+
+func TestCircuitBreakerMove(t *testing.T) {
+    ticker := &Ticker{Market:"TEST", Interval:60}
+    //              Type, Amount,   Basis,        Price,        Time
+    ticker.AddTrade("A",  USATOSHI, 10*USATOSHI,  10*USATOSHI,  0)
+    ticker.AddTrade("B",  USATOSHI, 11*USATOSHI,  11*USATOSHI,  60)
+    ticker.AddTrade("B",  USATOSHI, 12*USATOSHI,  12*USATOSHI,  120)
+
+    low, high := ticker.Range(60)
+    if low != 11*USATOSHI || high != 12*USATOSHI { t.Errorf("Expected the range since 60 to be 11 to 12, got %v %v", low, high) }
+    if movedMoreThan(low, high, 10)  { t.Errorf("Expected 11 to 12 to be within 10%%") }
+    low, high = ticker.Range(0)
+    if !movedMoreThan(low, high, 10) { t.Errorf("Expected 10 to 12 to be more than 10%%") }
+    if movedMoreThan(0, 0, 10)       { t.Errorf("Expected no trades to be no move") }
+
+    market := &Market{state:MARKET_STATE_OPEN}
+    if !market.HaltFor(60) || market.State() != MARKET_STATE_HALTED || market.HaltedUntil() == 0 {
+        t.Errorf("Expected an open market to halt")
+    }
+    if market.HaltFor(60) { t.Errorf("Expected a halted market not to halt again") }
+    market.endTimedHalt()
+    if market.State() != MARKET_STATE_HALTED { t.Errorf("Expected the halt not to end early") }
+}
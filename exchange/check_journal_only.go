@@ -0,0 +1,6 @@
+// +build check_journal
+
+package exchange
+
+// Built into bin/check_journal, which mustn't load the markets, see init().
+const JOURNAL_CHECK_ONLY = true
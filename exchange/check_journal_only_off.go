@@ -0,0 +1,5 @@
+// +build !check_journal
+
+package exchange
+
+const JOURNAL_CHECK_ONLY = false
@@ -2,20 +2,26 @@ package exchange
 
 import (
     . "ftnox.com/common"
+    . "ftnox.com/config"
     "ftnox.com/account"
     "ftnox.com/db"
     "github.com/jaekwon/GoLLRB/llrb"
     "math"
+    "sync"
+    "time"
 )
 
 const (
     MIN_MEMPOOL = 800
     MAX_MEMPOOL = 1200
-)
+    MAX_QUEUE   = 200
+
+    // Market orders reserve this many percent more than the book says they'll need.
+    MARKET_ORDER_SLIPPAGE_PCT = 5
 
-// All orders go through this channel for processing & cancellations.
-// TODO create a channel for each market, thus parallelizing execution.
-var ordersCh = make(chan *Order, 200)
+    // Most trades returned by the trade history & trades APIs at once.
+    MAX_TRADES_PAGE = 200
+)
 
 // Global, all the markets.
 var Markets = map[string]*Market{}
@@ -24,46 +30,113 @@ var MarketNames = []string{}
 
 func init() {
     if false{ Info("") }
-    initMarkets()
+    // bin/check_journal only reads, and loading markets processes orders.
+    if !JOURNAL_CHECK_ONLY { initMarkets() }
 }
 
+// Loads the markets in Config.Markets, except disabled ones.
 func initMarkets() {
-    var markets = []*Market{}
-    // TODO: refactor out to config
-    markets = append(markets, CreateMarket("USD", "BTC"))
-    markets = append(markets, CreateMarket("USD", "LTC"))
-
-    for _, market := range markets {
-        marketName := market.Coin+"/"+market.BasisCoin
-        Markets[marketName] = market
-        MarketNames = append(MarketNames, marketName)
+    for _, mcfg := range Config.Markets {
+        if mcfg.Disabled { continue }
+        LoadMarket(mcfg)
     }
 }
 
+// Creates the market & lists it after the ones already loaded.
+// Markets isn't locked, so this is for init & tests.
+func LoadMarket(mcfg *MarketConfig) *Market {
+    if Markets[mcfg.Name()] != nil { panic(NewError("Market %v is already loaded", mcfg.Name())) }
+    market := CreateMarket(mcfg)
+    Markets[market.Name()] = market
+    MarketNames = append(MarketNames, market.Name())
+    return market
+}
+
 // Main entry for adding a new order.
-// The order gets saved, funds reserved, and added to ordersCh for processing.
+// The order gets saved, funds reserved, and added to the market's queue for processing.
 // order.Id gets set.
-func AddOrder(order *Order) {
+// Orders with a ClientId get added once: resubmitting one returns the order that
+// was saved the first time, which doesn't get queued again.
+// Returns the saved order.
+func AddOrder(order *Order) *Order {
+    prepareOrder(order)
+    err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+        saveAndReserveFundsForOrder(tx, order)
+    })
+    switch db.GetErrorType(err) {
+    case db.ERR_DUPLICATE_ENTRY:
+        if order.ClientId == "" { panic(err) }
+        return LoadOrderByClientId(order.UserId, order.ClientId)
+    default:
+        if err != nil { panic(err) }
+    }
+    publishOrder(order)
+    order.Market().ordersCh <- order
+    return order
+}
+
+// Fills in defaults & the bid fee reserve, then validates the order for its market.
+func prepareOrder(order *Order) {
+    if order.Kind == ""        { order.Kind = ORDER_KIND_LIMIT }
+    if order.TimeInForce == "" {
+        if order.Kind == ORDER_KIND_MARKET || order.Kind == ORDER_KIND_STOP {
+            order.TimeInForce = ORDER_TIF_IOC
+        } else {
+            order.TimeInForce = ORDER_TIF_GTC
+        }
+    }
+    if order.SelfTradePolicy == "" { order.SelfTradePolicy = ORDER_STP_CANCEL_NEWEST }
+    // Bids reserve the largest fee they could be charged.
+    if order.Type == ORDER_TYPE_BID {
+        order.BasisFeeRatio = MaxFeeRatio(order.BasisCoin, order.Coin)
+        order.BasisFee = ComputeFeeReserve(order.BasisAmount, order.BasisFeeRatio)
+    }
     order.Validate()
-    SaveAndReserveFundsForOrder(order)
-    ordersCh <- order
+    if !order.Market().CanAddOrder() {
+        panic(NewError("[order: %v] Market %v isn't taking orders", order.Id, order.MarketName()))
+    }
+    tickSize := order.Market().TickSize
+    if order.Price % tickSize != 0 || order.StopPrice % tickSize != 0 {
+        panic(NewError("[order: %v] Price must be a multiple of the tick size %v", order.Id, tickSize))
+    }
 }
 
 // Main entry for canceling existing (saved) orders.
 func CancelOrder(order *Order) {
+    if !order.Market().CanCancelOrder() {
+        panic(NewError("[order: %v] Market %v is halted", order.Id, order.MarketName()))
+    }
+    queueCancellation(order)
+}
+
+// Queues the cancellation of order, even if its market is halted.
+// Halted markets don't trade, so releasing the order's funds there is safe.
+func queueCancellation(order *Order) {
     order.Validate()
     order.Cancel = true
-    ordersCh <- order
+    order.Market().ordersCh <- order
 }
 
-// This gets called by the daemon.
-// NOTE: in the future, this will take a 'market' parameter such that
-// each market can run in its own goroutine.
-// TODO: refactor & make this a method of Market.
-func ProcessNextOrder() (*Order) {
-    // Process next order.
-    var order = <-ordersCh
-    return order.Market().ProcessOrder(order)
+// Queues cancellations for the user's pending orders in markets,
+// on orderType's side or on both if "".
+// Returns the orders queued for cancellation, and the ones left alone
+// because their market is halted.
+// Each market's state is read once, so a halt in the meantime doesn't fail
+// the cancellations partway through.
+func CancelAllOrders(userId int64, markets []*Market, orderType string) (canceled []*Order, halted []*Order) {
+    for _, market := range markets {
+        canCancel := market.CanCancelOrder()
+        for _, order := range LoadPendingOrdersByUser(userId, market.BasisCoin, market.Coin) {
+            if orderType != "" && order.Type != orderType { continue }
+            if !canCancel {
+                halted = append(halted, order)
+                continue
+            }
+            queueCancellation(order)
+            canceled = append(canceled, order)
+        }
+    }
+    return
 }
 
 // A market is where exchanges occur between two currencies.
@@ -72,15 +145,62 @@ func ProcessNextOrder() (*Order) {
 type Market struct {
     Coin        string
     BasisCoin   string
+    TickSize    uint64      // prices must be a multiple of this, see PRICE_SCALE
+    MinTrade    uint64      // smallest order Amount, in Coin
+    BasisMinTrade uint64    // smallest order BasisAmount, in BasisCoin
     Bids        *llrb.LLRB  // min is the best (highest) bid
     Asks        *llrb.LLRB  // min is the best (lowest)  ask
     HasMoreBids bool
     HasMoreAsks bool
     PriceLogger *PriceLogger
+    Triggers    *TriggerBook // stop orders that haven't triggered yet
+    PriceBandPct float64    // see PriceBand()
+    ReferencePrice uint64   // for PriceBand() before the first trade
+    CircuitBreaker *CircuitBreaker // nil for none
+    AuctionDuration int64   // seconds of call auction when resuming from a halt, see auction.go
+    ordersCh    chan *Order // all orders for this market go through here, for processing & cancellations.
+    triggered   []*Order    // triggered stop orders, processed before anything in ordersCh
+    uncrossCh   chan struct{} // requests an uncross from the market's goroutine
+    lastOrderId int64       // the greatest id of the orders processed so far
+    journaled   int         // commands journaled since the last snapshot, see journalCommand()
+    state       string      // see MARKET_STATE_*
+    haltedUntil int64       // when a timed halt ends, see HaltFor()
+    auctionEnd  int64       // when the auction uncrosses, 0 if not scheduled
+    indicative  *Indicative // the auction's uncross price & volume as of now
+    stateMtx    sync.Mutex
+}
+
+func (market *Market) Name() string {
+    return MarketName(market.Coin, market.BasisCoin)
+}
+
+// This gets called by the daemon, which runs one goroutine per market.
+// Blocks until the next order for this market is available.
+// Triggered stop orders go first.
+// Returns the most up-to-date version of the order,
+// or nil if it uncrossed an auction instead, see auction.go.
+func (market *Market) ProcessNextOrder() (*Order) {
+    if len(market.triggered) > 0 {
+        order := market.triggered[0]
+        market.triggered = market.triggered[1:]
+        return market.ProcessOrder(order)
+    }
+    select {
+    case order := <-market.ordersCh:
+        return market.ProcessOrder(order)
+    case <-market.uncrossCh:
+        if market.uncrossDue(time.Now().Unix()) { market.Uncross() }
+        return nil
+    }
+}
+
+// Number of orders waiting to be processed.
+func (market *Market) QueueDepth() int {
+    return len(market.ordersCh) + len(market.triggered)
 }
 
 // Returns the maximum bid price, or 0 if no bids.
-func (market *Market) BestBidPrice() (maxBid float64) {
+func (market *Market) BestBidPrice() (maxBid uint64) {
     if market.Bids.Len() > 0 {
         maxBid = market.Bids.Min().(*Order).Price
     }
@@ -88,7 +208,7 @@ func (market *Market) BestBidPrice() (maxBid float64) {
 }
 
 // Returns the minum ask price, or 0 if no asks.
-func (market *Market) BestAskPrice() (minAsk float64) {
+func (market *Market) BestAskPrice() (minAsk uint64) {
     if market.Asks.Len() > 0 {
         minAsk = market.Asks.Min().(*Order).Price
     }
@@ -98,6 +218,7 @@ func (market *Market) BestAskPrice() (minAsk float64) {
 // Inserts an order into market.Bids/Asks if in range.
 // `order` is assumed to be unexecutable.
 // Updates market.HasMoreBids/Asks as necessary.
+// Changed levels get published to the book feed.
 func (market *Market) InsertIfInRange(order *Order) {
 
     // Insert into market.Bids/Asks
@@ -106,10 +227,14 @@ func (market *Market) InsertIfInRange(order *Order) {
            market.Bids.Max().(*Order).Price < order.Price {
             // Insert
             market.Bids.InsertNoReplace(order)
+            market.publishLevel(order.Type, order.Price)
             // If there are too many, prune one.
             if market.Bids.Len() > MAX_MEMPOOL {
                 pruned := market.Bids.DeleteMax()
-                if pruned != nil { market.HasMoreBids = true }
+                if pruned != nil {
+                    market.HasMoreBids = true
+                    market.publishLevel(order.Type, pruned.(*Order).Price)
+                }
             }
         } else {
             market.HasMoreBids = true
@@ -119,10 +244,14 @@ func (market *Market) InsertIfInRange(order *Order) {
            order.Price < market.Asks.Max().(*Order).Price {
             // Insert
             market.Asks.InsertNoReplace(order)
+            market.publishLevel(order.Type, order.Price)
             // If there are too many, prune one.
             if market.Asks.Len() > MAX_MEMPOOL {
                 pruned := market.Asks.DeleteMax()
-                if pruned != nil { market.HasMoreAsks = true }
+                if pruned != nil {
+                    market.HasMoreAsks = true
+                    market.publishLevel(order.Type, pruned.(*Order).Price)
+                }
             }
         } else {
             market.HasMoreAsks = true
@@ -130,11 +259,12 @@ func (market *Market) InsertIfInRange(order *Order) {
     }
 }
 
-// Loads more bids or orders, updating .Asks/.HasMoreAsks or .Bids/.HasMoreBids.
+// Loads more bids or asks, updating .Bids/.HasMoreBids or .Asks/.HasMoreAsks.
+// orderType: The side that orders were dropped from.
 // lastOrderId: We need this for the 'maxId' parameter of loadLimitBids/loadLimitAsks.
 //              It must be the same as the result of LastCompletedOrderId()
 func (market *Market) LoadMore(orderType string, lastOrderId int64) {
-    if orderType == ORDER_TYPE_BID {
+    if orderType == ORDER_TYPE_ASK {
         // Maybe we need to load more asks.
         if market.HasMoreAsks && market.Asks.Len() < MIN_MEMPOOL {
             if market.Asks.Len() == 0 { panic("market.HasMoreAsks but no asks in mempool?") }
@@ -143,13 +273,14 @@ func (market *Market) LoadMore(orderType string, lastOrderId int64) {
                 market.Coin,
                 (MAX_MEMPOOL - MIN_MEMPOOL)/2,
                 market.Asks.Max().(*Order).Price,
-                market.Asks.Max().(*Order).Id,
+                market.Asks.Max().(*Order).Priority,
                 lastOrderId,
             )
             for _, ask := range moreAsks {
                 market.Asks.InsertNoReplace(llrb.Item(ask))
             }
             market.HasMoreAsks = hasMoreAsks
+            market.publishLevels(ORDER_TYPE_ASK, moreAsks)
         }
     } else {
         // Maybe we need to load more bids.
@@ -160,26 +291,28 @@ func (market *Market) LoadMore(orderType string, lastOrderId int64) {
                 market.Coin,
                 (MAX_MEMPOOL - MIN_MEMPOOL)/2,
                 market.Bids.Max().(*Order).Price,
-                market.Bids.Max().(*Order).Id,
+                market.Bids.Max().(*Order).Priority,
                 lastOrderId,
             )
             for _, bid := range moreBids {
                 market.Bids.InsertNoReplace(llrb.Item(bid))
             }
             market.HasMoreBids = hasMoreBids
+            market.publishLevels(ORDER_TYPE_BID, moreBids)
         }
     }
 }
 
 // Given a new order, finds the next match, or returns nil
 // if not executable.
+// Market orders match whatever is at the top of the book.
 func (market *Market) NextMatch(order *Order) *Order {
     if order.Type == ORDER_TYPE_BID {
         nxt, ok := market.Asks.Min().(*Order)
-        if ok && nxt.Price <= order.Price { return nxt }
+        if ok && order.Crosses(nxt) { return nxt }
     } else if order.Type == ORDER_TYPE_ASK {
         nxt, ok := market.Bids.Min().(*Order)
-        if ok && order.Price <= nxt.Price { return nxt }
+        if ok && order.Crosses(nxt) { return nxt }
     } else {
         panic(NewError("Unexpected order type %v", order.Type))
     }
@@ -189,29 +322,88 @@ func (market *Market) NextMatch(order *Order) *Order {
 // Removes order from mempool.
 // The caller is responsible for calling market.LoadMore() afterwards.
 func (market *Market) DropOrderFromMempool(order *Order) *Order {
+    var dropped *Order
     if order.Type == ORDER_TYPE_BID {
-        dropped, _ := market.Bids.Delete(order).(*Order)
-        return dropped
+        dropped, _ = market.Bids.Delete(order).(*Order)
     } else if order.Type == ORDER_TYPE_ASK {
-        dropped, _ := market.Asks.Delete(order).(*Order)
-        return dropped
+        dropped, _ = market.Asks.Delete(order).(*Order)
     } else {
         panic(NewError("Unexpected order type %v", order.Type))
     }
+    if dropped != nil { market.publishLevel(dropped.Type, dropped.Price) }
+    return dropped
+}
+
+// Moves an order in the mempool to its new priority.
+// If the mempool doesn't hold the whole book, orders that weren't loaded might
+// now come first, so an order that would be last gets left for LoadMore().
+func (market *Market) requeue(order *Order, priority int64) {
+    book, hasMore := market.Bids, market.HasMoreBids
+    if order.Type == ORDER_TYPE_ASK { book, hasMore = market.Asks, market.HasMoreAsks }
+    book.Delete(order)
+    order.Priority = priority
+    if hasMore && book.Len() > 0 && book.Max().(*Order).Less(order) {
+        market.LoadMore(order.Type, market.lastOrderId)
+        return
+    }
+    book.InsertNoReplace(order)
 }
 
 // Process an order synchronously.
 // Returns the most up-to-date version of the order.
 func (market *Market) ProcessOrder(order *Order) (*Order) {
+    market.journalCommand(order)
+    if order.Amend != nil { return market.ProcessOrderAmendment(order) }
+    if !order.Cancel && order.Id > market.lastOrderId { market.lastOrderId = order.Id }
+    // Siblings may have shrunk or canceled a grouped order while it was queued.
+    if !order.Cancel && order.GroupId != 0 {
+        order = LoadOrder(order.Id)
+        if order.Status != ORDER_STATUS_PENDING { return order }
+    }
     if order.Cancel {
         order := market.ProcessOrderCancellation(order)
         return order
+    } else if !market.CanAddOrder() {
+        // Queued before the market stopped taking orders.
+        market.CancelUnfilled(order)
+        return order
+    } else if order.IsStop() {
+        market.ProcessStopOrder(order)
+        return order
+    } else if market.State() == MARKET_STATE_AUCTION {
+        market.ProcessAuctionOrder(order)
+        return order
     } else {
         market.ProcessOrderExecution(order)
+        market.FireTriggers()
         return order
     }
 }
 
+// Stop orders wait in market.Triggers, unless the last trade already triggers them.
+func (market *Market) ProcessStopOrder(order *Order) {
+    market.Triggers.Insert(order)
+    market.FireTriggers()
+}
+
+// Converts the stop orders triggered by the last trade price into
+// market or limit orders, and queues them up for processing.
+func (market *Market) FireTriggers() {
+    // They stay in the trigger book until continuous trading resumes.
+    if market.State() != MARKET_STATE_OPEN { return }
+    lastPrice := market.PriceLogger.LastPrice()
+    if lastPrice == 0 { return }
+    for _, order := range market.Triggers.PopTriggered(lastPrice) {
+        order.Trigger()
+        err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+            UpdateOrderKind(tx, order)
+        })
+        if err != nil { panic(err) }
+        publishOrder(order)
+        market.triggered = append(market.triggered, order)
+    }
+}
+
 // Cancels an existing order.
 // Returns the most up-to-date version of order.
 func (market *Market) ProcessOrderCancellation(order *Order) (*Order) {
@@ -225,12 +417,17 @@ func (market *Market) ProcessOrderCancellation(order *Order) (*Order) {
     default: panic(NewError("Unrecognized order status %v", order.Status))
     }
 
-    // remove it from mempool
-    dropped := market.DropOrderFromMempool(order)
-    if dropped != nil {
-        market.LoadMore(order.Type, order.Id)
+    // remove it from mempool, or from the trigger book if it's a stop order.
+    if order.IsStop() {
+        market.Triggers.Remove(order)
+    } else {
+        dropped := market.DropOrderFromMempool(order)
+        if dropped != nil {
+            market.LoadMore(order.Type, market.lastOrderId)
+        }
     }
 
+    var siblings []*Order
     err := db.DoBeginSerializable(func(tx *db.ModelTx) {
         // save the status as canceled
         order.Status = ORDER_STATUS_CANCELED
@@ -238,8 +435,13 @@ func (market *Market) ProcessOrderCancellation(order *Order) (*Order) {
 
         // return the reserved funds
         ReleaseReservedFundsForOrder(tx, order)
+
+        siblings = cancelSiblings(tx, order, ORDER_STATUS_CANCELED)
     })
     if err != nil { panic(err) }
+    publishOrder(order)
+    market.syncSiblings(siblings)
+    if market.State() == MARKET_STATE_AUCTION { market.updateIndicative() }
     return order
 }
 
@@ -248,11 +450,27 @@ func (market *Market) ProcessOrderCancellation(order *Order) (*Order) {
 // If the order is executable, it gets executed as well.
 // If the order is not executable, or after execution it is
 // not complete and no longer executable, it gets added
-// into the mempool.
+// into the mempool, unless it can't rest (market orders, IOC, FOK),
+// in which case the remainder gets canceled.
+// Orders that violate their time in force get canceled without trading.
+// Matches from the same user are handled by PreventSelfTrade instead of trading.
 func (market *Market) ProcessOrderExecution(order *Order) {
     if order.Id == 0 { panic("Order hasn't been saved yet") }
     if order.Complete() { panic("New order is already complete.") }
 
+    // Enforce time in force before touching the book.
+    switch order.TimeInForce {
+    case ORDER_TIF_POST_ONLY:
+        if market.NextMatch(order) != nil { market.CancelUnfilled(order); return }
+    case ORDER_TIF_FOK:
+        if !market.CanFill(order)         { market.CancelUnfilled(order); return }
+    case ORDER_TIF_GTT:
+        if order.Expired(time.Now().Unix()) { market.CancelUnfilled(order); return }
+    }
+
+    // Trades stay within the price band as of the order's arrival.
+    bandLow, bandHigh := market.PriceBand()
+
     // Until order is complete, or there are no more matches...
     for {
 
@@ -260,86 +478,20 @@ func (market *Market) ProcessOrderExecution(order *Order) {
         if match != nil {
             if match.Complete() { panic(NewError("Match %v is already complete.", match.Id)) }
 
-            // Figure out which is bid & ask.
-            var bid, ask *Order
-            if order.Type == ORDER_TYPE_BID {
-                bid, ask = order, match
-            } else {
-                bid, ask = match, order
+            // Stop at the band, or if the circuit breaker tripped.
+            // The rest would cross the book, so it gets canceled.
+            if match.Price < bandLow || bandHigh < match.Price || market.State() != MARKET_STATE_OPEN {
+                market.CancelUnfilled(order)
+                return
             }
 
-            // Figure out how much to trade.
-            tradeAmount, tradeBasis, bidBasisFee, askBasisFee := order.ComputeTradeAndFees(match)
-            // Info("TradeCoin %v tradeBasis %v", tradeAmount, tradeBasis)
-
-            // Update filled & sanity check before updating the DB.
-            bid.Filled += tradeAmount
-            bid.BasisFilled += tradeBasis
-            bid.BasisFeeFilled += bidBasisFee
-            ask.Filled += tradeAmount
-            ask.BasisFilled += tradeBasis
-            ask.BasisFeeFilled += askBasisFee
-
-            // Update order & match accordingly.
-            if order.Complete() { order.Status = ORDER_STATUS_COMPLETE }
-            if match.Complete() { match.Status = ORDER_STATUS_COMPLETE }
-
-            // Sanity check
-            bid.Validate()
-            ask.Validate()
-            if askBasisFee > tradeBasis           { panic("askBasisFee exceeded tradeBasis ?!") }
-            if !ask.Complete() && !bid.Complete() { panic("Neither ask nor bid was fulfilled after trade.") }
-
-            // Make trade
-            trade := &Trade{
-                BidUserId:      bid.UserId,
-                BidOrderId:     bid.Id,
-                BidBasisFee:    bidBasisFee,
-                AskUserId:      ask.UserId,
-                AskOrderId:     ask.Id,
-                AskBasisFee:    askBasisFee,
-                Coin:           order.Coin,
-                BasisCoin:      order.BasisCoin,
-                TradeAmount:    tradeAmount,
-                TradeBasis:     tradeBasis,
-                Price:          match.Price,
+            // Users don't trade with themselves.
+            if match.UserId == order.UserId {
+                if market.PreventSelfTrade(order, match) { return }
+                continue
             }
 
-            // Perform transaction.
-            // -> update order & match filled & status.
-            // -> perform trade of coins between both users.
-            // -> return unfilled reserved coins back to the account.WALLET_MAIN wallet.
-            err := db.DoBeginSerializable(func(tx *db.ModelTx) {
-
-                UpdateOrder(tx, match)
-                UpdateOrder(tx, order)
-
-                // Save trade info.
-                SaveTrade(tx, trade)
-
-                // Release remaining reserved funds
-                if bid.Complete() { ReleaseReservedFundsForOrder(tx, bid) }
-                if ask.Complete() { ReleaseReservedFundsForOrder(tx, ask) }
-
-                // Trade funds & check parity in reserved wallets
-                _, err := tx.Exec(`SELECT exchange_do_trade(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-                    bid.Id, bid.UserId, bidBasisFee,
-                    ask.Id, ask.UserId, askBasisFee,
-                    order.BasisCoin,    tradeBasis,
-                    order.Coin,         tradeAmount,
-                )
-                if err != nil { panic(err) }
-            })
-            if err != nil { panic(err) }
-
-            // Add trade to price log.
-            market.PriceLogger.AddTrade(order.Type, tradeAmount, match.Price, trade.Time)
-
-            // Remove match from mempool if complete.
-            if match.Complete() {
-                market.DropOrderFromMempool(match)
-                market.LoadMore(match.Type, order.Id)
-            }
+            market.executeTrade(order, match, match.Price)
 
             // Return if we're done with this order.
             if order.Complete() { return }
@@ -348,6 +500,11 @@ func (market *Market) ProcessOrderExecution(order *Order) {
 
             // There are no more matches for this order,
             // or the order isn't immediatly executable.
+            // Market, IOC & FOK orders never rest on the book.
+            if !order.CanRest() {
+                market.CancelUnfilled(order)
+                return
+            }
             // The order was already saved to DB, but
             // we need to insert it into market.Bids/Asks if in range.
             market.InsertIfInRange(order)
@@ -356,8 +513,298 @@ func (market *Market) ProcessOrderExecution(order *Order) {
     }
 }
 
-func CreateMarket(basisCoin, coin string) *Market {
-    marketName := coin+"/"+basisCoin
+// Trades order (the taker) with match (the maker) at price, as much as they both can.
+// match is in the mempool, and gets dropped from it if complete.
+func (market *Market) executeTrade(order *Order, match *Order, price uint64) {
+    // Figure out which is bid & ask.
+    var bid, ask *Order
+    if order.Type == ORDER_TYPE_BID {
+        bid, ask = order, match
+    } else {
+        bid, ask = match, order
+    }
+
+    // Figure out how much to trade.
+    tradeAmount, tradeBasis, bidBasisFee, askBasisFee := order.ComputeTradeAndFeesAtPrice(match, price)
+    // Info("TradeCoin %v tradeBasis %v", tradeAmount, tradeBasis)
+    // Siblings shrink by the fraction of this that gets traded.
+    bidRemaining, askRemaining := bid.BasisAmount - bid.BasisFilled, ask.Amount - ask.Filled
+
+    // Update filled & sanity check before updating the DB.
+    bid.Filled += tradeAmount
+    bid.BasisFilled += tradeBasis
+    bid.BasisFeeFilled += bidBasisFee
+    ask.Filled += tradeAmount
+    ask.BasisFilled += tradeBasis
+    ask.BasisFeeFilled += askBasisFee
+
+    // Update order & match accordingly.
+    if order.Complete() { order.Status = ORDER_STATUS_COMPLETE }
+    if match.Complete() { match.Status = ORDER_STATUS_COMPLETE }
+
+    // Sanity check
+    bid.Validate()
+    ask.Validate()
+    if askBasisFee > int64(tradeBasis)    { panic("askBasisFee exceeded tradeBasis ?!") }
+    // Icebergs that rest only trade their visible slice.
+    refresh := match.SliceFilled()
+    if !ask.Complete() && !bid.Complete() && !refresh { panic("Neither ask nor bid was fulfilled after trade.") }
+
+    // Make trade
+    trade := &Trade{
+        BidUserId:      bid.UserId,
+        BidOrderId:     bid.Id,
+        BidBasisFee:    bidBasisFee,
+        AskUserId:      ask.UserId,
+        AskOrderId:     ask.Id,
+        AskBasisFee:    askBasisFee,
+        Coin:           order.Coin,
+        BasisCoin:      order.BasisCoin,
+        TradeAmount:    tradeAmount,
+        TradeBasis:     tradeBasis,
+        Price:          price,
+        TakerType:      order.Type,
+    }
+
+    // Perform transaction.
+    // -> update order & match filled & status.
+    // -> perform trade of coins between both users.
+    // -> take what grouped orders spent off their group's reserve.
+    // -> return unfilled reserved coins back to the account.WALLET_MAIN wallet.
+    // -> send an iceberg whose slice filled to the back of its price level.
+    // -> shrink or cancel the siblings of grouped orders.
+    var priority int64
+    var siblings []*Order
+    err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+
+        UpdateOrder(tx, match)
+        UpdateOrder(tx, order)
+
+        // Save trade info.
+        SaveTrade(tx, trade)
+
+        // Trade funds & check parity in reserved wallets
+        _, err := tx.Exec(`SELECT exchange_do_trade(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+            bid.Id, bid.UserId, bidBasisFee,
+            ask.Id, ask.UserId, askBasisFee,
+            order.BasisCoin,    tradeBasis,
+            order.Coin,         tradeAmount,
+        )
+        if err != nil { panic(err) }
+        addToGroupReserve(tx, bid, -(int64(tradeBasis) + bidBasisFee))
+        addToGroupReserve(tx, ask, -int64(tradeAmount))
+
+        // Release remaining reserved funds
+        if bid.Complete() { ReleaseReservedFundsForOrder(tx, bid) }
+        if ask.Complete() { ReleaseReservedFundsForOrder(tx, ask) }
+
+        if refresh { priority = RefreshOrderPriority(tx, match) }
+
+        siblings = nil
+        siblings = append(siblings, shrinkSiblings(tx, bid, tradeBasis, bidRemaining)...)
+        siblings = append(siblings, shrinkSiblings(tx, ask, tradeAmount, askRemaining)...)
+
+        // exchange_do_trade doesn't go through account.UpdateBalanceByWallet.
+        account.PublishBalanceByWallet(tx, bid.UserId, account.WALLET_RESERVED_ORDER, order.BasisCoin)
+        account.PublishBalanceByWallet(tx, bid.UserId, account.WALLET_MAIN,           order.Coin)
+        account.PublishBalanceByWallet(tx, ask.UserId, account.WALLET_RESERVED_ORDER, order.Coin)
+        account.PublishBalanceByWallet(tx, ask.UserId, account.WALLET_MAIN,           order.BasisCoin)
+    })
+    if err != nil { panic(err) }
+    if refresh { market.requeue(match, priority) }
+    market.syncSiblings(siblings)
+
+    // Add trade to price log.
+    market.PriceLogger.AddTrade(order.Type, tradeAmount, tradeBasis, price, trade.Time)
+    market.CheckCircuitBreaker(trade.Time)
+
+    // Publish to the feed.
+    market.publishTrade(trade)
+    publishOrder(match)
+    publishOrder(order)
+
+    // Remove match from mempool if complete.
+    if match.Complete() {
+        market.DropOrderFromMempool(match)
+        market.LoadMore(match.Type, market.lastOrderId)
+    } else {
+        market.publishLevel(match.Type, match.Price)
+    }
+}
+
+// Cancels the unfilled remainder of an order that isn't in the mempool,
+// and releases its reserved funds.
+func (market *Market) CancelUnfilled(order *Order) {
+    var siblings []*Order
+    err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+        order.Status = ORDER_STATUS_CANCELED
+        UpdateOrder(tx, order)
+        ReleaseReservedFundsForOrder(tx, order)
+        siblings = cancelSiblings(tx, order, ORDER_STATUS_CANCELED)
+    })
+    if err != nil { panic(err) }
+    publishOrder(order)
+    market.syncSiblings(siblings)
+}
+
+// Applies order.SelfTradePolicy, where order & match belong to the same user.
+// Canceled orders get their reserved funds released, and a canceled match
+// gets dropped from the mempool. The outcome is recorded as a SelfTrade.
+// Returns true if order was canceled.
+func (market *Market) PreventSelfTrade(order *Order, match *Order) (orderCanceled bool) {
+    // Decrementing only an iceberg's slice would leave both orders standing.
+    tradeAmount, tradeBasis := order.ComputeTrade(match.withHidden())
+
+    var matchCanceled bool
+    switch order.SelfTradePolicy {
+    case ORDER_STP_CANCEL_NEWEST:
+        orderCanceled = true
+    case ORDER_STP_CANCEL_OLDEST:
+        matchCanceled = true
+    case ORDER_STP_CANCEL_BOTH:
+        orderCanceled, matchCanceled = true, true
+    case ORDER_STP_DECREMENT:
+        orderCanceled = order.WouldComplete(tradeAmount, tradeBasis)
+        matchCanceled = match.WouldComplete(tradeAmount, tradeBasis)
+        if !orderCanceled && !matchCanceled { panic("Neither order nor match would have been fulfilled by self trade.") }
+    default:
+        panic(NewError("Unexpected self trade policy %v", order.SelfTradePolicy))
+    }
+
+    selfTrade := &SelfTrade{
+        UserId:         order.UserId,
+        OrderId:        order.Id,
+        MatchId:        match.Id,
+        Policy:         order.SelfTradePolicy,
+        OrderCanceled:  orderCanceled,
+        MatchCanceled:  matchCanceled,
+        Amount:         tradeAmount,
+        BasisAmount:    tradeBasis,
+    }
+
+    var siblings []*Order
+    err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+        if orderCanceled {
+            order.Status = ORDER_STATUS_CANCELED
+            UpdateOrder(tx, order)
+            ReleaseReservedFundsForOrder(tx, order)
+        } else if order.SelfTradePolicy == ORDER_STP_DECREMENT {
+            DecrementOrder(tx, order, tradeAmount, tradeBasis)
+        }
+        if matchCanceled {
+            match.Status = ORDER_STATUS_CANCELED
+            UpdateOrder(tx, match)
+            ReleaseReservedFundsForOrder(tx, match)
+        } else if order.SelfTradePolicy == ORDER_STP_DECREMENT {
+            DecrementOrder(tx, match, tradeAmount, tradeBasis)
+        }
+        SaveSelfTrade(tx, selfTrade)
+        // After both are settled, in case they're in the same group.
+        siblings = nil
+        if orderCanceled { siblings = append(siblings, cancelSiblings(tx, order, ORDER_STATUS_CANCELED)...) }
+        if matchCanceled { siblings = append(siblings, cancelSiblings(tx, match, ORDER_STATUS_CANCELED)...) }
+    })
+    if err != nil { panic(err) }
+    publishOrder(order)
+    publishOrder(match)
+    market.syncSiblings(siblings)
+
+    if matchCanceled {
+        market.DropOrderFromMempool(match)
+        market.LoadMore(match.Type, market.lastOrderId)
+    } else {
+        market.publishLevel(match.Type, match.Price)
+    }
+    return orderCanceled
+}
+
+// Whether the order could be completely filled right now.
+// NOTE: this only looks at the mempool, so an order deeper than the
+// mempool may be reported as unfillable even if the DB could fill it.
+func (market *Market) CanFill(order *Order) bool {
+    book := market.Asks
+    if order.Type == ORDER_TYPE_ASK { book = market.Bids }
+    sim := *order
+    bandLow, bandHigh := market.PriceBand()
+    book.AscendGreaterOrEqual(book.Min(), func(i llrb.Item) bool {
+        match := i.(*Order)
+        if !sim.Crosses(match) { return false }
+        if match.Price < bandLow || bandHigh < match.Price { return false }
+        // Icebergs keep refreshing at the same price.
+        tradeAmount, tradeBasis := sim.ComputeTrade(match.withHidden())
+        sim.Filled += tradeAmount
+        sim.BasisFilled += tradeBasis
+        return !sim.Complete()
+    })
+    return sim.Complete()
+}
+
+// For stop orders, fills in the limit that the user didn't specify
+// using StopPrice, plus MARKET_ORDER_SLIPPAGE_PCT.
+// Stop orders that trigger into a market order may not fill completely if
+// the price moves past StopPrice by more than that.
+func EstimateStopOrder(order *Order) {
+    if order.Kind != ORDER_KIND_STOP { panic(NewError("Expected a stop order")) }
+
+    if order.Type == ORDER_TYPE_BID && order.BasisAmount == 0 {
+        order.BasisAmount = addSlippage(BasisForAmount(order.Amount, order.StopPrice))
+    } else if order.Type == ORDER_TYPE_ASK && order.Amount == 0 {
+        order.Amount = addSlippage(AmountForBasis(order.BasisAmount, order.StopPrice))
+    }
+}
+
+// For market orders, fills in the limit that the user didn't specify
+// (order.BasisAmount for bids, order.Amount for asks) by walking the
+// current book, plus MARKET_ORDER_SLIPPAGE_PCT.
+// This is what gets reserved, so it should err on the side of too much.
+// Returns false if the book can't fill any of the order.
+func (market *Market) EstimateMarketOrder(order *Order) bool {
+    if order.Kind != ORDER_KIND_MARKET { panic(NewError("Expected a market order")) }
+
+    if order.Type == ORDER_TYPE_BID {
+        if order.BasisAmount > 0 { return true }
+        remaining, basis := order.Amount, uint64(0)
+        mAsks := market.Asks.Snapshot()
+        mAsks.AscendGreaterOrEqual(mAsks.Min(), func(i llrb.Item) bool {
+            ask := i.(*Order)
+            take := MinUint64(remaining, ask.Amount - ask.Filled)
+            basis += BasisForAmount(take, ask.Price)
+            remaining -= take
+            return remaining > 0
+        })
+        order.BasisAmount = addSlippage(basis)
+        return order.BasisAmount > 0
+    } else if order.Type == ORDER_TYPE_ASK {
+        if order.Amount > 0 { return true }
+        remaining, amount := order.BasisAmount, uint64(0)
+        mBids := market.Bids.Snapshot()
+        mBids.AscendGreaterOrEqual(mBids.Min(), func(i llrb.Item) bool {
+            bid := i.(*Order)
+            available := bid.BasisAmount - bid.BasisFilled
+            if bid.Amount != 0 {
+                available = MinUint64(available, BasisForAmount(bid.Amount - bid.Filled, bid.Price))
+            }
+            take := MinUint64(remaining, available)
+            amount += AmountForBasis(take, bid.Price)
+            remaining -= take
+            return remaining > 0
+        })
+        order.Amount = addSlippage(amount)
+        return order.Amount > 0
+    } else {
+        panic(NewError("Unexpected order type %v", order.Type))
+    }
+}
+
+func addSlippage(x uint64) uint64 {
+    return MulDivCeilUint64(x, 100 + MARKET_ORDER_SLIPPAGE_PCT, 100)
+}
+
+func CreateMarket(mcfg *MarketConfig) *Market {
+    basisCoin, coin := mcfg.BasisCoin, mcfg.Coin
+    minTrade, basisMinTrade := mcfg.MinTrade, mcfg.BasisMinTrade
+    if minTrade == 0      { minTrade = Config.GetCoin(coin).MinTrade }
+    if basisMinTrade == 0 { basisMinTrade = Config.GetCoin(basisCoin).MinTrade }
     numMemPool := (MIN_MEMPOOL+MAX_MEMPOOL)/2
 
     // First, get the maximum executed (completed) order number.
@@ -367,24 +814,67 @@ func CreateMarket(basisCoin, coin string) *Market {
     // but it doesn't hurt to re-process them since they have no further side effects.
     lastOrderId := LastCompletedOrderId(basisCoin, coin)
 
-    // Load limit orders.
-    bidsSlice, hasMoreBids := LoadLimitBids(basisCoin, coin, numMemPool+1, math.MaxInt64, 0, lastOrderId)
-    asksSlice, hasMoreAsks := LoadLimitAsks(basisCoin, coin, numMemPool+1, 0, 0, lastOrderId)
+    // Load limit orders, from the journal if so configured & it has a snapshot.
+    var bidsSlice, asksSlice []*Order
+    var hasMoreBids, hasMoreAsks bool
+    var check *JournalCheck
+    if Config.RecoverBookFromJournal { check = CheckJournal(basisCoin, coin) }
+    if check != nil && check.Start != nil {
+        for _, problem := range check.Problems() {
+            Warn("[%v] Journal: %v", mcfg.Name(), problem)
+        }
+        bidsSlice, hasMoreBids = check.LimitOrders(ORDER_TYPE_BID, numMemPool+1, lastOrderId)
+        asksSlice, hasMoreAsks = check.LimitOrders(ORDER_TYPE_ASK, numMemPool+1, lastOrderId)
+    } else {
+        bidsSlice, hasMoreBids = LoadLimitBids(basisCoin, coin, numMemPool+1, uint64(math.MaxInt64), 0, lastOrderId)
+        asksSlice, hasMoreAsks = LoadLimitAsks(basisCoin, coin, numMemPool+1, 0, 0, lastOrderId)
+    }
+    // Before anything trades, so the next check can start here.
+    snapshotJournal(basisCoin, coin)
     bids, asks := llrb.New(), llrb.New()
     for _, bid := range bidsSlice { bids.InsertNoReplace(llrb.Item(bid)) }
     for _, ask := range asksSlice { asks.InsertNoReplace(llrb.Item(ask)) }
     market := &Market {
         Coin:           coin,
         BasisCoin:      basisCoin,
+        TickSize:       mcfg.TickSize,
+        MinTrade:       minTrade,
+        BasisMinTrade:  basisMinTrade,
+        state:          LoadMarketState(mcfg.Name()),
         Bids:           bids,
         Asks:           asks,
         HasMoreBids:    hasMoreBids,
         HasMoreAsks:    hasMoreAsks,
-        PriceLogger:    &PriceLogger{Market:marketName},
+        PriceLogger:    NewPriceLogger(basisCoin, coin),
+        Triggers:       NewTriggerBook(),
+        PriceBandPct:   mcfg.PriceBandPct,
+        ReferencePrice: mcfg.ReferencePrice,
+        CircuitBreaker: mcfg.CircuitBreaker,
+        AuctionDuration: mcfg.AuctionDuration,
+        uncrossCh:      make(chan struct{}, 1),
+        lastOrderId:    lastOrderId,
+        ordersCh:       make(chan *Order, MAX_QUEUE),
     }
-    // TODO: graceful continuing after server restart.
-    // currently the PriceLogger is at the BasisInterval scale.
     market.PriceLogger.Initialize()
+    // Halted in the config overrides the saved state, short of delisted.
+    if mcfg.Halted && market.state != MARKET_STATE_DELISTED {
+        market.state = MARKET_STATE_HALTED
+    }
+
+    // Load stop orders that haven't been triggered yet.
+    for _, order := range LoadPendingStopOrders(basisCoin, coin) {
+        market.Triggers.Insert(order)
+    }
+
+    // Markets that were in an auction when the server stopped get a new one.
+    // An open market whose book is crossed had its uncross cut short, so it finishes now.
+    if market.state == MARKET_STATE_AUCTION {
+        market.stateMtx.Lock()
+        market.scheduleUncross(false)
+        market.stateMtx.Unlock()
+    } else if market.state == MARKET_STATE_OPEN && market.Crossed() {
+        market.Uncross()
+    }
 
     // Process pending orders from last app shutdown.
     pendingOrders := LoadPendingOrdersSince(basisCoin, coin, lastOrderId+1)
@@ -405,30 +895,53 @@ func CreateMarket(basisCoin, coin string) *Market {
 // The returned error.Error() is a front-end message.
 func SaveAndReserveFundsForOrder(order *Order) {
     err := db.DoBeginSerializable(func(tx *db.ModelTx) {
-        // Save the order, get the id
-        SaveOrder(tx, order)
-        // Reserve the funds
-        if order.Type == ORDER_TYPE_BID {
-            account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_MAIN, order.BasisCoin, -int64(order.BasisAmount + order.BasisFee), true)
-            account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_RESERVED_ORDER, order.BasisCoin, int64(order.BasisAmount + order.BasisFee), false)
-        } else {
-            account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_MAIN, order.Coin, -int64(order.Amount), true)
-            account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_RESERVED_ORDER, order.Coin, int64(order.Amount), false)
-        }
+        saveAndReserveFundsForOrder(tx, order)
     })
     if err != nil { panic(err) }
 }
 
+func saveAndReserveFundsForOrder(tx *db.ModelTx, order *Order) {
+    // Save the order, get the id
+    SaveOrder(tx, order)
+    // Reserve the funds, in whichever coin the order pays with.
+    account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_MAIN, order.ReserveCoin(), -int64(order.Reserve()), true)
+    account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_RESERVED_ORDER, order.ReserveCoin(), int64(order.Reserve()), false)
+}
+
+// Shrinks a pending order by tradeAmount & tradeBasis without trading,
+// and releases the funds that were reserved for that part.
+// A grouped order's group releases what it no longer needs instead.
+func DecrementOrder(tx *db.ModelTx, order *Order, tradeAmount, tradeBasis uint64) {
+    if order.Status != ORDER_STATUS_PENDING { panic(NewError("Cannot decrement order that isn't pending: %v", order.Id)) }
+
+    if order.Amount > 0      { order.Amount -= tradeAmount }
+    if order.BasisAmount > 0 { order.BasisAmount -= tradeBasis }
+    UpdateOrderAmounts(tx, order)
+    if order.GroupId != 0 { syncGroupReserve(tx, order); return }
+
+    if order.Type == ORDER_TYPE_BID {
+        account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_RESERVED_ORDER, order.BasisCoin, -int64(tradeBasis), true)
+        account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_MAIN, order.BasisCoin, int64(tradeBasis), false)
+    } else if order.Type == ORDER_TYPE_ASK {
+        account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_RESERVED_ORDER, order.Coin, -int64(tradeAmount), true)
+        account.UpdateBalanceByWallet(tx, order.UserId, account.WALLET_MAIN, order.Coin, int64(tradeAmount), false)
+    } else {
+        panic(NewError("Unexpected order type %v", order.Type))
+    }
+}
+
+// A grouped order's funds are its group's, which releases what it no longer needs.
 func ReleaseReservedFundsForOrder(tx *db.ModelTx, order *Order) {
     if order.Status != ORDER_STATUS_COMPLETE &&
        order.Status != ORDER_STATUS_CANCELED { panic(NewError("Cannot release reserved funds for order that isn't complete nor canceled: %v", order.Id)) }
+    if order.GroupId != 0 { syncGroupReserve(tx, order); return }
 
     if order.Type == ORDER_TYPE_BID {
         bid := order
-        bidReleaseBasis := (bid.BasisAmount - bid.BasisFilled) + (bid.BasisFee - bid.BasisFeeFilled)
+        bidReleaseBasis := bid.RemainingReserve()
         if bidReleaseBasis > 0 {
-            account.UpdateBalanceByWallet(tx, bid.UserId, account.WALLET_RESERVED_ORDER, bid.BasisCoin, -int64(bidReleaseBasis), true)
-            account.UpdateBalanceByWallet(tx, bid.UserId, account.WALLET_MAIN, bid.BasisCoin, int64(bidReleaseBasis), false)
+            account.UpdateBalanceByWallet(tx, bid.UserId, account.WALLET_RESERVED_ORDER, bid.BasisCoin, -bidReleaseBasis, true)
+            account.UpdateBalanceByWallet(tx, bid.UserId, account.WALLET_MAIN, bid.BasisCoin, bidReleaseBasis, false)
         }
     } else if order.Type == ORDER_TYPE_ASK {
         ask := order
@@ -0,0 +1,55 @@
+/*
+Good till time orders get canceled once they expire, releasing their reserved funds.
+Orders that expired before they got processed get canceled instead, see
+ProcessOrderExecution(), and the daemon sweeps up the rest, see OrderExpirer.
+*/
+
+package exchange
+
+// Orders of a market that ExpireOrders() loads at a time.
+const EXPIRE_ORDERS_PAGE = 100
+
+// The last order of a market whose cancellation got queued.
+type expireCursor struct {
+    expireTime  int64
+    orderId     int64
+}
+
+// Queues the cancellations of expired orders, through each market's queue like
+// any other. Each market's cursor moves past the orders queued for cancellation,
+// so they don't get queued again while still in the queue. Cancellations that
+// were queued always get processed, even if the market halts in the meantime.
+type OrderExpirer struct {
+    cursors     map[string]*expireCursor
+}
+
+func NewOrderExpirer() *OrderExpirer {
+    return &OrderExpirer{cursors: map[string]*expireCursor{}}
+}
+
+// Queues the cancellations of the orders expired as of now.
+// Halted markets are skipped, their orders expire once the market isn't halted.
+// Returns how many got queued in each market.
+func (expirer *OrderExpirer) ExpireOrders(now int64) map[string]int {
+    expired := map[string]int{}
+    for _, marketName := range MarketNames {
+        market := Markets[marketName]
+        // Read once, so a halt in the meantime doesn't fail the rest.
+        if !market.CanCancelOrder() { continue }
+        cursor := expirer.cursors[marketName]
+        if cursor == nil {
+            cursor = &expireCursor{}
+            expirer.cursors[marketName] = cursor
+        }
+        for {
+            orders := LoadExpiredOrders(market.BasisCoin, market.Coin, now, cursor.expireTime, cursor.orderId, EXPIRE_ORDERS_PAGE)
+            for _, order := range orders {
+                queueCancellation(order)
+                cursor.expireTime, cursor.orderId = order.ExpireTime, order.Id
+                expired[marketName]++
+            }
+            if len(orders) < EXPIRE_ORDERS_PAGE { break }
+        }
+    }
+    return expired
+}
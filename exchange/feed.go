@@ -0,0 +1,69 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/feed"
+    "github.com/jaekwon/GoLLRB/llrb"
+)
+
+// An L2 book delta: the new total amount at a price level.
+// Amount 0 means the level is gone.
+// Only the mempool is reflected, same as OrderBookHandler.
+type BookDelta struct {
+    Type        string  `json:"t"`
+    Price       uint64  `json:"p"`
+    Amount      uint64  `json:"a"`
+}
+
+// The unfilled amount as shown in the book.
+// Bids with only a BasisAmount are converted at their price.
+// Icebergs only show what's left of their visible slice.
+func BookAmount(order *Order) uint64 {
+    amount := order.Amount - order.Filled
+    if order.Type == ORDER_TYPE_BID && order.Amount == 0 {
+        amount = AmountForBasis(order.BasisAmount - order.BasisFilled, order.Price)
+    }
+    if order.DisplayAmount > 0 { amount = MinUint64(amount, order.SliceRemaining()) }
+    return amount
+}
+
+// Publishes the current total of the level at price.
+// Call this from the market's goroutine after changing the mempool.
+func (market *Market) publishLevel(orderType string, price uint64) {
+    book := market.Bids
+    if orderType == ORDER_TYPE_ASK { book = market.Asks }
+    // Sorts before every order at price.
+    pivot := &Order{Type:orderType, Price:price}
+    total := uint64(0)
+    book.AscendGreaterOrEqual(pivot, func(i llrb.Item) bool {
+        order := i.(*Order)
+        if order.Price != price { return false }
+        total += BookAmount(order)
+        return true
+    })
+    feed.Publish(feed.MarketChannel(feed.CHANNEL_BOOK, market.Name()), "book", &BookDelta{orderType, price, total})
+}
+
+// For orders loaded into the mempool, publishes each level once.
+// orders must be sorted by price, as loaded.
+func (market *Market) publishLevels(orderType string, orders []*Order) {
+    for i, order := range orders {
+        if i > 0 && orders[i-1].Price == order.Price { continue }
+        market.publishLevel(orderType, order.Price)
+    }
+}
+
+func (market *Market) publishTrade(trade *Trade) {
+    feed.Publish(feed.MarketChannel(feed.CHANNEL_TRADES, market.Name()), "trade", trade.Anonymize())
+}
+
+// data is an *Indicative.
+func (market *Market) publishAuction(eventType string, data *Indicative) {
+    feed.Publish(feed.MarketChannel(feed.CHANNEL_AUCTION, market.Name()), eventType, data)
+}
+
+// Publishes a copy, since the market keeps modifying the order.
+func publishOrder(order *Order) {
+    published := *order
+    feed.Publish(feed.UserChannel(feed.CHANNEL_ORDERS, order.UserId), "order", &published)
+}
@@ -0,0 +1,112 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    . "ftnox.com/config"
+    "ftnox.com/db"
+    "database/sql"
+    "sync"
+    "time"
+)
+
+const (
+    FEE_VOLUME_PERIOD    = 30 * 24 * 60 * 60 // trailing volume that decides the fee tier, in seconds
+    FEE_VOLUME_CACHE_TTL = 10 * 60           // how long a user's volume is cached, in seconds
+    FEE_RATIO_SCALE      = 1000000           // fee ratios are exact to a millionth
+)
+
+// The free tier, for markets that don't charge fees.
+var noFeeTier = &FeeTier{}
+
+type feeVolumeKey struct {
+    UserId      int64
+    BasisCoin   string
+}
+
+type feeVolume struct {
+    Volume      uint64
+    Time        int64
+}
+
+// All markets look up fee tiers while matching, so this gets locked.
+var feeVolumeCache = map[feeVolumeKey]*feeVolume{}
+var feeVolumeMtx = sync.Mutex{}
+
+// Returns the user's current fee tier for the market of coin in basisCoin,
+// along with the trailing volume that decided it.
+// The volume counts all markets of basisCoin.
+func GetFeeTier(userId int64, basisCoin string, coin string) (*FeeTier, uint64) {
+    tiers := Config.GetFeeTiers(basisCoin, coin)
+    if len(tiers) == 0 { return noFeeTier, 0 }
+    volume := GetFeeVolume(userId, basisCoin)
+    return FeeTierForVolume(tiers, volume), volume
+}
+
+// tiers must be in ascending MinVolume.
+func FeeTierForVolume(tiers []*FeeTier, volume uint64) *FeeTier {
+    tier := tiers[0]
+    for _, t := range tiers {
+        if t.MinVolume <= volume { tier = t } else { break }
+    }
+    return tier
+}
+
+// The largest fee ratio a bid could be charged in the market of coin in basisCoin.
+// Bids reserve this much so they can pay the fee whether they make or take.
+func MaxFeeRatio(basisCoin string, coin string) float64 {
+    maxRatio := float64(0)
+    for _, tier := range Config.GetFeeTiers(basisCoin, coin) {
+        if tier.TakerRatio > maxRatio { maxRatio = tier.TakerRatio }
+        if tier.MakerRatio > maxRatio { maxRatio = tier.MakerRatio }
+    }
+    return maxRatio
+}
+
+// The fee for tradeBasis at ratio, rounded half away from zero.
+// Negative ratios give negative fees (rebates).
+func ComputeFee(tradeBasis uint64, ratio float64) int64 {
+    ppm := RoundFloat64(ratio * FEE_RATIO_SCALE)
+    if ppm < 0 {
+        return -int64(MulDivRoundUint64(tradeBasis, uint64(-ppm), FEE_RATIO_SCALE))
+    }
+    return int64(MulDivRoundUint64(tradeBasis, uint64(ppm), FEE_RATIO_SCALE))
+}
+
+// What a bid for basisAmount reserves to cover fees at ratio, rounded up.
+func ComputeFeeReserve(basisAmount uint64, ratio float64) uint64 {
+    ppm := RoundFloat64(ratio * FEE_RATIO_SCALE)
+    if ppm <= 0 { return 0 }
+    return MulDivCeilUint64(basisAmount, uint64(ppm), FEE_RATIO_SCALE)
+}
+
+// The user's trailing volume, cached for FEE_VOLUME_CACHE_TTL.
+func GetFeeVolume(userId int64, basisCoin string) uint64 {
+    now := time.Now().Unix()
+    key := feeVolumeKey{userId, basisCoin}
+
+    feeVolumeMtx.Lock()
+    cached := feeVolumeCache[key]
+    feeVolumeMtx.Unlock()
+    if cached != nil && now - cached.Time < FEE_VOLUME_CACHE_TTL {
+        return cached.Volume
+    }
+
+    volume := LoadTradeVolumeByUser(userId, basisCoin, now - FEE_VOLUME_PERIOD)
+
+    feeVolumeMtx.Lock()
+    feeVolumeCache[key] = &feeVolume{volume, now}
+    feeVolumeMtx.Unlock()
+    return volume
+}
+
+// Total basis traded by the user, as either bid or ask, since startTime.
+func LoadTradeVolumeByUser(userId int64, basisCoin string, startTime int64) uint64 {
+    var volume sql.NullInt64
+    err := db.QueryRow(
+        `SELECT SUM(trade_basis) FROM exchange_trade
+         WHERE (bid_user_id=? OR ask_user_id=?) AND basis_coin=? AND time>=?`,
+        userId, userId, basisCoin, startTime,
+    ).Scan(&volume)
+    if err != nil { panic(err) }
+    return uint64(volume.Int64)
+}
@@ -0,0 +1,42 @@
+package exchange
+
+import (
+    . "ftnox.com/config"
+    "testing"
+)
+
+func TestFeeTierForVolume(t *testing.T) {
+    tiers := []*FeeTier{
+        &FeeTier{MinVolume:0,    MakerRatio:0.001,   TakerRatio:0.002},
+        &FeeTier{MinVolume:100,  MakerRatio:0.0005,  TakerRatio:0.0015},
+        &FeeTier{MinVolume:1000, MakerRatio:-0.0001, TakerRatio:0.001},
+    }
+    testTier := func(volume uint64, expected *FeeTier) {
+        tier := FeeTierForVolume(tiers, volume)
+        if tier != expected { t.Errorf("Wrong tier for volume %v: expected %v actual %v", volume, *expected, *tier) }
+    }
+    testTier(0,     tiers[0])
+    testTier(99,    tiers[0])
+    testTier(100,   tiers[1])
+    testTier(999,   tiers[1])
+    testTier(1000,  tiers[2])
+    testTier(50000, tiers[2])
+}
+
+func TestMarketFeeTiers(t *testing.T) {
+    defer func(markets []*MarketConfig, schedule map[string][]*FeeTier) {
+        Config.Markets, Config.FeeSchedule = markets, schedule
+    }(Config.Markets, Config.FeeSchedule)
+    Config.FeeSchedule = map[string][]*FeeTier{
+        "USD": []*FeeTier{&FeeTier{MinVolume:0, MakerRatio:0.001, TakerRatio:0.002}},
+    }
+    Config.Markets = []*MarketConfig{
+        &MarketConfig{Coin:"BTC", BasisCoin:"USD", TickSize:1},
+        &MarketConfig{Coin:"LTC", BasisCoin:"USD", TickSize:1, FeeTiers:[]*FeeTier{
+            &FeeTier{MinVolume:0, MakerRatio:0.003, TakerRatio:0.001},
+        }},
+    }
+    if ratio := MaxFeeRatio("USD", "BTC"); ratio != 0.002 { t.Errorf("Expected the basis coin's schedule for BTC/USD but got %v", ratio) }
+    if ratio := MaxFeeRatio("USD", "LTC"); ratio != 0.003 { t.Errorf("Expected the market's own tiers for LTC/USD but got %v", ratio) }
+    if ratio := MaxFeeRatio("BTC", "LTC"); ratio != 0 { t.Errorf("Expected no fees for LTC/BTC but got %v", ratio) }
+}
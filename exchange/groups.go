@@ -0,0 +1,169 @@
+/*
+Order groups link orders of one user in one market, so that trading one member
+affects the rest (its siblings). All groups are one-cancels-other: when a member
+trades, its siblings shrink by the same fraction of what's left of them, and when
+it completes or gets canceled, so do they. A bracket is a take-profit limit order
+& a stop-loss placed together on the same side, see AddBracketHandler.
+Members are all on the same side, and since at most one of them can fill, the
+group reserves funds once, for its largest member, see syncGroupReserve().
+Siblings change in the same transaction as the trade or cancellation that caused
+it, then syncSiblings() brings the mempool & trigger book in line.
+*/
+
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/account"
+    "ftnox.com/db"
+    "github.com/jaekwon/GoLLRB/llrb"
+)
+
+// Saves the orders as a group of kind, reserving funds for the largest of them,
+// then queues them for processing in order. The orders' GroupId & Id get set.
+func AddOrderGroup(kind string, orders []*Order) *OrderGroup {
+    if len(orders) < 2 { panic(NewError("An order group needs at least 2 orders")) }
+    first := orders[0]
+    reserve := uint64(0)
+    for _, order := range orders {
+        prepareOrder(order)
+        if order.UserId != first.UserId || order.MarketName() != first.MarketName() {
+            panic(NewError("Orders in a group must be from the same user & market"))
+        }
+        if order.Type != first.Type {
+            panic(NewError("Orders in a group must be on the same side"))
+        }
+        if order.Reserve() > reserve { reserve = order.Reserve() }
+    }
+
+    group := &OrderGroup{
+        Kind:       kind,
+        UserId:     first.UserId,
+        Coin:       first.Coin,
+        BasisCoin:  first.BasisCoin,
+        Status:     ORDER_STATUS_PENDING,
+        Reserved:   int64(reserve),
+    }
+    err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+        SaveOrderGroup(tx, group)
+        for _, order := range orders {
+            order.GroupId = group.Id
+            SaveOrder(tx, order)
+        }
+        account.UpdateBalanceByWallet(tx, group.UserId, account.WALLET_MAIN, first.ReserveCoin(), -group.Reserved, true)
+        account.UpdateBalanceByWallet(tx, group.UserId, account.WALLET_RESERVED_ORDER, first.ReserveCoin(), group.Reserved, false)
+    })
+    if err != nil { panic(err) }
+
+    for _, order := range orders {
+        publishOrder(order)
+        order.Market().ordersCh <- order
+    }
+    return group
+}
+
+// Adds diff to what member's group holds, without moving funds:
+// negative for what member spent in a trade, positive for funds reserved for it.
+func addToGroupReserve(tx *db.ModelTx, member *Order, diff int64) {
+    if member.GroupId == 0 || diff == 0 { return }
+    group := LoadOrderGroup(tx, member.GroupId)
+    group.Reserved += diff
+    UpdateOrderGroupReserved(tx, group)
+}
+
+// Releases what member's group holds beyond what its largest pending member could
+// still spend, everything once none is pending.
+// Call this in any transaction that shrinks or finishes a member, after the funds
+// the member spent got taken off with addToGroupReserve().
+func syncGroupReserve(tx *db.ModelTx, member *Order) {
+    group := LoadOrderGroup(tx, member.GroupId)
+    need := int64(0)
+    for _, pending := range LoadPendingGroupMembers(tx, group.Id) {
+        if pending.RemainingReserve() > need { need = pending.RemainingReserve() }
+    }
+    release := group.Reserved - need
+    if release <= 0 { return }
+    account.UpdateBalanceByWallet(tx, group.UserId, account.WALLET_RESERVED_ORDER, member.ReserveCoin(), -release, true)
+    account.UpdateBalanceByWallet(tx, group.UserId, account.WALLET_MAIN, member.ReserveCoin(), release, false)
+    group.Reserved = need
+    UpdateOrderGroupReserved(tx, group)
+}
+
+// Cancels the pending siblings of member, which just finished with status,
+// and releases the group's reserved funds. The group takes on status.
+// Call this in the same transaction that finished member.
+// Returns the siblings that got canceled.
+func cancelSiblings(tx *db.ModelTx, member *Order, status uint32) []*Order {
+    if member.GroupId == 0 { return nil }
+    UpdateOrderGroupStatus(tx, member.GroupId, status)
+    siblings := LoadPendingSiblings(tx, member)
+    for _, sibling := range siblings {
+        sibling.Status = ORDER_STATUS_CANCELED
+        UpdateOrder(tx, sibling)
+    }
+    syncGroupReserve(tx, member)
+    return siblings
+}
+
+// member just traded traded out of remaining, both in the unit that limits it
+// (BasisAmount for bids, Amount for asks). Its pending siblings shrink by the same
+// fraction, or get canceled if member completed.
+// Call this in the trade's transaction, after addToGroupReserve().
+// Returns the siblings that changed.
+func shrinkSiblings(tx *db.ModelTx, member *Order, traded uint64, remaining uint64) []*Order {
+    if member.GroupId == 0 { return nil }
+    if member.Complete() { return cancelSiblings(tx, member, ORDER_STATUS_COMPLETE) }
+    reserved := LoadOrderGroup(tx, member.GroupId).Reserved
+    siblings := LoadPendingSiblings(tx, member)
+    for _, sibling := range siblings {
+        var amount, basis uint64
+        if sibling.Amount > 0 {
+            amount, _ = MulDivUint64(sibling.Amount - sibling.Filled, traded, remaining)
+        }
+        if sibling.BasisAmount > 0 {
+            basis, _ = MulDivUint64(sibling.BasisAmount - sibling.BasisFilled, traded, remaining)
+        }
+        // The fee member paid came out of what the group holds, but a bid sibling's
+        // fee reserve doesn't shrink with it, so it gives way to fit.
+        var over int64
+        if sibling.Type == ORDER_TYPE_BID {
+            over = sibling.RemainingReserve() - int64(basis) - reserved
+            if feeLeft := int64(sibling.BasisFee) - sibling.BasisFeeFilled; over > feeLeft { over = feeLeft }
+            if over > 0 { sibling.BasisFee -= uint64(over) }
+        }
+        if amount == 0 && basis == 0 {
+            if over > 0 { UpdateOrderAmounts(tx, sibling) }
+            continue
+        }
+        DecrementOrder(tx, sibling, amount, basis)
+    }
+    syncGroupReserve(tx, member)
+    return siblings
+}
+
+func (market *Market) mempool(orderType string) *llrb.LLRB {
+    if orderType == ORDER_TYPE_BID { return market.Bids }
+    return market.Asks
+}
+
+// Replaces the mempool's or trigger book's copies of siblings that changed in the DB,
+// and drops the ones that got canceled.
+// Siblings still in the queue get reloaded when processed, see ProcessOrder().
+func (market *Market) syncSiblings(siblings []*Order) {
+    for _, sibling := range siblings {
+        publishOrder(sibling)
+        pending := sibling.Status == ORDER_STATUS_PENDING
+        if sibling.IsStop() {
+            if market.Triggers.Remove(sibling) != nil && pending { market.Triggers.Insert(sibling) }
+            continue
+        }
+        book := market.mempool(sibling.Type)
+        if book.Delete(sibling) == nil { continue }
+        if pending {
+            book.InsertNoReplace(sibling)
+        } else {
+            market.LoadMore(sibling.Type, market.lastOrderId)
+        }
+        market.publishLevel(sibling.Type, sibling.Price)
+    }
+}
@@ -3,10 +3,17 @@ package exchange
 import (
     . "ftnox.com/common"
     . "ftnox.com/config"
+    "ftnox.com/account"
     "ftnox.com/auth"
+    "ftnox.com/feed"
     "github.com/jaekwon/GoLLRB/llrb"
     //"github.com/davecgh/go-spew/spew"
+    "encoding/json"
     "net/http"
+    "net/url"
+    "runtime"
+    "strings"
+    "math"
     "time"
     "fmt"
 )
@@ -14,7 +21,17 @@ import (
 // Simplified order for orderbook API
 type SOrder struct {
     Amount      uint64  `json:"a"`
-    Price       string  `json:"p"`
+    Price       uint64  `json:"p"`
+}
+
+// Simplified trade for the trades API & feed, without the users.
+type STrade struct {
+    Id          int64   `json:"id"`
+    Type        string  `json:"t"`     // the taker's order type
+    Amount      uint64  `json:"a"`
+    Basis       uint64  `json:"b"`
+    Price       uint64  `json:"p"`
+    Time        int64   `json:"time"`
 }
 
 // Helper for getting the market from request param
@@ -29,27 +46,72 @@ func MarketsHandler(w http.ResponseWriter, r *http.Request) {
     type marketInfo struct {
         Coin        string  `json:"coin"`
         BasisCoin   string  `json:"basisCoin"`
-        Last        float64 `json:"last"`
-        BestBid     float64 `json:"bestBid"`
-        BestAsk     float64 `json:"bestAsk"`
+        TickSize    uint64  `json:"tickSize"`
+        MinTrade    uint64  `json:"minTrade"`
+        BasisMinTrade uint64 `json:"basisMinTrade"`
+        State       string  `json:"state"`
+        HaltedUntil int64   `json:"haltedUntil"`
+        BandLow     uint64  `json:"bandLow"`
+        BandHigh    uint64  `json:"bandHigh"`
+        Auction     *Indicative `json:"auction"`  // nil unless in an auction
+        Intervals   []int64 `json:"intervals"`
+        Last        uint64  `json:"last"`
+        BestBid     uint64  `json:"bestBid"`
+        BestAsk     uint64  `json:"bestAsk"`
+        QueueDepth  int     `json:"queueDepth"`
+        Ticker      *TickerStats `json:"ticker"`
     }
     var infos = []marketInfo{}
+    now := time.Now().Unix()
     for _, marketName := range MarketNames {
         market := Markets[marketName]
+        bandLow, bandHigh := market.PriceBand()
+        if bandHigh == math.MaxUint64 { bandHigh = 0 } // no band
         infos = append(infos, marketInfo{
             Coin:       market.Coin,
             BasisCoin:  market.BasisCoin,
+            TickSize:   market.TickSize,
+            MinTrade:   market.MinTrade,
+            BasisMinTrade: market.BasisMinTrade,
+            State:      market.State(),
+            HaltedUntil: market.HaltedUntil(),
+            BandLow:    bandLow,
+            BandHigh:   bandHigh,
+            Auction:    market.Indicative(),
+            Intervals:  market.PriceLogger.IntervalList(),
             Last:       market.PriceLogger.LastPrice(),
             BestBid:    market.BestBidPrice(),
             BestAsk:    market.BestAskPrice(),
+            QueueDepth: market.QueueDepth(),
+            Ticker:     market.PriceLogger.Ticker.Stats(now),
         })
     }
     ReturnJSON(API_OK, infos)
 }
 
+// 24h statistics for "market", or for all markets by name if it's not given.
+func TickerHandler(w http.ResponseWriter, r *http.Request) {
+    now := time.Now().Unix()
+    if GetParam(r, "market") != "" {
+        market := GetParamMarket(r, "market")
+        ReturnJSON(API_OK, market.PriceLogger.Ticker.Stats(now))
+    }
+    tickers := map[string]*TickerStats{}
+    for _, marketName := range MarketNames {
+        tickers[marketName] = Markets[marketName].PriceLogger.Ticker.Stats(now)
+    }
+    ReturnJSON(API_OK, tickers)
+}
+
+// "seq" is the book feed's sequence number as of the snapshot.
+// Book deltas with a greater seq should be applied on top.
 func OrderBookHandler(w http.ResponseWriter, r *http.Request) {
     market := GetParamMarket(r, "market")
 
+    // Deltas are absolute, so reading seq first is safe:
+    // a delta that's already in the snapshot just gets applied twice.
+    seq := feed.Seq(feed.MarketChannel(feed.CHANNEL_BOOK, market.Name()))
+
     // Take a snapshot of each so we don't return overlapping bids/asks.
     mBids, mAsks := market.Bids.Snapshot(), market.Asks.Snapshot()
 
@@ -58,13 +120,8 @@ func OrderBookHandler(w http.ResponseWriter, r *http.Request) {
 
     mBids.AscendGreaterOrEqual(mBids.Min(), func(i llrb.Item) bool {
         bid := i.(*Order)
-        sfAmount := uint64(0)
-        sfPrice := F64ToS(bid.Price, 5)
-        if bid.Amount != 0 {
-            sfAmount = bid.Amount - bid.Filled
-        } else {
-            sfAmount = uint64(float64(bid.BasisAmount - bid.BasisFilled) * bid.Price)
-        }
+        sfPrice := bid.Price
+        sfAmount := BookAmount(bid)
         if sfAmount == uint64(0) { return true }
         if curSOrder == nil || curSOrder.Price != sfPrice {
             curSOrder = &SOrder{sfAmount, sfPrice}
@@ -77,8 +134,8 @@ func OrderBookHandler(w http.ResponseWriter, r *http.Request) {
     curSOrder = nil
     mAsks.AscendGreaterOrEqual(mAsks.Min(), func(i llrb.Item) bool {
         ask := i.(*Order)
-        sfPrice := F64ToS(ask.Price, 5)
-        sfAmount := ask.Amount - ask.Filled
+        sfPrice := ask.Price
+        sfAmount := BookAmount(ask)
         if sfAmount == uint64(0) { return true }
         if curSOrder == nil || curSOrder.Price != sfPrice {
             curSOrder = &SOrder{sfAmount, sfPrice}
@@ -92,95 +149,631 @@ func OrderBookHandler(w http.ResponseWriter, r *http.Request) {
     res := map[string]interface{}{
         "bids": bids,
         "asks": asks,
+        "seq":  seq,
     }
 
     ReturnJSON(API_OK, res)
 }
 
 func AddOrderHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    order := addOrderFromParams(r, user)
+    ReturnJSON(API_OK, order)
+}
+
+// Validates the add_order params & adds the order, see AddOrderHandler & BatchOrdersHandler.
+// Invalid params get returned as an API error.
+// Returns the saved order.
+func addOrderFromParams(r *http.Request, user *auth.User) *Order {
     market :=           GetParamMarket(r, "market")
     orderType :=        GetParamRegexp(r, "order_type",   RE_ORDER_TYPE, true)
+    orderKind :=        GetParamRegexp(r, "order_kind",   RE_ORDER_KIND, false)
+    timeInForce :=      GetParamRegexp(r, "time_in_force", RE_TIME_IN_FORCE, false)
+    stpPolicy :=        GetParamRegexp(r, "stp_policy",   RE_SELF_TRADE_POLICY, false)
+    expireTime, _ :=    GetParamInt64Safe(r, "expire_time")
     amount, _ :=        GetParamUint64Safe(r, "amount")
     basisAmount, _ :=   GetParamUint64Safe(r, "basis_amount")
-    price :=            GetParamFloat64(r, "price")
+    displayAmount, _ := GetParamUint64Safe(r, "display_amount")
+    priceFloat, _ :=    GetParamFloat64Safe(r, "price")
+    stopPriceFloat, _ := GetParamFloat64Safe(r, "stop_price")
+    clientId :=         GetParamRegexp(r, "client_id",    RE_CLIENT_ID, false)
+
+    // Resubmitting an order gets the one that was saved the first time, see AddOrder().
+    if clientId != "" {
+        if existing := LoadOrderByClientId(user.Id, clientId); existing != nil { return existing }
+    }
+
+    if !market.CanAddOrder() {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("Market %v isn't taking orders", market.Name()))
+    }
+
+    if orderKind == "" { orderKind = ORDER_KIND_LIMIT }
+    hasPrice := orderKind == ORDER_KIND_LIMIT || orderKind == ORDER_KIND_STOP_LIMIT
+    isStop := orderKind == ORDER_KIND_STOP || orderKind == ORDER_KIND_STOP_LIMIT
+    isMarket := orderKind == ORDER_KIND_MARKET || orderKind == ORDER_KIND_STOP
+    if timeInForce == "" {
+        if isMarket {
+            timeInForce = ORDER_TIF_IOC
+        } else {
+            timeInForce = ORDER_TIF_GTC
+        }
+    }
 
-    c := Config.GetCoin(market.Coin)
-    bc := Config.GetCoin(market.BasisCoin)
+    // The user's own default, or the exchange default if neither is set.
+    if stpPolicy == "" { stpPolicy = user.SelfTradePolicy }
 
     // Validation
     if amount == 0 && basisAmount == 0 {
         ReturnJSON(API_INVALID_PARAM,
             fmt.Sprintf("Please enter a valid order amount"))
     }
-    if price <= 0 {
+    if hasPrice && priceFloat <= 0 {
         ReturnJSON(API_INVALID_PARAM,
             fmt.Sprintf("Please enter a valid order price"))
     }
+    if isStop && stopPriceFloat <= 0 {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Please enter a valid stop price"))
+    }
 
-    // Round price to 5 significant figures
-    price = F64ToF(price, 5)
+    if isMarket &&
+       timeInForce != ORDER_TIF_IOC && timeInForce != ORDER_TIF_FOK {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Market orders must be immediate or cancel, or fill or kill"))
+    }
+    if timeInForce == ORDER_TIF_GTT {
+        if expireTime <= time.Now().Unix() {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Please enter an expire time in the future"))
+        }
+    } else {
+        expireTime = 0
+    }
+    // Nothing matches until the uncross, so orders that can't rest would only get canceled.
+    if market.State() == MARKET_STATE_AUCTION && !isStop &&
+       (isMarket || timeInForce == ORDER_TIF_IOC || timeInForce == ORDER_TIF_FOK) {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Market %v is in an auction, which only takes orders that can rest", market.Name()))
+    }
+
+    // Prices must be a multiple of the market's tick size.
+    // Market orders have no price.
+    var price, stopPrice uint64
+    if hasPrice {
+        price = F64ToPrice(priceFloat)
+        if price % market.TickSize != 0 {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Price must be a multiple of %v", PriceToF64(market.TickSize)))
+        }
+    }
+    // Limit prices past the band on the side they'd trade on are likely mistakes.
+    // Market orders stop trading at the band, see ProcessOrderExecution().
+    if hasPrice && !isStop {
+        bandLow, bandHigh := market.PriceBand()
+        if orderType == ORDER_TYPE_BID && price > bandHigh {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Bid price can be at most %v", PriceToF64(bandHigh)))
+        }
+        if orderType == ORDER_TYPE_ASK && price < bandLow {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Ask price must be at least %v", PriceToF64(bandLow)))
+        }
+    }
+    if isStop {
+        stopPrice = F64ToPrice(stopPriceFloat)
+        if stopPrice % market.TickSize != 0 {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Stop price must be a multiple of %v", PriceToF64(market.TickSize)))
+        }
+    }
 
     // Ensure that trades aren't dust.
-    if amount > 0 && amount < c.MinTrade {
+    if amount > 0 && amount < market.MinTrade {
         ReturnJSON(API_INVALID_PARAM,
-            fmt.Sprintf("Minimum order amount is %v %v", I64ToF64(int64(c.MinTrade)), market.Coin))
+            fmt.Sprintf("Minimum order amount is %v %v", I64ToF64(int64(market.MinTrade)), market.Coin))
     }
-    if basisAmount > 0 && basisAmount < bc.MinTrade {
+    if basisAmount > 0 && basisAmount < market.BasisMinTrade {
         ReturnJSON(API_INVALID_PARAM,
-            fmt.Sprintf("Minimum order amount is %v %v", I64ToF64(int64(bc.MinTrade)), market.BasisCoin))
+            fmt.Sprintf("Minimum order amount is %v %v", I64ToF64(int64(market.BasisMinTrade)), market.BasisCoin))
     }
 
-    if orderType == "A" && amount == 0 {
-        amount = uint64(float64(basisAmount) / float64(price) + 0.5)
-    } else if orderType == "B" && basisAmount == 0 {
-        basisAmount = uint64(float64(amount) * float64(price) + 0.5)
+    if hasPrice {
+        if orderType == "A" && amount == 0 {
+            amount = AmountForBasis(basisAmount, price)
+        } else if orderType == "B" && basisAmount == 0 {
+            basisAmount = BasisForAmount(amount, price)
+        }
+    }
+
+    // Icebergs show a slice of display_amount at a time, see Order.SliceRemaining().
+    if displayAmount > 0 {
+        if !hasPrice || isMarket || timeInForce == ORDER_TIF_IOC || timeInForce == ORDER_TIF_FOK {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Only limit orders that rest on the book can have a display amount"))
+        }
+        if displayAmount < market.MinTrade {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Minimum display amount is %v %v", I64ToF64(int64(market.MinTrade)), market.Coin))
+        }
+        total := amount
+        if total == 0 { total = AmountForBasis(basisAmount, price) }
+        if displayAmount >= total {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Display amount must be less than the order amount"))
+        }
     }
 
     order := &Order{
-        Type:           orderType,
-        UserId:         user.Id,
-        Coin:           market.Coin,
-        Amount:         amount,
-        BasisCoin:      market.BasisCoin,
-        BasisAmount:    basisAmount,
-        Price:          price,
+        Type:            orderType,
+        Kind:            orderKind,
+        TimeInForce:     timeInForce,
+        SelfTradePolicy: stpPolicy,
+        ExpireTime:      expireTime,
+        UserId:          user.Id,
+        Coin:            market.Coin,
+        Amount:          amount,
+        DisplayAmount:   displayAmount,
+        BasisCoin:       market.BasisCoin,
+        BasisAmount:     basisAmount,
+        Price:           price,
+        StopPrice:       stopPrice,
+        ClientId:        clientId,
     }
-    AddOrder(order)
 
-    ReturnJSON(API_OK, order)
+    // Market orders reserve what the book says they'll need.
+    // Stop orders reserve what they'd need at their stop price.
+    if orderKind == ORDER_KIND_MARKET && !market.EstimateMarketOrder(order) {
+        ReturnJSON(API_INVALID_PARAM, "There are no orders to match against")
+    }
+    if orderKind == ORDER_KIND_STOP {
+        EstimateStopOrder(order)
+    }
+
+    return AddOrder(order)
 }
 
+// Places a take-profit limit order at price & a stop-loss at stop_price as a group,
+// so that filling one shrinks or cancels the other, see groups.go.
+// Both are on the order_type side, for amount of the coin.
+// The stop-loss is a stop limit order if stop_limit_price is given, and a stop order otherwise.
+func AddBracketHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    market :=           GetParamMarket(r, "market")
+    orderType :=        GetParamRegexp(r, "order_type",   RE_ORDER_TYPE, true)
+    stpPolicy :=        GetParamRegexp(r, "stp_policy",   RE_SELF_TRADE_POLICY, false)
+    amount :=           GetParamUint64(r, "amount")
+    price :=            F64ToPrice(GetParamFloat64(r, "price"))
+    stopPrice :=        F64ToPrice(GetParamFloat64(r, "stop_price"))
+    stopLimitFloat, _ := GetParamFloat64Safe(r, "stop_limit_price")
+    stopLimitPrice :=   F64ToPrice(stopLimitFloat)
+
+    if !market.CanAddOrder() || market.State() == MARKET_STATE_AUCTION {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("Market %v isn't taking brackets", market.Name()))
+    }
+    if stpPolicy == "" { stpPolicy = user.SelfTradePolicy }
+
+    // Validation
+    if amount < market.MinTrade {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Minimum order amount is %v %v", I64ToF64(int64(market.MinTrade)), market.Coin))
+    }
+    if price == 0 || stopPrice == 0 {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Please enter a valid price & stop price"))
+    }
+    for _, p := range []uint64{price, stopPrice, stopLimitPrice} {
+        if p % market.TickSize != 0 {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Prices must be a multiple of %v", PriceToF64(market.TickSize)))
+        }
+    }
+    // Selling takes profit above the stop, buying below it.
+    if orderType == ORDER_TYPE_ASK && price <= stopPrice {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Take-profit price must be above the stop price"))
+    }
+    if orderType == ORDER_TYPE_BID && price >= stopPrice {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Take-profit price must be below the stop price"))
+    }
+
+    takeProfit := &Order{
+        Type:            orderType,
+        Kind:            ORDER_KIND_LIMIT,
+        TimeInForce:     ORDER_TIF_GTC,
+        SelfTradePolicy: stpPolicy,
+        UserId:          user.Id,
+        Coin:            market.Coin,
+        Amount:          amount,
+        BasisCoin:       market.BasisCoin,
+        Price:           price,
+    }
+    stopLoss := &Order{
+        Type:            orderType,
+        Kind:            ORDER_KIND_STOP,
+        TimeInForce:     ORDER_TIF_IOC,
+        SelfTradePolicy: stpPolicy,
+        UserId:          user.Id,
+        Coin:            market.Coin,
+        Amount:          amount,
+        BasisCoin:       market.BasisCoin,
+        StopPrice:       stopPrice,
+    }
+    if stopLimitPrice > 0 {
+        stopLoss.Kind, stopLoss.TimeInForce, stopLoss.Price = ORDER_KIND_STOP_LIMIT, ORDER_TIF_GTC, stopLimitPrice
+    }
+    if orderType == ORDER_TYPE_BID {
+        takeProfit.BasisAmount = BasisForAmount(amount, price)
+        if stopLoss.Kind == ORDER_KIND_STOP {
+            EstimateStopOrder(stopLoss)
+        } else {
+            stopLoss.BasisAmount = BasisForAmount(amount, stopLimitPrice)
+        }
+    }
+
+    group := AddOrderGroup(ORDER_GROUP_BRACKET, []*Order{takeProfit, stopLoss})
+
+    ReturnJSON(API_OK, map[string]interface{}{
+        "group":        group,
+        "takeProfit":   takeProfit,
+        "stopLoss":     stopLoss,
+    })
+}
+
+// Takes the order's id, or the client_id it was added with.
 func CancelOrderHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
-    id := GetParamInt64(r, "id")
+    cancelOrderFromParams(r, user, nil)
+    ReturnJSON(API_OK, "CANCELED")
+}
 
-    order := LoadOrder(id)
-    if order == nil { ReturnJSON(API_INVALID_PARAM, "Order with that id does not exist") }
+// Validates the cancel_order params & queues the cancellation,
+// see CancelOrderHandler & BatchOrdersHandler.
+// The order must be in market, unless it's nil.
+// Returns the order as it was before the cancellation.
+func cancelOrderFromParams(r *http.Request, user *auth.User, market *Market) *Order {
+    id, _ :=    GetParamInt64Safe(r, "id")
+    clientId := GetParamRegexp(r, "client_id", RE_CLIENT_ID, false)
+
+    var order *Order
+    if clientId != "" {
+        order = LoadOrderByClientId(user.Id, clientId)
+    } else {
+        order = LoadOrder(id)
+    }
+    if order == nil || order.UserId != user.Id { ReturnJSON(API_INVALID_PARAM, "Order with that id does not exist") }
+    if market != nil && order.MarketName() != market.Name() {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("Order %v isn't in market %v", order.Id, market.Name()))
+    }
+    if !order.Market().CanCancelOrder() {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("Market %v is halted", order.MarketName()))
+    }
 
     CancelOrder(order)
+    return order
+}
 
-    ReturnJSON(API_OK, "CANCELED")
+// Most items that BatchOrdersHandler takes at once.
+const MAX_BATCH_ITEMS = 100
+
+// The outcome of an item in a batch.
+type BatchResult struct {
+    Action      string  `json:"action"`
+    Order       *Order  `json:"order,omitempty"`
+    Error       string  `json:"error,omitempty"`
+}
+
+// Runs f, which returns API errors the way handlers do, for an item in a batch.
+// Errors f panics with, such as insufficient funds, fail only the item,
+// but runtime errors & anything else are bugs, and fail the whole request.
+func runBatchItem(action string, f func() *Order) (result BatchResult) {
+    result.Action = action
+    defer func() {
+        e := recover()
+        if e == nil { return }
+        switch err := e.(type) {
+        case APIResponse:
+            if err.Status == API_OK { panic(e) }
+            result.Error = fmt.Sprintf("%v", err.Data)
+        case runtime.Error:
+            panic(e)
+        case error:
+            if err == account.INSUFFICIENT_FUNDS_ERROR {
+                result.Error = "Insufficient funds"
+            } else {
+                result.Error = err.Error()
+            }
+        default:
+            panic(e)
+        }
+    }()
+    result.Order = f()
+    return
+}
+
+// Places & cancels orders in one market, in the order given.
+// "items" is a JSON list of objects, each with an "action" of "add" or "cancel"
+// & the params that add_order or cancel_order would take, except for the market.
+// Each item succeeds or fails on its own, see BatchResult.
+func BatchOrdersHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    market := GetParamMarket(r, "market")
+    var items []map[string]interface{}
+    decoder := json.NewDecoder(strings.NewReader(GetParam(r, "items")))
+    decoder.UseNumber() // keeps amounts exact
+    if err := decoder.Decode(&items); err != nil {
+        ReturnJSON(API_INVALID_PARAM, "Items must be a JSON list of objects")
+    }
+    if len(items) == 0 || len(items) > MAX_BATCH_ITEMS {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("A batch takes 1 to %v items", MAX_BATCH_ITEMS))
+    }
+
+    var results = []BatchResult{}
+    for _, item := range items {
+        // Each item goes through the same validation as on its own.
+        values := url.Values{}
+        for key, value := range item { values.Set(key, fmt.Sprintf("%v", value)) }
+        values.Set("market", market.Name())
+        itemReq := &http.Request{Method:"GET", URL:&url.URL{RawQuery:values.Encode()}, Header:http.Header{}}
+
+        action := values.Get("action")
+        switch action {
+        case "add":
+            results = append(results, runBatchItem(action, func() *Order {
+                return addOrderFromParams(itemReq, user)
+            }))
+        case "cancel":
+            results = append(results, runBatchItem(action, func() *Order {
+                return cancelOrderFromParams(itemReq, user, market)
+            }))
+        default:
+            results = append(results, BatchResult{Action:action, Error:"Action must be add or cancel"})
+        }
+    }
+    ReturnJSON(API_OK, results)
+}
+
+// Cancels the user's pending orders, in all markets unless "market" is given,
+// & on both sides unless "order_type" is given.
+// Orders in halted markets stay, and come back with an error.
+func CancelAllHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    orderType := GetParamRegexp(r, "order_type", RE_ORDER_TYPE, false)
+    markets := []*Market{}
+    if GetParam(r, "market") != "" {
+        markets = append(markets, GetParamMarket(r, "market"))
+    } else {
+        for _, marketName := range MarketNames { markets = append(markets, Markets[marketName]) }
+    }
+
+    canceled, halted := CancelAllOrders(user.Id, markets, orderType)
+    var results = []BatchResult{}
+    for _, order := range canceled {
+        results = append(results, BatchResult{Action:"cancel", Order:order})
+    }
+    for _, order := range halted {
+        results = append(results, BatchResult{Action:"cancel", Order:order,
+            Error:fmt.Sprintf("Market %v is halted", order.MarketName())})
+    }
+    ReturnJSON(API_OK, results)
+}
+
+// Changes the price and/or size of a pending limit order, see amend.go.
+// Bids placed for an amount of the coin get their basis amount recomputed at the
+// new price, unless basis_amount is given.
+func AmendOrderHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    id :=               GetParamInt64(r, "id")
+    amount, _ :=        GetParamUint64Safe(r, "amount")
+    basisAmount, _ :=   GetParamUint64Safe(r, "basis_amount")
+    priceFloat, _ :=    GetParamFloat64Safe(r, "price")
+
+    order := LoadOrder(id)
+    if order == nil || order.UserId != user.Id { ReturnJSON(API_INVALID_PARAM, "Order with that id does not exist") }
+    market := order.Market()
+
+    var price uint64
+    if priceFloat > 0 {
+        price = F64ToPrice(priceFloat)
+        if price % market.TickSize != 0 {
+            ReturnJSON(API_INVALID_PARAM,
+                fmt.Sprintf("Price must be a multiple of %v", PriceToF64(market.TickSize)))
+        }
+        // As for new orders, see AddOrderHandler.
+        if !order.IsStop() {
+            bandLow, bandHigh := market.PriceBand()
+            if order.Type == ORDER_TYPE_BID && price > bandHigh {
+                ReturnJSON(API_INVALID_PARAM,
+                    fmt.Sprintf("Bid price can be at most %v", PriceToF64(bandHigh)))
+            }
+            if order.Type == ORDER_TYPE_ASK && price < bandLow {
+                ReturnJSON(API_INVALID_PARAM,
+                    fmt.Sprintf("Ask price must be at least %v", PriceToF64(bandLow)))
+            }
+        }
+    }
+    if amount > 0 && amount < market.MinTrade {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Minimum order amount is %v %v", I64ToF64(int64(market.MinTrade)), market.Coin))
+    }
+    if basisAmount > 0 && basisAmount < market.BasisMinTrade {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Minimum order amount is %v %v", I64ToF64(int64(market.BasisMinTrade)), market.BasisCoin))
+    }
+    if order.Type == ORDER_TYPE_BID && order.Amount > 0 && basisAmount == 0 && (price > 0 || amount > 0) {
+        newAmount, newPrice := order.Amount, order.Price
+        if amount > 0 { newAmount = amount }
+        if price > 0  { newPrice = price }
+        if newAmount > order.Filled {
+            basisAmount = order.BasisFilled + BasisForAmount(newAmount - order.Filled, newPrice)
+        }
+    }
+
+    amendment := &Amendment{Price:price, Amount:amount, BasisAmount:basisAmount}
+    if err := CheckAmendment(order, amendment); err != nil {
+        ReturnJSON(API_INVALID_PARAM, err.Error())
+    }
+    // Amendments that requeue are like new orders, the rest like cancellations.
+    if requeues(order, order.Amended(amendment)) && !market.CanAddOrder() {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("Market %v isn't taking orders", market.Name()))
+    }
+    if !market.CanCancelOrder() {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("Market %v is halted", market.Name()))
+    }
+
+    AmendOrder(order, amendment)
+
+    ReturnJSON(API_OK, "AMENDED")
+}
+
+// Arms or renews cancel on disconnect for the api_key, see heartbeat.go.
+// If no heartbeat comes within timeout seconds, all of the user's orders get canceled.
+// A timeout of 0 disarms it.
+func HeartbeatHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    apiKey := GetParam(r, "api_key")
+    timeout := GetParamInt64(r, "timeout")
+
+    if key := auth.LoadAPIKey(apiKey); key == nil || key.UserId != user.Id {
+        ReturnJSON(API_INVALID_PARAM, "Heartbeats need an api_key")
+    }
+    if timeout < 0 || timeout > MAX_HEARTBEAT_TIMEOUT {
+        ReturnJSON(API_INVALID_PARAM,
+            fmt.Sprintf("Timeout must be from 0 to %v seconds", MAX_HEARTBEAT_TIMEOUT))
+    }
+
+    heartbeat := SendHeartbeat(user.Id, apiKey, timeout, time.Now().Unix())
+    ReturnJSON(API_OK, heartbeat)
+}
+
+// The times that missed heartbeats canceled the user's orders, newest first.
+func AutoCancelsHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    autoCancels := LoadAutoCancelsByUser(user.Id, 100)
+    ReturnJSON(API_OK, autoCancels)
 }
 
+// Sets the default self trade policy for the user's new orders.
+func SelfTradePolicyHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    policy := GetParamRegexp(r, "stp_policy", RE_SELF_TRADE_POLICY, true)
+
+    auth.UpdateUserSetSelfTradePolicy(user.Id, policy)
+
+    ReturnJSON(API_OK, policy)
+}
+
+// The user's current fee tier for each market, along with the market's whole schedule.
+// Volume is the user's trailing volume in all markets of the basis coin.
+func FeesHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    type feeInfo struct {
+        Market      string      `json:"market"`
+        BasisCoin   string      `json:"basisCoin"`
+        Volume      uint64      `json:"volume"`
+        MakerRatio  float64     `json:"makerRatio"`
+        TakerRatio  float64     `json:"takerRatio"`
+        Tiers       []*FeeTier  `json:"tiers"`
+    }
+    var infos = []feeInfo{}
+    for _, marketName := range MarketNames {
+        market := Markets[marketName]
+        tier, volume := GetFeeTier(user.Id, market.BasisCoin, market.Coin)
+        infos = append(infos, feeInfo{
+            Market:     marketName,
+            BasisCoin:  market.BasisCoin,
+            Volume:     volume,
+            MakerRatio: tier.MakerRatio,
+            TakerRatio: tier.TakerRatio,
+            Tiers:      Config.GetFeeTiers(market.BasisCoin, market.Coin),
+        })
+    }
+    ReturnJSON(API_OK, infos)
+}
+
+// Orders in a group come with the group, see groups.go.
+// With a client_id, returns just that order whatever its status, so that clients can
+// tell whether an order they submitted got saved.
 func GetPendingOrdersHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    type pendingOrder struct {
+        *Order
+        Group       *OrderGroup `json:"group,omitempty"`
+    }
     market := GetParamMarket(r, "market")
-    orders := LoadPendingOrdersByUser(user.Id, market.BasisCoin, market.Coin)
-    ReturnJSON(API_OK, orders)
+    clientId := GetParamRegexp(r, "client_id", RE_CLIENT_ID, false)
+    var orders []*Order
+    if clientId != "" {
+        order := LoadOrderByClientId(user.Id, clientId)
+        if order != nil && order.MarketName() == market.Name() { orders = append(orders, order) }
+    } else {
+        orders = LoadPendingOrdersByUser(user.Id, market.BasisCoin, market.Coin)
+    }
+    groups := map[int64]*OrderGroup{}
+    for _, group := range LoadPendingOrderGroupsByUser(user.Id, market.BasisCoin, market.Coin) {
+        groups[group.Id] = group
+    }
+    var pending = []pendingOrder{}
+    for _, order := range orders {
+        pending = append(pending, pendingOrder{order, groups[order.GroupId]})
+    }
+    ReturnJSON(API_OK, pending)
 }
 
+// The user's trades, newest first, a page at a time.
+// Pass the returned "next" as "before" to get the next page; it's 0 after the last page.
+// "market" is optional, and so are "start" & "end" (unix time).
 func TradeHistoryHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
-    // TODO
+    before, _ := GetParamInt64Safe(r, "before")
+    start, _ :=  GetParamInt64Safe(r, "start")
+    end, _ :=    GetParamInt64Safe(r, "end")
+    limit, _ :=  GetParamInt64Safe(r, "limit")
+
+    var basisCoin, coin string
+    if GetParam(r, "market") != "" {
+        market := GetParamMarket(r, "market")
+        basisCoin, coin = market.BasisCoin, market.Coin
+    }
+    if limit <= 0 || limit > MAX_TRADES_PAGE { limit = MAX_TRADES_PAGE }
+
+    trades := LoadTradeHistory(user.Id, basisCoin, coin, start, end, before, uint(limit))
+    userTrades := []*UserTrade{}
+    for _, trade := range trades {
+        userTrades = append(userTrades, trade.ForUser(user.Id))
+    }
+    next := int64(0)
+    if len(trades) == int(limit) { next = trades[len(trades)-1].Id }
+
+    ReturnJSON(API_OK, map[string]interface{}{
+        "trades": userTrades,
+        "next":   next,
+    })
+}
+
+// The latest trades in a market, newest first.
+func TradesHandler(w http.ResponseWriter, r *http.Request) {
+    market := GetParamMarket(r, "market")
+    limit, _ := GetParamInt64Safe(r, "limit")
+    if limit <= 0 || limit > MAX_TRADES_PAGE { limit = MAX_TRADES_PAGE }
+
+    trades := LoadRecentTrades(market.BasisCoin, market.Coin, uint(limit))
+    sTrades := []*STrade{}
+    for _, trade := range trades {
+        sTrades = append(sTrades, trade.Anonymize())
+    }
+    ReturnJSON(API_OK, sTrades)
 }
 
+// "interval" is optional, by default it's picked to fit start to end.
+// Each entry has its interval as "i".
+// At most MAX_PRICE_LOGS entries are returned, the latest ones.
 func PriceLogHandler(w http.ResponseWriter, r *http.Request) {
     market := GetParamMarket(r, "market")
     start  := GetParamInt64(r, "start")
     end    := GetParamInt64(r, "end")
+    interval, _ := GetParamInt64Safe(r, "interval")
 
     if end == 0 || end < int64(0) { end = time.Now().Unix() + end }
     if start == 0 { ReturnJSON(API_INVALID_PARAM, "Parameter 'start' cannot be 0") }
     if start < 0 { start = time.Now().Unix() + start }
 
-    // TODO: automatically adjust interval based on start & end.
-    plogs := market.PriceLogger.LoadPrices(60*5, start, end)
+    logger := market.PriceLogger
+    if interval == 0 {
+        interval = logger.PickInterval(start, end)
+    } else if !logger.HasInterval(interval) {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("Interval %v is not available for %v", interval, market.Name()))
+    }
+    if (end - start) / interval > MAX_PRICE_LOGS { start = end - MAX_PRICE_LOGS * interval }
+
+    plogs := logger.LoadPrices(interval, start, end)
     ReturnJSON(API_OK, plogs)
 }
@@ -0,0 +1,80 @@
+/*
+Cancel on disconnect, a dead man's switch for bots. Once a client sends a heartbeat
+for its API key with a timeout, it has to send the next one before the deadline,
+or all of the user's pending orders get canceled, see FireHeartbeats().
+A heartbeat with a timeout of 0 disarms the switch.
+Each time it fires gets recorded as an AutoCancel, so the owner can tell why
+their orders went away.
+Heartbeats are saved, so the switch stays armed across restarts.
+*/
+
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/db"
+)
+
+// Longest timeout a heartbeat may have, in seconds.
+const MAX_HEARTBEAT_TIMEOUT = 24*60*60
+
+// Arms or renews the switch for apiKey to fire timeout seconds after now,
+// or disarms it if timeout is 0.
+func SendHeartbeat(userId int64, apiKey string, timeout int64, now int64) *Heartbeat {
+    if timeout < 0 || timeout > MAX_HEARTBEAT_TIMEOUT {
+        panic(NewError("Heartbeat timeout must be from 0 to %v seconds", MAX_HEARTBEAT_TIMEOUT))
+    }
+    heartbeat := &Heartbeat{APIKey:apiKey, UserId:userId, Timeout:timeout, Deadline:now + timeout}
+    err := db.DoBegin("", func(tx *db.ModelTx) {
+        if timeout == 0 {
+            DeleteHeartbeat(tx, apiKey)
+        } else {
+            SaveOrUpdateHeartbeat(tx, heartbeat)
+        }
+    })
+    if err != nil { panic(err) }
+    return heartbeat
+}
+
+// Cancels the orders of users whose heartbeats missed their deadline as of now,
+// in all markets. Orders in halted markets go too, or they'd trade once the market
+// reopens, after the switch disarmed.
+// Returns what got recorded for each.
+func FireHeartbeats(now int64) []*AutoCancel {
+    markets := []*Market{}
+    for _, marketName := range MarketNames { markets = append(markets, Markets[marketName]) }
+
+    autoCancels := []*AutoCancel{}
+    for _, heartbeat := range LoadExpiredHeartbeats(now) {
+        // A heartbeat may have come in since.
+        var fired bool
+        err := db.DoBegin("", func(tx *db.ModelTx) {
+            fired = DeleteExpiredHeartbeat(tx, heartbeat.APIKey, now)
+        })
+        if err != nil { panic(err) }
+        if !fired { continue }
+
+        var canceled, halted int64
+        for _, market := range markets {
+            for _, order := range LoadPendingOrdersByUser(heartbeat.UserId, market.BasisCoin, market.Coin) {
+                if !market.CanCancelOrder() { halted++ }
+                queueCancellation(order)
+                canceled++
+            }
+        }
+        autoCancel := &AutoCancel{
+            UserId:     heartbeat.UserId,
+            APIKey:     heartbeat.APIKey,
+            Deadline:   heartbeat.Deadline,
+            Canceled:   canceled,
+            Halted:     halted,
+        }
+        err = db.DoBegin("", func(tx *db.ModelTx) {
+            SaveAutoCancel(tx, autoCancel)
+        })
+        if err != nil { panic(err) }
+        Warn("[user: %v] Missed heartbeat, canceled %v orders (%v in halted markets)", heartbeat.UserId, canceled, halted)
+        autoCancels = append(autoCancels, autoCancel)
+    }
+    return autoCancels
+}
@@ -0,0 +1,341 @@
+/*
+The matching journal is an append-only log of each market's goroutine, so that a
+matching bug can be debugged from what happened instead of from the DB end state.
+Commands get journaled by ProcessOrder() as they come in: orders, cancellations &
+amendments. What they result in gets journaled in the same transaction as the DB
+change: trades, and the new state of each order that changed (see UpdateOrder()
+& co.), whether it traded, shrank, got canceled, amended or triggered.
+A command gets its own transaction, so a crash can leave it without results.
+Since only the results change state, it counts as never processed, which it
+wasn't: its order is still pending as queued, & gets processed again when the
+market loads.
+Seq is monotonic, and one goroutine writes each market's entries, so applying
+them in Seq order goes through the same states the market did. Whenever a market
+loads, and every JOURNAL_SNAPSHOT commands, its journal gets a snapshot of its
+pending orders, see snapshotJournal(). Checks start from the latest snapshot, so
+what they cost follows the live book instead of the journal's whole history.
+A JournalCheck rebuilds the book from the journaled states, checks that the trades
+add up to the fills, & compares it all with exchange_order & exchange_trade, see
+bin/check_journal.go. It doesn't rerun the commands through the matching engine,
+so a matching bug that the journal & the DB both recorded won't show up in it.
+Markets may also recover their books from it when they load, see
+Config.RecoverBookFromJournal.
+*/
+
+package exchange
+
+import (
+    . "ftnox.com/common"
+    . "ftnox.com/config"
+    "ftnox.com/db"
+    "github.com/jaekwon/GoLLRB/llrb"
+    "encoding/json"
+    "fmt"
+)
+
+const (
+    JOURNAL_START  = "S" // a snapshot checks can start at, RefId is the market's last trade then
+    JOURNAL_ORDER  = "O" // command: an order to process, as queued
+    JOURNAL_CANCEL = "C" // command: a cancellation, with the order as queued
+    JOURNAL_AMEND  = "A" // command: an amendment, see amend.go
+    JOURNAL_TRADE  = "T" // a trade, which fills both orders
+    JOURNAL_UPDATE = "U" // an order's new state
+
+    JOURNAL_PAGE     = 1000  // entries loaded at a time
+    JOURNAL_SNAPSHOT = 10000 // commands between snapshots
+)
+
+func journalEntry(kind string, market string, refId int64, priority int64, v interface{}) *JournalEntry {
+    data, err := json.Marshal(v)
+    if err != nil { panic(err) }
+    return &JournalEntry{
+        Market:     market,
+        Kind:       kind,
+        RefId:      refId,
+        Priority:   priority,
+        Data:       string(data),
+    }
+}
+
+// Call this in the transaction that saves the order's state.
+func journalOrder(tx *db.ModelTx, kind string, order *Order) {
+    SaveJournalEntry(tx, journalEntry(kind, order.MarketName(), order.Id, order.Priority, order))
+}
+
+// Call this in the transaction that saves the trade.
+func journalTrade(tx *db.ModelTx, trade *Trade) {
+    SaveJournalEntry(tx, journalEntry(JOURNAL_TRADE, MarketName(trade.Coin, trade.BasisCoin), trade.Id, 0, trade))
+}
+
+// Journals order as ProcessOrder() gets it, before anything happens to it.
+// Takes a snapshot first every JOURNAL_SNAPSHOT commands.
+func (market *Market) journalCommand(order *Order) {
+    market.journaled++
+    if market.journaled >= JOURNAL_SNAPSHOT {
+        snapshotJournal(market.BasisCoin, market.Coin)
+        market.journaled = 0
+    }
+    var entry *JournalEntry
+    switch {
+    case order.Amend != nil:
+        entry = journalEntry(JOURNAL_AMEND, market.Name(), order.Id, order.Priority, order.Amend)
+    case order.Cancel:
+        entry = journalEntry(JOURNAL_CANCEL, market.Name(), order.Id, order.Priority, order)
+    default:
+        entry = journalEntry(JOURNAL_ORDER, market.Name(), order.Id, order.Priority, order)
+    }
+    // Appending doesn't conflict with anything, so no need for serializable.
+    err := db.DoBegin("", func(tx *db.ModelTx) {
+        SaveJournalEntry(tx, entry)
+    })
+    if err != nil { panic(err) }
+}
+
+// Journals the state of the market's pending orders after a JOURNAL_START entry,
+// so that checks don't need anything from before.
+// Call this from the market's goroutine, or before it runs.
+func snapshotJournal(basisCoin string, coin string) {
+    market := MarketName(coin, basisCoin)
+    var lastTradeId int64
+    if trades := LoadRecentTrades(basisCoin, coin, 1); len(trades) > 0 { lastTradeId = trades[0].Id }
+    orders := LoadPendingOrdersSince(basisCoin, coin, 0)
+    err := db.DoBeginSerializable(func(tx *db.ModelTx) {
+        SaveJournalEntry(tx, journalEntry(JOURNAL_START, market, lastTradeId, 0, struct{}{}))
+        for _, order := range orders {
+            journalOrder(tx, JOURNAL_UPDATE, order)
+        }
+    })
+    if err != nil { panic(err) }
+    Info("[%v] Snapshot of %v pending orders in the journal", market, len(orders))
+}
+
+// Filled & BasisFilled, as trades add up to them.
+type fills struct {
+    amount  uint64
+    basis   uint64
+}
+
+// A market's state as rebuilt from its journal, see Apply().
+type JournalCheck struct {
+    Coin        string
+    BasisCoin   string
+    Start       *JournalEntry           // the JOURNAL_START entry the check started at, nil until then
+    Orders      map[int64]*Order        // the latest state of each order journaled
+    Trades      map[int64]*Trade
+    Commands    int                     // orders, cancellations & amendments
+    LastSeq     int64
+    ids         []int64                 // of Orders, in the order they were first journaled
+    tradeIds    []int64                 // of Trades, in journal order
+    base        map[int64]fills         // what each order had filled when first journaled
+    traded      map[int64]fills         // what each order's trades add up to since
+    problems    []string
+}
+
+func NewJournalCheck(basisCoin string, coin string) *JournalCheck {
+    return &JournalCheck{
+        Coin:       coin,
+        BasisCoin:  basisCoin,
+        Orders:     map[int64]*Order{},
+        Trades:     map[int64]*Trade{},
+        base:       map[int64]fills{},
+        traded:     map[int64]fills{},
+    }
+}
+
+func (check *JournalCheck) Market() string {
+    return MarketName(check.Coin, check.BasisCoin)
+}
+
+// Checks the market's journal from its latest snapshot.
+// Nothing gets checked if it has none yet.
+func CheckJournal(basisCoin string, coin string) *JournalCheck {
+    start := LoadLastJournalStart(MarketName(coin, basisCoin))
+    if start == nil { return NewJournalCheck(basisCoin, coin) }
+    return CheckJournalSince(basisCoin, coin, start.Seq-1)
+}
+
+// Checks the market's journal from after afterSeq, which must be just before a
+// snapshot, or 0 for all of it.
+func CheckJournalSince(basisCoin string, coin string, afterSeq int64) *JournalCheck {
+    check := NewJournalCheck(basisCoin, coin)
+    check.LastSeq = afterSeq
+    for {
+        entries := LoadJournalEntries(check.Market(), check.LastSeq, JOURNAL_PAGE)
+        for _, entry := range entries {
+            check.Apply(entry)
+        }
+        if len(entries) < JOURNAL_PAGE { break }
+    }
+    return check
+}
+
+func (check *JournalCheck) problem(fmtStr string, args ...interface{}) {
+    check.problems = append(check.problems, fmt.Sprintf(fmtStr, args...))
+}
+
+func (entry *JournalEntry) order() *Order {
+    var order Order
+    err := json.Unmarshal([]byte(entry.Data), &order)
+    if err != nil { panic(NewError("Journal entry %v: %v", entry.Seq, err)) }
+    order.Priority = entry.Priority
+    return &order
+}
+
+func (entry *JournalEntry) trade() *Trade {
+    var trade Trade
+    err := json.Unmarshal([]byte(entry.Data), &trade)
+    if err != nil { panic(NewError("Journal entry %v: %v", entry.Seq, err)) }
+    return &trade
+}
+
+// Records order as the latest state of its id.
+func (check *JournalCheck) setOrder(order *Order) {
+    if check.Orders[order.Id] == nil {
+        check.ids = append(check.ids, order.Id)
+        check.base[order.Id] = fills{order.Filled, order.BasisFilled}
+    }
+    check.Orders[order.Id] = order
+}
+
+// Applies the next entry of the market's journal.
+// Updates are the orders' states, while commands only count, since what they
+// resulted in follows them. Orders that were never updated stay as queued, and
+// a command with nothing after it, e.g. cut off by a crash, changes nothing.
+// Anything that doesn't add up is left for Check().
+func (check *JournalCheck) Apply(entry *JournalEntry) {
+    if entry.Market != check.Market() {
+        panic(NewError("Journal entry %v is for %v, not %v", entry.Seq, entry.Market, check.Market()))
+    }
+    if entry.Seq <= check.LastSeq {
+        panic(NewError("Journal entry %v comes after %v", entry.Seq, check.LastSeq))
+    }
+    check.LastSeq = entry.Seq
+    if check.Start == nil && entry.Kind != JOURNAL_START {
+        check.problem("Entry %v comes before the start of the journal", entry.Seq)
+    }
+
+    switch entry.Kind {
+    case JOURNAL_START:
+        // Later snapshots restate what's been checked so far.
+        if check.Start == nil { check.Start = entry }
+    case JOURNAL_ORDER:
+        check.Commands++
+        // Orders queued again, e.g. once triggered, already have a state.
+        if check.Orders[entry.RefId] == nil { check.setOrder(entry.order()) }
+    case JOURNAL_CANCEL, JOURNAL_AMEND:
+        check.Commands++
+        if check.Orders[entry.RefId] == nil {
+            check.problem("[order: %v] Entry %v is for an order that was never journaled", entry.RefId, entry.Seq)
+        }
+    case JOURNAL_UPDATE:
+        check.setOrder(entry.order())
+    case JOURNAL_TRADE:
+        trade := entry.trade()
+        if check.Trades[trade.Id] == nil { check.tradeIds = append(check.tradeIds, trade.Id) }
+        check.Trades[trade.Id] = trade
+        for _, orderId := range []int64{trade.BidOrderId, trade.AskOrderId} {
+            if check.Orders[orderId] == nil {
+                check.problem("[trade: %v] Order %v was never journaled", trade.Id, orderId)
+                continue
+            }
+            traded := check.traded[orderId]
+            traded.amount += trade.TradeAmount
+            traded.basis += trade.TradeBasis
+            check.traded[orderId] = traded
+        }
+    default:
+        check.problem("Entry %v is of unknown kind %v", entry.Seq, entry.Kind)
+    }
+}
+
+// What doesn't add up within the journal: orders whose trades don't add up to
+// what they filled, & entries that don't follow from the ones before.
+func (check *JournalCheck) Problems() []string {
+    problems := append([]string{}, check.problems...)
+    if check.Start == nil { problems = append(problems, fmt.Sprintf("The journal of %v hasn't started", check.Market())) }
+    for _, id := range check.ids {
+        order, base, traded := check.Orders[id], check.base[id], check.traded[id]
+        if order.Filled != base.amount + traded.amount || order.BasisFilled != base.basis + traded.basis {
+            problems = append(problems, fmt.Sprintf("[order: %v] Filled %v & %v, but its trades add up to %v & %v",
+                id, order.Filled - base.amount, order.BasisFilled - base.basis, traded.amount, traded.basis))
+        }
+        if order.Status == ORDER_STATUS_PENDING && order.Complete() {
+            problems = append(problems, fmt.Sprintf("[order: %v] Complete but still pending", id))
+        }
+    }
+    return problems
+}
+
+// The best limit orders of orderType in the book the journal left, with ids up to maxId,
+// as LoadLimitBids() & LoadLimitAsks() load the best ones from the DB.
+func (check *JournalCheck) LimitOrders(orderType string, limit int, maxId int64) (orders []*Order, hasMore bool) {
+    book := llrb.New()
+    for _, id := range check.ids {
+        order := check.Orders[id]
+        if order.Type != orderType || order.Kind != ORDER_KIND_LIMIT { continue }
+        if order.Status != ORDER_STATUS_PENDING || order.Id > maxId { continue }
+        book.InsertNoReplace(order)
+    }
+    if book.Len() == 0 { return nil, false }
+    book.AscendGreaterOrEqual(book.Min(), func(i llrb.Item) bool {
+        if len(orders) == limit { return false }
+        orders = append(orders, i.(*Order))
+        return true
+    })
+    return orders, book.Len() > limit
+}
+
+// Differences of the journaled order from the saved one.
+// BasisFeeFilled isn't compared, orders that last traded before UpdateOrder() saved it have 0 there.
+func diffOrder(journaled *Order, saved *Order) (diffs []string) {
+    field := func(name string, j interface{}, s interface{}) {
+        if j == s { return }
+        diffs = append(diffs, fmt.Sprintf("[order: %v] %v is %v in the journal but %v in the DB", journaled.Id, name, j, s))
+    }
+    field("status",       journaled.Status,       saved.Status)
+    field("kind",         journaled.Kind,         saved.Kind)
+    field("price",        journaled.Price,        saved.Price)
+    field("amount",       journaled.Amount,       saved.Amount)
+    field("filled",       journaled.Filled,       saved.Filled)
+    field("basis_amount", journaled.BasisAmount,  saved.BasisAmount)
+    field("basis_filled", journaled.BasisFilled,  saved.BasisFilled)
+    field("basis_fee",    journaled.BasisFee,     saved.BasisFee)
+    field("priority",     journaled.Priority,     saved.Priority)
+    return
+}
+
+// Differences between the state the journal left & exchange_order & exchange_trade.
+// Trades of the market since the journal started must all have been journaled.
+func (check *JournalCheck) Diff() []string {
+    diffs := []string{}
+    if check.Start == nil { return diffs }
+    for _, id := range check.ids {
+        saved := LoadOrder(id)
+        if saved == nil {
+            diffs = append(diffs, fmt.Sprintf("[order: %v] Missing from the DB", id))
+            continue
+        }
+        diffs = append(diffs, diffOrder(check.Orders[id], saved)...)
+    }
+
+    saved := map[int64]bool{}
+    afterId := check.Start.RefId
+    for {
+        trades := LoadTradesAfterId(check.BasisCoin, check.Coin, afterId, JOURNAL_PAGE)
+        for _, trade := range trades {
+            afterId = trade.Id
+            saved[trade.Id] = true
+            journaled := check.Trades[trade.Id]
+            if journaled == nil {
+                diffs = append(diffs, fmt.Sprintf("[trade: %v] Missing from the journal", trade.Id))
+            } else if *journaled != *trade {
+                diffs = append(diffs, fmt.Sprintf("[trade: %v] Is %+v in the journal but %+v in the DB", trade.Id, *journaled, *trade))
+            }
+        }
+        if len(trades) < JOURNAL_PAGE { break }
+    }
+    for _, id := range check.tradeIds {
+        if !saved[id] { diffs = append(diffs, fmt.Sprintf("[trade: %v] Missing from the DB", id)) }
+    }
+    return diffs
+}
@@ -0,0 +1,69 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "testing"
+)
+
+func TestJournalCheck(t *testing.T) {
+    check := NewJournalCheck("BTC", "LTC")
+    seq := int64(0)
+    apply := func(kind string, refId int64, priority int64, v interface{}) {
+        seq++
+        entry := journalEntry(kind, "LTC/BTC", refId, priority, v)
+        entry.Seq = seq
+        check.Apply(entry)
+    }
+
+    // An ask from before the journal started, which had filled 10.
+    ask := &Order{Id:1, Type:"A", Kind:"L", Coin:"LTC", BasisCoin:"BTC", Amount:100, Filled:10, Price:USATOSHI, Priority:1}
+    apply(JOURNAL_START, 0, 0, struct{}{})
+    apply(JOURNAL_UPDATE, ask.Id, ask.Priority, ask)
+
+    // A bid that takes 30 of it.
+    bid := &Order{Id:2, Type:"B", Kind:"L", Coin:"LTC", BasisCoin:"BTC", Amount:30, Price:USATOSHI, Priority:2}
+    apply(JOURNAL_ORDER, bid.Id, bid.Priority, bid)
+    ask.Filled, ask.BasisFilled = 40, 30
+    bid.Filled, bid.BasisFilled, bid.Status = 30, 30, ORDER_STATUS_COMPLETE
+    apply(JOURNAL_UPDATE, ask.Id, ask.Priority, ask)
+    apply(JOURNAL_UPDATE, bid.Id, bid.Priority, bid)
+    apply(JOURNAL_TRADE, 1, 0, &Trade{Id:1, BidOrderId:2, AskOrderId:1, Coin:"LTC", BasisCoin:"BTC", TradeAmount:30, TradeBasis:30, Price:USATOSHI})
+
+    // Another ask that rests behind the first.
+    ask2 := &Order{Id:3, Type:"A", Kind:"L", Coin:"LTC", BasisCoin:"BTC", Amount:50, Price:USATOSHI, Priority:3}
+    apply(JOURNAL_ORDER, ask2.Id, ask2.Priority, ask2)
+    apply(JOURNAL_CANCEL, bid.Id, bid.Priority, bid)
+
+    if problems := check.Problems(); len(problems) != 0 { t.Errorf("Expected no problems, got %v", problems) }
+    if check.Commands != 3 { t.Errorf("Expected 3 commands, got %v", check.Commands) }
+    asks, hasMore := check.LimitOrders(ORDER_TYPE_ASK, 1, 3)
+    if len(asks) != 1 || asks[0].Id != 1 || asks[0].Filled != 40 || !hasMore {
+        t.Errorf("Expected the first ask to come first, with more behind it, got %v %v", asks, hasMore)
+    }
+    if asks, _ := check.LimitOrders(ORDER_TYPE_ASK, 10, 2); len(asks) != 1 {
+        t.Errorf("Expected orders after maxId to be left out, got %v", asks)
+    }
+    if bids, _ := check.LimitOrders(ORDER_TYPE_BID, 10, 3); len(bids) != 0 {
+        t.Errorf("Expected the complete bid to be out of the book, got %v", bids)
+    }
+
+    // A later snapshot restates the pending orders.
+    apply(JOURNAL_START, 1, 0, struct{}{})
+    apply(JOURNAL_UPDATE, ask.Id, ask.Priority, ask)
+    apply(JOURNAL_UPDATE, ask2.Id, ask2.Priority, ask2)
+    if problems := check.Problems(); len(problems) != 0 || check.Start.Seq != 1 {
+        t.Errorf("Expected a later snapshot to change nothing, got %v from entry %v", problems, check.Start.Seq)
+    }
+
+    // A cancellation that a crash cut off before any result, then ask2 again as the market reloads.
+    apply(JOURNAL_CANCEL, ask2.Id, ask2.Priority, ask2)
+    apply(JOURNAL_ORDER, ask2.Id, ask2.Priority, ask2)
+    if asks, _ := check.LimitOrders(ORDER_TYPE_ASK, 10, 3); len(check.Problems()) != 0 || len(asks) != 2 {
+        t.Errorf("Expected a command without results to change nothing, got %v", asks)
+    }
+
+    // An update that no trade accounts for.
+    ask2.Filled = 5
+    apply(JOURNAL_UPDATE, ask2.Id, ask2.Priority, ask2)
+    if problems := check.Problems(); len(problems) != 1 { t.Errorf("Expected 1 problem, got %v", problems) }
+}
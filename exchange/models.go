@@ -2,6 +2,7 @@ package exchange
 
 import (
     . "ftnox.com/common"
+    . "ftnox.com/config"
     "ftnox.com/db"
     "database/sql"
     "math"
@@ -14,21 +15,31 @@ import (
 type Order struct {
     Id              int64   `json:"id"              db:"id,autoinc"`
     Type            string  `json:"type"            db:"type"`
+    Kind            string  `json:"kind"            db:"kind"`
+    TimeInForce     string  `json:"timeInForce"     db:"time_in_force"`
+    SelfTradePolicy string  `json:"selfTradePolicy" db:"stp_policy"`
     UserId          int64   `json:"userId"          db:"user_id"`
     Coin            string  `json:"coin"            db:"coin"`
     Amount          uint64  `json:"amount"          db:"amount"`
     Filled          uint64  `json:"filled"          db:"filled"`
+    DisplayAmount   uint64  `json:"displayAmount"   db:"display_amount"`   // icebergs only show this much, 0 for all
     BasisCoin       string  `json:"basisCoin"       db:"basis_coin"`
     BasisAmount     uint64  `json:"basisAmount"     db:"basis_amount"`
     BasisFilled     uint64  `json:"basisFilled"     db:"basis_filled"`
     BasisFee        uint64  `json:"basisFee"        db:"basis_fee"`
-    BasisFeeFilled  uint64  `json:"basisFeeFilled"  db:"basis_fee_filled"`
-    BasisFeeRatio   float64 `json:"basisFeeRatio"   db:"basis_fee_ratio"`
-    Price           float64 `json:"price"           db:"price"`
+    BasisFeeFilled  int64   `json:"basisFeeFilled"  db:"basis_fee_filled"` // negative after maker rebates
+    BasisFeeRatio   float64 `json:"basisFeeRatio"   db:"basis_fee_ratio"`  // what BasisFee was reserved at, see MaxFeeRatio
+    Price           uint64  `json:"price"           db:"price"`       // see PRICE_SCALE
+    StopPrice       uint64  `json:"stopPrice"       db:"stop_price"`
     Status          uint32  `json:"status"          db:"status"`
     Cancel          bool    `json:"-"`
+    Amend           *Amendment `json:"-"`                                  // see amend.go
+    ExpireTime      int64   `json:"expireTime"      db:"expire_time"`
     Time            int64   `json:"time"            db:"time"`
     Updated         int64   `json:"updated"         db:"updated"`
+    Priority        int64   `json:"-"               db:"priority"`         // time priority within a price level, see Less()
+    GroupId         int64   `json:"groupId"         db:"group_id"`         // see OrderGroup, 0 for none
+    ClientId        string  `json:"clientId"        db:"client_id"`        // unique per user, "" for none, see AddOrder()
 }
 
 var OrderModel = db.GetModelInfo(new(Order))
@@ -37,6 +48,24 @@ const (
     ORDER_TYPE_BID = "B"
     ORDER_TYPE_ASK = "A"
 
+    ORDER_KIND_LIMIT  = "L"
+    ORDER_KIND_MARKET = "M" // Executes against the book until exhausted, never rests on the book.
+    ORDER_KIND_STOP       = "S" // Becomes a market order once the last trade reaches StopPrice.
+    ORDER_KIND_STOP_LIMIT = "T" // Becomes a limit order once the last trade reaches StopPrice.
+
+    ORDER_TIF_GTC       = "G" // Good till canceled
+    ORDER_TIF_IOC       = "I" // Immediate or cancel: whatever doesn't fill right away gets canceled
+    ORDER_TIF_FOK       = "F" // Fill or kill: fills completely right away, or gets canceled
+    ORDER_TIF_POST_ONLY = "P" // Maker only: gets canceled if it would take from the book
+    ORDER_TIF_GTT       = "T" // Good till time: gets canceled after ExpireTime
+
+    // What happens when an order would match another order from the same user.
+    // The policy of the incoming (newer) order is the one that applies.
+    ORDER_STP_CANCEL_NEWEST = "N" // Cancel the incoming order (default)
+    ORDER_STP_CANCEL_OLDEST = "O" // Cancel the resting order, keep matching
+    ORDER_STP_CANCEL_BOTH   = "B" // Cancel both
+    ORDER_STP_DECREMENT     = "D" // Shrink both by the amount that would have traded, canceling whichever runs out
+
     ORDER_STATUS_PENDING = 0
     // ORDER_STATUS_INCOMPLETE = 1 (NOT USED, RESERVED)
     ORDER_STATUS_COMPLETE = 2
@@ -47,11 +76,36 @@ func (order *Order) Validate() {
 
     if 0 < order.Amount && order.Amount < order.Filled                  { panic(NewError("[order: %v] order.Amount < order.Filled", order.Id)) }
     if 0 < order.BasisAmount && order.BasisAmount < order.BasisFilled   { panic(NewError("[order: %v] order.BasisAmount < order.BasisFilled", order.Id)) }
+    switch order.Kind {
+    case ORDER_KIND_LIMIT, ORDER_KIND_MARKET: break
+    case ORDER_KIND_STOP, ORDER_KIND_STOP_LIMIT:
+        if order.StopPrice == 0                 { panic(NewError("[order: %v] Stop order has no StopPrice", order.Id)) }
+    default:
+        panic(NewError("[order: %v] Invalid order kind %v", order.Id, order.Kind))
+    }
+    switch order.TimeInForce {
+    case ORDER_TIF_GTC, ORDER_TIF_IOC, ORDER_TIF_FOK, ORDER_TIF_POST_ONLY: break
+    case ORDER_TIF_GTT:
+        if order.ExpireTime == 0                { panic(NewError("[order: %v] Good till time order has no ExpireTime", order.Id)) }
+    default:
+        panic(NewError("[order: %v] Invalid time in force %v", order.Id, order.TimeInForce))
+    }
+    switch order.SelfTradePolicy {
+    case ORDER_STP_CANCEL_NEWEST, ORDER_STP_CANCEL_OLDEST, ORDER_STP_CANCEL_BOTH, ORDER_STP_DECREMENT: break
+    default:
+        panic(NewError("[order: %v] Invalid self trade policy %v", order.Id, order.SelfTradePolicy))
+    }
+    if order.DisplayAmount > 0 &&
+       (order.Kind == ORDER_KIND_STOP ||
+        !order.CanRest())                       { panic(NewError("[order: %v] Only orders that rest on the book can be icebergs", order.Id)) }
+    if (order.Kind == ORDER_KIND_MARKET || order.Kind == ORDER_KIND_STOP) &&
+       !(order.TimeInForce == ORDER_TIF_IOC ||
+         order.TimeInForce == ORDER_TIF_FOK)    { panic(NewError("[order: %v] Market orders must be immediate or cancel, or fill or kill", order.Id)) }
 
     if order.Type == ORDER_TYPE_BID {
         bid := order
         if bid.BasisAmount == 0                 { panic(NewError("[order: %v] bid.BasisAmount == 0", bid.Id)) }
-        if bid.BasisFee    < bid.BasisFeeFilled { panic(NewError("[order: %v] bid.BasisFee    < bid.BasisFeeFilled", bid.Id)) }
+        if int64(bid.BasisFee) < bid.BasisFeeFilled { panic(NewError("[order: %v] bid.BasisFee    < bid.BasisFeeFilled", bid.Id)) }
         if bid.Complete() &&
            bid.Status != ORDER_STATUS_COMPLETE  { panic(NewError("[order: %v] bid.Status != ORDER_STATUS_COMPLETE", bid.Id)) }
         // bid.Amount may be anything.
@@ -66,8 +120,65 @@ func (order *Order) Validate() {
     }
 }
 
+// Whether this order is waiting for a trigger.
+func (order *Order) IsStop() bool {
+    return order.Kind == ORDER_KIND_STOP || order.Kind == ORDER_KIND_STOP_LIMIT
+}
+
+// Converts a stop order into the order it becomes once triggered.
+func (order *Order) Trigger() {
+    switch order.Kind {
+    case ORDER_KIND_STOP:       order.Kind = ORDER_KIND_MARKET
+    case ORDER_KIND_STOP_LIMIT: order.Kind = ORDER_KIND_LIMIT
+    default: panic(NewError("[order: %v] Cannot trigger order of kind %v", order.Id, order.Kind))
+    }
+}
+
+// Whether the unfilled remainder of this order may rest on the book.
+func (order *Order) CanRest() bool {
+    if order.Kind == ORDER_KIND_MARKET { return false }
+    return order.TimeInForce != ORDER_TIF_IOC && order.TimeInForce != ORDER_TIF_FOK
+}
+
+// Icebergs show a slice of DisplayAmount at a time. Once it fills, the next slice
+// comes out of the hidden rest of the order, at the back of the price level.
+// A slice that filled partly while the order was taking shows only what's left of it.
+func (order *Order) SliceRemaining() uint64 {
+    if order.DisplayAmount == 0 { panic(NewError("[order: %v] Not an iceberg", order.Id)) }
+    return order.DisplayAmount - order.Filled % order.DisplayAmount
+}
+
+// Whether an iceberg's visible slice just filled, with more hidden behind it.
+func (order *Order) SliceFilled() bool {
+    return order.DisplayAmount > 0 && order.Filled > 0 &&
+        order.Filled % order.DisplayAmount == 0 && !order.Complete()
+}
+
+// A copy that trades its hidden amount too, for when slices don't matter.
+func (order *Order) withHidden() *Order {
+    whole := *order
+    whole.DisplayAmount = 0
+    return &whole
+}
+
+// Whether this is a good till time order that has expired by time now.
+func (order *Order) Expired(now int64) bool {
+    return order.TimeInForce == ORDER_TIF_GTT && order.ExpireTime <= now
+}
+
+// Whether order would trade against match, which is on the other side of the book.
+// Market orders trade against anything.
+func (order *Order) Crosses(match *Order) bool {
+    if order.Kind == ORDER_KIND_MARKET { return true }
+    if order.Type == ORDER_TYPE_BID {
+        return match.Price <= order.Price
+    } else {
+        return order.Price <= match.Price
+    }
+}
+
 func (order *Order) MarketName() string {
-    return order.Coin+"/"+order.BasisCoin
+    return MarketName(order.Coin, order.BasisCoin)
 }
 
 func (order *Order) Market() *Market {
@@ -84,20 +195,44 @@ func (order *Order) SortBidAsk(match *Order) (bid *Order, ask *Order) {
     }
 }
 
-func (order *Order) ComputeTradeAndFees(match *Order) (tradeAmount, tradeBasis, bidBasisFee, askBasisFee uint64) {
-    tradeAmount, tradeBasis = order.ComputeTrade(match)
-    bid, ask := order.SortBidAsk(match)
-    // compute basis_coin fee for bid
-    bidBasisFee = uint64(float64(bid.BasisFeeRatio) * float64(tradeBasis) + 0.5)
-    if bidBasisFee > (bid.BasisFee - bid.BasisFeeFilled) {
-        bidBasisFee = bid.BasisFee - bid.BasisFeeFilled
+// order is the taker & match is the maker.
+// The fee ratios are fixed here, from each user's fee tier at the time of the match.
+// Negative fees are maker rebates.
+func (order *Order) ComputeTradeAndFees(match *Order) (tradeAmount, tradeBasis uint64, bidBasisFee, askBasisFee int64) {
+    return order.ComputeTradeAndFeesAtPrice(match, match.Price)
+}
+
+// Same as ComputeTradeAndFees, but trading at price instead of match.Price, as auctions do.
+func (order *Order) ComputeTradeAndFeesAtPrice(match *Order, price uint64) (tradeAmount, tradeBasis uint64, bidBasisFee, askBasisFee int64) {
+    takerTier, _ := GetFeeTier(order.UserId, order.BasisCoin, order.Coin)
+    makerTier, _ := GetFeeTier(match.UserId, match.BasisCoin, match.Coin)
+    return order.ComputeTradeAndFeesForTiers(match, price, takerTier, makerTier)
+}
+
+func (order *Order) ComputeTradeAndFeesForTiers(match *Order, price uint64, takerTier, makerTier *FeeTier) (tradeAmount, tradeBasis uint64, bidBasisFee, askBasisFee int64) {
+    tradeAmount, tradeBasis = order.ComputeTradeAtPrice(match, price)
+    var bidFeeRatio, askFeeRatio float64
+    if order.Type == ORDER_TYPE_BID {
+        bidFeeRatio, askFeeRatio = takerTier.TakerRatio, makerTier.MakerRatio
+    } else {
+        bidFeeRatio, askFeeRatio = makerTier.MakerRatio, takerTier.TakerRatio
     }
-    // compute basis_coin fee for ask
-    askBasisFee = uint64(float64(ask.BasisFeeRatio) * float64(tradeBasis) + 0.5)
+    bid, _ := order.SortBidAsk(match)
+    // compute basis_coin fee for bid, which can't exceed what was reserved.
+    bidBasisFee = ComputeFee(tradeBasis, bidFeeRatio)
+    if bidBasisFee > (int64(bid.BasisFee) - bid.BasisFeeFilled) {
+        bidBasisFee = int64(bid.BasisFee) - bid.BasisFeeFilled
+    }
+    // compute basis_coin fee for ask, which comes out of the trade.
+    askBasisFee = ComputeFee(tradeBasis, askFeeRatio)
     return tradeAmount, tradeBasis, bidBasisFee, askBasisFee
 }
 
 func (order *Order) ComputeTrade(match *Order) (tradeAmount, tradeBasis uint64) {
+    return order.ComputeTradeAtPrice(match, match.Price)
+}
+
+func (order *Order) ComputeTradeAtPrice(match *Order, price uint64) (tradeAmount, tradeBasis uint64) {
     if order.Amount == 0 && order.BasisAmount == 0 { panic(NewError("Order has no limitation")) }
     if match.Amount == 0 && match.BasisAmount == 0 { panic(NewError("Match has no limitation")) }
 
@@ -113,8 +248,6 @@ func (order *Order) ComputeTrade(match *Order) (tradeAmount, tradeBasis uint64)
     */
     /* End section */
 
-    var price = match.Price
-
     var orderAmountRemaining uint64
     if order.Amount > 0 {       orderAmountRemaining = order.Amount - order.Filled
     } else {                    orderAmountRemaining = math.MaxUint64 }
@@ -124,6 +257,8 @@ func (order *Order) ComputeTrade(match *Order) (tradeAmount, tradeBasis uint64)
     var matchAmountRemaining uint64
     if match.Amount > 0 {       matchAmountRemaining = match.Amount - match.Filled
     } else {                    matchAmountRemaining = math.MaxUint64 }
+    // Resting icebergs trade one slice at a time.
+    if match.DisplayAmount > 0 { matchAmountRemaining = MinUint64(matchAmountRemaining, match.SliceRemaining()) }
     var matchBasisRemaining uint64
     if match.BasisAmount > 0 {  matchBasisRemaining = match.BasisAmount - match.BasisFilled
     } else {                    matchBasisRemaining = math.MaxUint64 }
@@ -132,13 +267,13 @@ func (order *Order) ComputeTrade(match *Order) (tradeAmount, tradeBasis uint64)
     var basisRemaining =  MinUint64(orderBasisRemaining,  matchBasisRemaining)
 
     if amountRemaining != math.MaxUint64 {
-        basisRemaining2 := uint64(float64(amountRemaining) * float64(price) + 0.5)
+        basisRemaining2 := BasisForAmount(amountRemaining, price)
         if basisRemaining == math.MaxUint64 {
             return amountRemaining, basisRemaining2
         } else if basisRemaining >= basisRemaining2 {
             return amountRemaining, basisRemaining2
         } else {
-            amountRemaining2 := uint64(float64(basisRemaining) / float64(price) + 0.5)
+            amountRemaining2 := AmountForBasis(basisRemaining, price)
             if amountRemaining2 > amountRemaining {
                 // Not sure if this happens or not. Probably possible. :P
                 return amountRemaining, basisRemaining
@@ -147,11 +282,19 @@ func (order *Order) ComputeTrade(match *Order) (tradeAmount, tradeBasis uint64)
             }
         }
     } else {
-        amountRemaining2 := uint64(float64(basisRemaining) / float64(price) + 0.5)
+        amountRemaining2 := AmountForBasis(basisRemaining, price)
         return amountRemaining2, basisRemaining
     }
 }
 
+// Whether trading tradeAmount & tradeBasis would complete this order.
+func (order *Order) WouldComplete(tradeAmount, tradeBasis uint64) bool {
+    sim := *order
+    sim.Filled += tradeAmount
+    sim.BasisFilled += tradeBasis
+    return sim.Complete()
+}
+
 func (order *Order) Complete() bool {
     if order.Amount > 0 && order.Amount == order.Filled {
         return true
@@ -162,8 +305,28 @@ func (order *Order) Complete() bool {
     return false
 }
 
+// What the order reserves while pending, in ReserveCoin():
+// bids pay with the basis coin, fees included, asks with the coin.
+func (order *Order) Reserve() uint64 {
+    if order.Type == ORDER_TYPE_BID { return order.BasisAmount + order.BasisFee }
+    return order.Amount
+}
+
+// What the order could still spend out of its reserve, fees included.
+func (order *Order) RemainingReserve() int64 {
+    if order.Type == ORDER_TYPE_BID {
+        return int64(order.BasisAmount - order.BasisFilled) + (int64(order.BasisFee) - order.BasisFeeFilled)
+    }
+    return int64(order.Amount - order.Filled)
+}
+
+func (order *Order) ReserveCoin() string {
+    if order.Type == ORDER_TYPE_BID { return order.BasisCoin }
+    return order.Coin
+}
+
 // The least item is the one closest to the last price.
-// TODO: account for float64, we shouldn't be comparing by equality. 
+// Within a price level, the order with the earliest Priority goes first.
 func (order *Order) Less(than llrb.Item) bool {
     other, ok := than.(*Order)
     if !ok { panic("Cannot compare order with something else ") }
@@ -174,11 +337,11 @@ func (order *Order) Less(than llrb.Item) bool {
     if order.Type != other.Type { panic("Cannot compare bid & ask") }
     if order.Type == ORDER_TYPE_BID {
         if order.Price > other.Price { return true }
-        if order.Price == other.Price { return order.Id < other.Id }
+        if order.Price == other.Price { return order.Priority < other.Priority }
         return false
     } else {
         if order.Price < other.Price { return true }
-        if order.Price == other.Price { return order.Id < other.Id }
+        if order.Price == other.Price { return order.Priority < other.Priority }
         return false
     }
 }
@@ -200,6 +363,24 @@ func LoadOrder(id int64) (*Order) {
     }
 }
 
+// Returns nil if the user has no such order.
+func LoadOrderByClientId(userId int64, clientId string) (*Order) {
+    var order Order
+    err := db.QueryRow(
+        `SELECT `+OrderModel.FieldsSimple+`
+         FROM exchange_order
+         WHERE user_id=? AND client_id=?`, userId, clientId,
+    ).Scan(&order)
+    switch db.GetErrorType(err) {
+    case sql.ErrNoRows:
+        return nil
+    case nil:
+        return &order
+    default:
+        panic(err)
+    }
+}
+
 func SaveOrder(tx *db.ModelTx, order *Order) (*Order) {
     if order.Time == 0 { order.Time = time.Now().Unix() }
     err := tx.QueryRow(
@@ -209,6 +390,13 @@ func SaveOrder(tx *db.ModelTx, order *Order) (*Order) {
         order,
     ).Scan(&order.Id)
     if err != nil { panic(err) }
+    // New orders go to the back of their price level.
+    order.Priority = order.Id
+    _, err = tx.Exec(
+        `UPDATE exchange_order SET priority=? WHERE id=?`,
+        order.Priority, order.Id,
+    )
+    if err != nil { panic(err) }
     return order
 }
 
@@ -216,11 +404,70 @@ func UpdateOrder(tx *db.ModelTx, order *Order) {
     order.Updated = time.Now().Unix()
     _, err := tx.Exec(
         `UPDATE exchange_order
-         SET status=?, filled=?, basis_filled=?, updated=?
+         SET status=?, filled=?, basis_filled=?, basis_fee_filled=?, updated=?
+         WHERE id=?`,
+        order.Status, order.Filled, order.BasisFilled, order.BasisFeeFilled, order.Updated, order.Id,
+    )
+    if err != nil { panic(err) }
+    journalOrder(tx, JOURNAL_UPDATE, order)
+}
+
+// Orders get shrunk by self trade prevention, & grouped ones as siblings trade.
+func UpdateOrderAmounts(tx *db.ModelTx, order *Order) {
+    order.Updated = time.Now().Unix()
+    _, err := tx.Exec(
+        `UPDATE exchange_order
+         SET amount=?, basis_amount=?, basis_fee=?, updated=?
+         WHERE id=?`,
+        order.Amount, order.BasisAmount, order.BasisFee, order.Updated, order.Id,
+    )
+    if err != nil { panic(err) }
+    journalOrder(tx, JOURNAL_UPDATE, order)
+}
+
+// Orders get amended in place, see amend.go.
+func UpdateOrderAmendment(tx *db.ModelTx, order *Order) {
+    order.Updated = time.Now().Unix()
+    _, err := tx.Exec(
+        `UPDATE exchange_order
+         SET price=?, amount=?, basis_amount=?, basis_fee=?, updated=?
          WHERE id=?`,
-        order.Status, order.Filled, order.BasisFilled, order.Updated, order.Id,
+        order.Price, order.Amount, order.BasisAmount, order.BasisFee, order.Updated, order.Id,
     )
     if err != nil { panic(err) }
+    journalOrder(tx, JOURNAL_UPDATE, order)
+}
+
+// Stop orders get converted when triggered.
+func UpdateOrderKind(tx *db.ModelTx, order *Order) {
+    order.Updated = time.Now().Unix()
+    _, err := tx.Exec(
+        `UPDATE exchange_order
+         SET kind=?, updated=?
+         WHERE id=?`,
+        order.Kind, order.Updated, order.Id,
+    )
+    if err != nil { panic(err) }
+    journalOrder(tx, JOURNAL_UPDATE, order)
+}
+
+// Sends an iceberg to the back of its price level, as if it were a new order.
+// Priorities come from the order id sequence, so they compare with those of new orders.
+// Returns the new priority, which the caller sets on the order.
+func RefreshOrderPriority(tx *db.ModelTx, order *Order) int64 {
+    var priority int64
+    err := tx.QueryRow(
+        `UPDATE exchange_order
+         SET priority=nextval('exchange_order_id_seq')
+         WHERE id=?
+         RETURNING priority`,
+        order.Id,
+    ).Scan(&priority)
+    if err != nil { panic(err) }
+    refreshed := *order
+    refreshed.Priority = priority
+    journalOrder(tx, JOURNAL_UPDATE, &refreshed)
+    return priority
 }
 
 // Gets the last executed order id, or 0 if none.
@@ -242,19 +489,20 @@ func LastCompletedOrderId(basisCoin string, coin string) int64 {
     }
 }
 
-// Loads bid orders less than or equal to maxPrice,
-//  but id greater than minId if price is maxPrice.
+// Loads bid orders less than maxPrice,
+//  or equal to maxPrice with priority greater than minPriority.
 // This way you can either set maxPrice to MaxUint64 (or MaxInt64 for postgres)
-//  or set maxPrice & minId to the last bid loaded to load more.
+//  or set maxPrice & minPriority to the last bid loaded to load more.
 // Also, order ids must be less than or equal to maxId.
 // (Orders with ids greater than maxId may not be limit orders & may need to get reprocessed.)
-func LoadLimitBids(basisCoin string, coin string, limit int, maxPrice float64, minId int64, maxId int64) (bids []*Order, hasMore bool) {
+func LoadLimitBids(basisCoin string, coin string, limit int, maxPrice uint64, minPriority int64, maxId int64) (bids []*Order, hasMore bool) {
     rows, err := db.QueryAll(Order{},
         `SELECT `+OrderModel.FieldsSimple+`
          FROM exchange_order
-         WHERE basis_coin=? AND coin=? AND type='B' AND status=0 AND (price, id) < (?, ?) AND id<=?
-         ORDER BY price DESC, id ASC LIMIT ?`,
-        basisCoin, coin, maxPrice, int64(-1) * minId, maxId, limit+1,
+         WHERE basis_coin=? AND coin=? AND type='B' AND kind='L' AND status=0
+           AND (price<? OR (price=? AND priority>?)) AND id<=?
+         ORDER BY price DESC, priority ASC LIMIT ?`,
+        basisCoin, coin, maxPrice, maxPrice, minPriority, maxId, limit+1,
     )
     if err != nil { panic(err) }
     bids = rows.([]*Order)
@@ -267,13 +515,14 @@ func LoadLimitBids(basisCoin string, coin string, limit int, maxPrice float64, m
 
 // See comment for LoadLimitBids.
 // To load the best asks, set minPrice to 0.
-func LoadLimitAsks(basisCoin string, coin string, limit int, minPrice float64, minId int64, maxId int64) (asks []*Order, hasMore bool) {
+func LoadLimitAsks(basisCoin string, coin string, limit int, minPrice uint64, minPriority int64, maxId int64) (asks []*Order, hasMore bool) {
     rows, err := db.QueryAll(Order{},
         `SELECT `+OrderModel.FieldsSimple+`
          FROM exchange_order
-         WHERE basis_coin=? AND coin=? AND type='A' AND status=0 AND (price, id) > (?, ?) AND id<=?
-         ORDER BY price ASC, id ASC LIMIT ?`,
-        basisCoin, coin, minPrice, minId, maxId, limit+1,
+         WHERE basis_coin=? AND coin=? AND type='A' AND kind='L' AND status=0
+           AND (price>? OR (price=? AND priority>?)) AND id<=?
+         ORDER BY price ASC, priority ASC LIMIT ?`,
+        basisCoin, coin, minPrice, minPrice, minPriority, maxId, limit+1,
     )
     if err != nil { panic(err) }
     asks = rows.([]*Order)
@@ -299,6 +548,35 @@ func LoadPendingOrdersSince(basisCoin string, coin string, startOrderId int64) [
     return rows.([]*Order)
 }
 
+// Stop orders that haven't been triggered yet.
+func LoadPendingStopOrders(basisCoin string, coin string) []*Order {
+    rows, err := db.QueryAll(Order{},
+        `SELECT `+OrderModel.FieldsSimple+`
+         FROM exchange_order
+         WHERE basis_coin=? AND coin=? AND kind IN ('S', 'T') AND status=0
+         ORDER BY id ASC`,
+        basisCoin, coin,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Order)
+}
+
+// Pending good till time orders of the market that expired at or before now,
+// after (afterTime, afterId) in (expire_time, id) order, so that you can page through them.
+func LoadExpiredOrders(basisCoin string, coin string, now int64, afterTime int64, afterId int64, limit int) []*Order {
+    rows, err := db.QueryAll(Order{},
+        `SELECT `+OrderModel.FieldsSimple+`
+         FROM exchange_order
+         WHERE status=0 AND time_in_force='T' AND expire_time<=?
+           AND basis_coin=? AND coin=?
+           AND (expire_time>? OR (expire_time=? AND id>?))
+         ORDER BY expire_time ASC, id ASC LIMIT ?`,
+        now, basisCoin, coin, afterTime, afterTime, afterId, limit,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Order)
+}
+
 func LoadPendingOrdersByUser(userId int64, basisCoin string, coin string) (orders []*Order) {
     rows, err := db.QueryAll(Order{},
         `SELECT `+OrderModel.FieldsSimple+`
@@ -311,26 +589,188 @@ func LoadPendingOrdersByUser(userId int64, basisCoin string, coin string) (order
     return rows.([]*Order)
 }
 
+// Order Group
+// Orders of one user that trade & get canceled together, see groups.go.
+
+type OrderGroup struct {
+    Id          int64   `json:"id"              db:"id,autoinc"`
+    Kind        string  `json:"kind"            db:"kind"`
+    UserId      int64   `json:"userId"          db:"user_id"`
+    Coin        string  `json:"coin"            db:"coin"`
+    BasisCoin   string  `json:"basisCoin"       db:"basis_coin"`
+    Status      uint32  `json:"status"          db:"status"`     // ORDER_STATUS_*, from the first member to finish
+    Reserved    int64   `json:"reserved"        db:"reserved"`   // held for all members, see syncGroupReserve()
+    Time        int64   `json:"time"            db:"time"`
+    Updated     int64   `json:"updated"         db:"updated"`
+}
+
+var OrderGroupModel = db.GetModelInfo(new(OrderGroup))
+
+const (
+    ORDER_GROUP_OCO     = "O" // One cancels other
+    ORDER_GROUP_BRACKET = "B" // A take-profit & a stop-loss, one cancels other
+)
+
+func SaveOrderGroup(tx *db.ModelTx, group *OrderGroup) (*OrderGroup) {
+    if group.Time == 0 { group.Time = time.Now().Unix() }
+    err := tx.QueryRow(
+        `INSERT INTO exchange_order_group (`+OrderGroupModel.FieldsInsert+`)
+         VALUES (`+OrderGroupModel.Placeholders+`)
+         RETURNING id`,
+        group,
+    ).Scan(&group.Id)
+    if err != nil { panic(err) }
+    return group
+}
+
+// Only the first member to finish sets the status.
+func UpdateOrderGroupStatus(tx *db.ModelTx, groupId int64, status uint32) {
+    _, err := tx.Exec(
+        `UPDATE exchange_order_group
+         SET status=?, updated=?
+         WHERE id=? AND status=0`,
+        status, time.Now().Unix(), groupId,
+    )
+    if err != nil { panic(err) }
+}
+
+func LoadOrderGroup(tx *db.ModelTx, id int64) *OrderGroup {
+    var group OrderGroup
+    err := tx.QueryRow(
+        `SELECT `+OrderGroupModel.FieldsSimple+`
+         FROM exchange_order_group
+         WHERE id=?`, id,
+    ).Scan(&group)
+    if err != nil { panic(err) }
+    return &group
+}
+
+func UpdateOrderGroupReserved(tx *db.ModelTx, group *OrderGroup) {
+    _, err := tx.Exec(
+        `UPDATE exchange_order_group
+         SET reserved=?
+         WHERE id=?`,
+        group.Reserved, group.Id,
+    )
+    if err != nil { panic(err) }
+}
+
+func LoadPendingOrderGroupsByUser(userId int64, basisCoin string, coin string) []*OrderGroup {
+    rows, err := db.QueryAll(OrderGroup{},
+        `SELECT `+OrderGroupModel.FieldsSimple+`
+         FROM exchange_order_group
+         WHERE status=0 AND user_id=? AND basis_coin=? AND coin=?
+         ORDER BY id ASC`,
+        userId, basisCoin, coin,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*OrderGroup)
+}
+
+// The other pending members of order's group, as of tx.
+func LoadPendingSiblings(tx *db.ModelTx, order *Order) []*Order {
+    rows, err := tx.QueryAll(Order{},
+        `SELECT `+OrderModel.FieldsSimple+`
+         FROM exchange_order
+         WHERE group_id=? AND id<>? AND status=0
+         ORDER BY id ASC`,
+        order.GroupId, order.Id,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Order)
+}
+
+// All pending members of the group, as of tx.
+func LoadPendingGroupMembers(tx *db.ModelTx, groupId int64) []*Order {
+    rows, err := tx.QueryAll(Order{},
+        `SELECT `+OrderModel.FieldsSimple+`
+         FROM exchange_order
+         WHERE group_id=? AND status=0
+         ORDER BY id ASC`,
+        groupId,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Order)
+}
+
 // Trade
 
 type Trade struct {
     Id          int64   `json:"id"              db:"id,autoinc"`
     BidUserId   int64   `json:"bidUserId"       db:"bid_user_id"`
     BidOrderId  int64   `json:"bidOrderId"      db:"bid_order_id"`
-    BidBasisFee uint64  `json:"bidBasisFee"     db:"bid_basis_fee"`
+    BidBasisFee int64   `json:"bidBasisFee"     db:"bid_basis_fee"`
     AskUserId   int64   `json:"askUserId"       db:"ask_user_id"`
     AskOrderId  int64   `json:"askOrderId"      db:"ask_order_id"`
-    AskBasisFee uint64  `json:"askBasisFee"     db:"ask_basis_fee"`
+    AskBasisFee int64   `json:"askBasisFee"     db:"ask_basis_fee"`
     Coin        string  `json:"coin"            db:"coin"`
     BasisCoin   string  `json:"basisCoin"       db:"basis_coin"`
     TradeAmount uint64  `json:"tradeAmount"     db:"trade_amount"`
     TradeBasis  uint64  `json:"tradeBasis"      db:"trade_basis"`
-    Price       float64 `json:"price"           db:"price"`
+    Price       uint64  `json:"price"           db:"price"`
+    TakerType   string  `json:"takerType"       db:"taker_type"` // the type of the order that took liquidity
     Time        int64   `json:"time"            db:"time"`
 }
 
 var TradeModel = db.GetModelInfo(new(Trade))
 
+const (
+    TRADE_LIQUIDITY_MAKER = "M"
+    TRADE_LIQUIDITY_TAKER = "T"
+)
+
+// A trade from one user's point of view, for their history.
+type UserTrade struct {
+    Id          int64   `json:"id"`
+    OrderId     int64   `json:"orderId"`
+    Type        string  `json:"type"`       // the user's side, ORDER_TYPE_*
+    Liquidity   string  `json:"liquidity"`  // TRADE_LIQUIDITY_*
+    Coin        string  `json:"coin"`
+    BasisCoin   string  `json:"basisCoin"`
+    Amount      uint64  `json:"amount"`
+    BasisAmount uint64  `json:"basisAmount"`
+    BasisFee    int64   `json:"basisFee"`   // negative for rebates
+    Price       uint64  `json:"price"`
+    Time        int64   `json:"time"`
+}
+
+// For public trade lists & the trades feed.
+func (trade *Trade) Anonymize() *STrade {
+    return &STrade{
+        Id:         trade.Id,
+        Type:       trade.TakerType,
+        Amount:     trade.TradeAmount,
+        Basis:      trade.TradeBasis,
+        Price:      trade.Price,
+        Time:       trade.Time,
+    }
+}
+
+func (trade *Trade) ForUser(userId int64) *UserTrade {
+    userTrade := &UserTrade{
+        Id:             trade.Id,
+        Coin:           trade.Coin,
+        BasisCoin:      trade.BasisCoin,
+        Amount:         trade.TradeAmount,
+        BasisAmount:    trade.TradeBasis,
+        Price:          trade.Price,
+        Time:           trade.Time,
+    }
+    if trade.BidUserId == userId {
+        userTrade.OrderId, userTrade.Type, userTrade.BasisFee = trade.BidOrderId, ORDER_TYPE_BID, trade.BidBasisFee
+    } else if trade.AskUserId == userId {
+        userTrade.OrderId, userTrade.Type, userTrade.BasisFee = trade.AskOrderId, ORDER_TYPE_ASK, trade.AskBasisFee
+    } else {
+        panic(NewError("User %v isn't in trade %v", userId, trade.Id))
+    }
+    if userTrade.Type == trade.TakerType {
+        userTrade.Liquidity = TRADE_LIQUIDITY_TAKER
+    } else {
+        userTrade.Liquidity = TRADE_LIQUIDITY_MAKER
+    }
+    return userTrade
+}
+
 func SaveTrade(tx *db.ModelTx, trade *Trade) (*Trade) {
     if trade.Time == 0 { trade.Time = time.Now().Unix() }
     err := tx.QueryRow(
@@ -340,6 +780,7 @@ func SaveTrade(tx *db.ModelTx, trade *Trade) (*Trade) {
         trade,
     ).Scan(&trade.Id)
     if err != nil { panic(err) }
+    journalTrade(tx, trade)
     return trade
 }
 
@@ -355,18 +796,315 @@ func LoadTradesByUser(userId int64, limit uint) []*Trade {
     return rows.([]*Trade)
 }
 
+// A page of the user's trades, newest first.
+// beforeId:   the cursor, only trades with a smaller id are returned. 0 for the first page.
+// basisCoin, coin: the market, or "" for all markets.
+// start, end: time range, inclusive. end 0 means no limit.
+func LoadTradeHistory(userId int64, basisCoin string, coin string, start int64, end int64, beforeId int64, limit uint) []*Trade {
+    if beforeId == 0 { beforeId = math.MaxInt64 }
+    if end == 0 { end = math.MaxInt64 }
+    rows, err := db.QueryAll(Trade{},
+        `SELECT `+TradeModel.FieldsSimple+`
+         FROM exchange_trade
+         WHERE (bid_user_id=? OR ask_user_id=?) AND id<?
+           AND (?='' OR (basis_coin=? AND coin=?))
+           AND time>=? AND time<=?
+         ORDER BY id DESC LIMIT ?`,
+        userId, userId, beforeId,
+        coin, basisCoin, coin,
+        start, end, limit,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Trade)
+}
+
+// Trades in a market since startTime, oldest first.
+func LoadTradesSince(basisCoin string, coin string, startTime int64) []*Trade {
+    rows, err := db.QueryAll(Trade{},
+        `SELECT `+TradeModel.FieldsSimple+`
+         FROM exchange_trade
+         WHERE basis_coin=? AND coin=? AND time>=?
+         ORDER BY id ASC`,
+        basisCoin, coin, startTime,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Trade)
+}
+
+// Trades with ids greater than afterId, in id order.
+func LoadTradesAfterId(basisCoin string, coin string, afterId int64, limit uint) []*Trade {
+    rows, err := db.QueryAll(Trade{},
+        `SELECT `+TradeModel.FieldsSimple+`
+         FROM exchange_trade
+         WHERE basis_coin=? AND coin=? AND id>?
+         ORDER BY id ASC LIMIT ?`,
+        basisCoin, coin, afterId, limit,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Trade)
+}
+
+// The latest trades in a market, newest first.
+func LoadRecentTrades(basisCoin string, coin string, limit uint) []*Trade {
+    rows, err := db.QueryAll(Trade{},
+        `SELECT `+TradeModel.FieldsSimple+`
+         FROM exchange_trade
+         WHERE basis_coin=? AND coin=?
+         ORDER BY id DESC LIMIT ?`,
+        basisCoin, coin, limit,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Trade)
+}
+
+// Fee Revenue
+// Fees collected from trades, per basis coin.
+
+type FeeRevenue struct {
+    BasisCoin   string  `json:"basisCoin"       db:"basis_coin"`
+    Fees        int64   `json:"fees"            db:"fees"`
+    Rebates     int64   `json:"rebates"         db:"rebates"` // negative
+    NumTrades   int64   `json:"numTrades"       db:"num_trades"`
+}
+
+// Fee revenue from trades where startTime <= time < endTime.
+// Set basisCoin to "" for all basis coins.
+func LoadFeeRevenue(basisCoin string, startTime int64, endTime int64) []*FeeRevenue {
+    rows, err := db.QueryAll(FeeRevenue{},
+        `SELECT basis_coin,
+            SUM(GREATEST(bid_basis_fee, 0) + GREATEST(ask_basis_fee, 0))::BIGINT AS fees,
+            SUM(LEAST(bid_basis_fee, 0) + LEAST(ask_basis_fee, 0))::BIGINT AS rebates,
+            COUNT(*) AS num_trades
+         FROM exchange_trade
+         WHERE (?='' OR basis_coin=?) AND ?<=time AND time<?
+         GROUP BY basis_coin
+         ORDER BY basis_coin ASC`,
+        basisCoin, basisCoin, startTime, endTime,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*FeeRevenue)
+}
+
+// Self Trade
+// A record of each time self trade prevention stopped an order from
+// matching another order from the same user.
+
+type SelfTrade struct {
+    Id              int64   `json:"id"              db:"id,autoinc"`
+    UserId          int64   `json:"userId"          db:"user_id"`
+    OrderId         int64   `json:"orderId"         db:"order_id"`
+    MatchId         int64   `json:"matchId"         db:"match_id"`
+    Policy          string  `json:"policy"          db:"policy"`
+    OrderCanceled   bool    `json:"orderCanceled"   db:"order_canceled"`
+    MatchCanceled   bool    `json:"matchCanceled"   db:"match_canceled"`
+    Amount          uint64  `json:"amount"          db:"amount"`
+    BasisAmount     uint64  `json:"basisAmount"     db:"basis_amount"`
+    Time            int64   `json:"time"            db:"time"`
+}
+
+var SelfTradeModel = db.GetModelInfo(new(SelfTrade))
+
+func SaveSelfTrade(tx *db.ModelTx, selfTrade *SelfTrade) (*SelfTrade) {
+    if selfTrade.Time == 0 { selfTrade.Time = time.Now().Unix() }
+    err := tx.QueryRow(
+        `INSERT INTO exchange_self_trade (`+SelfTradeModel.FieldsInsert+`)
+         VALUES (`+SelfTradeModel.Placeholders+`)
+         RETURNING id`,
+        selfTrade,
+    ).Scan(&selfTrade.Id)
+    if err != nil { panic(err) }
+    return selfTrade
+}
+
+func LoadSelfTradesByUser(userId int64, limit uint) []*SelfTrade {
+    rows, err := db.QueryAll(SelfTrade{},
+        `SELECT `+SelfTradeModel.FieldsSimple+`
+         FROM exchange_self_trade
+         WHERE user_id=?
+         ORDER BY time DESC LIMIT ?`,
+        userId, limit,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*SelfTrade)
+}
+
+// Heartbeat
+// Cancel on disconnect for an API key, see heartbeat.go.
+
+type Heartbeat struct {
+    APIKey          string  `json:"-"               db:"api_key"`
+    UserId          int64   `json:"userId"          db:"user_id"`
+    Timeout         int64   `json:"timeout"         db:"timeout"`  // seconds
+    Deadline        int64   `json:"deadline"        db:"deadline"`
+}
+
+var HeartbeatModel = db.GetModelInfo(new(Heartbeat))
+
+func SaveOrUpdateHeartbeat(tx *db.ModelTx, heartbeat *Heartbeat) {
+    res, err := tx.Exec(
+        `UPDATE exchange_heartbeat
+         SET user_id=?, timeout=?, deadline=?
+         WHERE api_key=?`,
+        heartbeat.UserId, heartbeat.Timeout, heartbeat.Deadline, heartbeat.APIKey,
+    )
+    if err != nil { panic(err) }
+    count, err := res.RowsAffected()
+    if err != nil { panic(err) }
+    if count > 0 { return }
+    _, err = tx.Exec(
+        `INSERT INTO exchange_heartbeat (`+HeartbeatModel.FieldsInsert+`)
+         VALUES (`+HeartbeatModel.Placeholders+`)`,
+        heartbeat,
+    )
+    if err != nil { panic(err) }
+}
+
+func DeleteHeartbeat(tx *db.ModelTx, apiKey string) {
+    _, err := tx.Exec(
+        `DELETE FROM exchange_heartbeat WHERE api_key=?`,
+        apiKey,
+    )
+    if err != nil { panic(err) }
+}
+
+// Deletes the heartbeat if its deadline passed as of now.
+// Returns false if it was renewed or deleted in the meantime.
+func DeleteExpiredHeartbeat(tx *db.ModelTx, apiKey string, now int64) bool {
+    res, err := tx.Exec(
+        `DELETE FROM exchange_heartbeat WHERE api_key=? AND deadline<=?`,
+        apiKey, now,
+    )
+    if err != nil { panic(err) }
+    count, err := res.RowsAffected()
+    if err != nil { panic(err) }
+    return count > 0
+}
+
+func LoadExpiredHeartbeats(now int64) []*Heartbeat {
+    rows, err := db.QueryAll(Heartbeat{},
+        `SELECT `+HeartbeatModel.FieldsSimple+`
+         FROM exchange_heartbeat
+         WHERE deadline<=?
+         ORDER BY deadline ASC`,
+        now,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*Heartbeat)
+}
+
+// Auto Cancel
+// A record of each time a missed heartbeat canceled a user's orders.
+
+type AutoCancel struct {
+    Id              int64   `json:"id"              db:"id,autoinc"`
+    UserId          int64   `json:"userId"          db:"user_id"`
+    APIKey          string  `json:"apiKey"          db:"api_key"`
+    Deadline        int64   `json:"deadline"        db:"deadline"`     // of the heartbeat that was missed
+    Canceled        int64   `json:"canceled"        db:"canceled"`     // orders queued for cancellation
+    Halted          int64   `json:"halted"          db:"halted"`       // of those canceled, the ones in halted markets
+    Time            int64   `json:"time"            db:"time"`
+}
+
+var AutoCancelModel = db.GetModelInfo(new(AutoCancel))
+
+func SaveAutoCancel(tx *db.ModelTx, autoCancel *AutoCancel) (*AutoCancel) {
+    if autoCancel.Time == 0 { autoCancel.Time = time.Now().Unix() }
+    err := tx.QueryRow(
+        `INSERT INTO exchange_auto_cancel (`+AutoCancelModel.FieldsInsert+`)
+         VALUES (`+AutoCancelModel.Placeholders+`)
+         RETURNING id`,
+        autoCancel,
+    ).Scan(&autoCancel.Id)
+    if err != nil { panic(err) }
+    return autoCancel
+}
+
+func LoadAutoCancelsByUser(userId int64, limit uint) []*AutoCancel {
+    rows, err := db.QueryAll(AutoCancel{},
+        `SELECT `+AutoCancelModel.FieldsSimple+`
+         FROM exchange_auto_cancel
+         WHERE user_id=?
+         ORDER BY time DESC LIMIT ?`,
+        userId, limit,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*AutoCancel)
+}
+
+// Journal
+// The matching journal, see journal.go.
+
+type JournalEntry struct {
+    Seq             int64   `json:"seq"             db:"seq,autoinc"`
+    Market          string  `json:"market"          db:"market"`
+    Kind            string  `json:"kind"            db:"kind"`         // see JOURNAL_*
+    RefId           int64   `json:"refId"           db:"ref_id"`       // the order's id, or the trade's
+    Priority        int64   `json:"priority"        db:"priority"`     // the order's, which its JSON leaves out
+    Data            string  `json:"data"            db:"data"`         // the order, trade or amendment as JSON
+    Time            int64   `json:"time"            db:"time"`
+}
+
+var JournalEntryModel = db.GetModelInfo(new(JournalEntry))
+
+func SaveJournalEntry(tx *db.ModelTx, entry *JournalEntry) (*JournalEntry) {
+    if entry.Time == 0 { entry.Time = time.Now().Unix() }
+    err := tx.QueryRow(
+        `INSERT INTO exchange_journal (`+JournalEntryModel.FieldsInsert+`)
+         VALUES (`+JournalEntryModel.Placeholders+`)
+         RETURNING seq`,
+        entry,
+    ).Scan(&entry.Seq)
+    if err != nil { panic(err) }
+    return entry
+}
+
+// Entries of market after afterSeq, in Seq order.
+func LoadJournalEntries(market string, afterSeq int64, limit uint) []*JournalEntry {
+    rows, err := db.QueryAll(JournalEntry{},
+        `SELECT `+JournalEntryModel.FieldsSimple+`
+         FROM exchange_journal
+         WHERE market=? AND seq>?
+         ORDER BY seq ASC LIMIT ?`,
+        market, afterSeq, limit,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*JournalEntry)
+}
+
+// The market's latest snapshot, see snapshotJournal().
+// Returns nil if market has none yet.
+func LoadLastJournalStart(market string) *JournalEntry {
+    var entry JournalEntry
+    err := db.QueryRow(
+        `SELECT `+JournalEntryModel.FieldsSimple+`
+         FROM exchange_journal
+         WHERE market=? AND kind='S'
+         ORDER BY seq DESC LIMIT 1`,
+        market,
+    ).Scan(&entry)
+    switch db.GetErrorType(err) {
+    case sql.ErrNoRows:
+        return nil
+    case nil:
+        return &entry
+    default:
+        panic(err)
+    }
+}
+
 // Price Log
 
 type PriceLog struct {
     Id          int64       `json:"-"           db:"id,autoinc"`
     Market      string      `json:"-"           db:"market"`
-    Low         float64     `json:"l"           db:"low"`
-    High        float64     `json:"h"           db:"high"`
-    Open        float64     `json:"o"           db:"open"`
-    Close       float64     `json:"c"           db:"close"`
-    Interval    int64       `json:"-"           db:"interval"`
+    Low         uint64      `json:"l"           db:"low"`
+    High        uint64      `json:"h"           db:"high"`
+    Open        uint64      `json:"o"           db:"open"`
+    Close       uint64      `json:"c"           db:"close"`
+    Interval    int64       `json:"i"           db:"interval"`
     AskVolume   uint64      `json:"a"           db:"ask_volume"`
     BidVolume   uint64      `json:"b"           db:"bid_volume"`
+    BasisVolume uint64      `json:"bv"          db:"basis_volume"`
     Time        int64       `json:"t"           db:"time"`
     Timestamp   time.Time   `json:"-"           db:"timestamp"`
 }
@@ -404,9 +1142,9 @@ func SavePriceLog(tx *db.ModelTx, plog *PriceLog) (*PriceLog) {
 func UpdatePriceLog(tx *db.ModelTx, plog *PriceLog) {
     _, err := tx.Exec(
         `UPDATE exchange_price_log
-         SET low=?, high=?, close=?, ask_volume=?, bid_volume=?
+         SET low=?, high=?, close=?, ask_volume=?, bid_volume=?, basis_volume=?
          WHERE market=? AND interval=? AND time=?`,
-        plog.Low, plog.High, plog.Close, plog.AskVolume, plog.BidVolume,
+        plog.Low, plog.High, plog.Close, plog.AskVolume, plog.BidVolume, plog.BasisVolume,
         plog.Market, plog.Interval, plog.Time,
     )
     if err != nil { panic(err) }
@@ -424,6 +1162,47 @@ func LoadPriceLogs(market string, interval int64, startTime int64, endTime int64
     return rows.([]*PriceLog)
 }
 
+// Returns nil if none.
+func LoadLastPriceLog(market string, interval int64) *PriceLog {
+    plogs := LoadLastPriceLogs(market, interval, 1)
+    if len(plogs) == 0 { return nil }
+    return plogs[0]
+}
+
+// Derives entries of interval from the basis entries since startTime.
+// They aren't saved, and have no Id.
+func LoadRolledUpPriceLogs(market string, basisInterval int64, interval int64, startTime int64) []*PriceLog {
+    rows, err := db.QueryAll(PriceLog{},
+        `SELECT 0, market, MIN(low), MAX(high),
+                (array_agg(open ORDER BY time ASC))[1], (array_agg(close ORDER BY time DESC))[1],
+                ?::BIGINT, SUM(ask_volume)::BIGINT, SUM(bid_volume)::BIGINT, SUM(basis_volume)::BIGINT,
+                rollup_time, to_timestamp(rollup_time)
+         FROM (SELECT *, time / ? * ? AS rollup_time
+               FROM exchange_price_log
+               WHERE market=? AND interval=? AND time>=?) AS basis
+         GROUP BY market, rollup_time
+         ORDER BY rollup_time ASC`,
+        interval, interval, interval,
+        market, basisInterval, startTime,
+    )
+    if err != nil { panic(err) }
+    return rows.([]*PriceLog)
+}
+
+// Deletes entries of interval that ended before the given time.
+// Returns the number of entries deleted.
+func DeletePriceLogsBefore(market string, interval int64, before int64) int64 {
+    res, err := db.Exec(
+        `DELETE FROM exchange_price_log
+         WHERE market=? AND interval=? AND time+interval<=?`,
+        market, interval, before,
+    )
+    if err != nil { panic(err) }
+    count, err := res.RowsAffected()
+    if err != nil { panic(err) }
+    return count
+}
+
 func LoadLastPriceLogs(market string, interval int64, limit int) []*PriceLog {
     rows, err := db.QueryAll(PriceLog{},
         `SELECT `+PriceLogModel.FieldsSimple+`
@@ -2,6 +2,8 @@ package exchange
 
 import (
     . "ftnox.com/common"
+    . "ftnox.com/config"
+    "math/rand"
     "testing"
 )
 
@@ -20,33 +22,132 @@ func TestComputeTrade(t *testing.T) {
         &Order{ // Limit Order
             Type:   "B",
             BasisAmount: 90,
-            Price:  1.0,
+            Price:  USATOSHI,
         }, 90, 90,
     )
 
-                                                                                                 //  Coin,  Basis
-    testTrade(&Order{Type:"B", BasisAmount:100,},   &Order{Type:"A", Amount:200,        Price:1.0},   100,    100)
-    testTrade(&Order{Type:"B", BasisAmount:100,},   &Order{Type:"A", Amount:50,         Price:1.0},    50,     50)
-    testTrade(&Order{Type:"B", BasisAmount:100,},   &Order{Type:"A", Amount:50,         Price:0.5},    50,     25)
+                                                                                                        //  Coin,  Basis
+    testTrade(&Order{Type:"B", BasisAmount:100,},   &Order{Type:"A", Amount:200,        Price:USATOSHI},     100,    100)
+    testTrade(&Order{Type:"B", BasisAmount:100,},   &Order{Type:"A", Amount:50,         Price:USATOSHI},      50,     50)
+    testTrade(&Order{Type:"B", BasisAmount:100,},   &Order{Type:"A", Amount:50,         Price:USATOSHI/2},    50,     25)
 
-    testTrade(&Order{Type:"A", Amount:100,},        &Order{Type:"B", BasisAmount:200,   Price:1.0},   100,    100)
-    testTrade(&Order{Type:"A", Amount:100,},        &Order{Type:"B", BasisAmount:50,    Price:1.0},    50,     50)
-    testTrade(&Order{Type:"A", Amount:100,},        &Order{Type:"B", BasisAmount:50,    Price:0.5},   100,     50)
+    testTrade(&Order{Type:"A", Amount:100,},        &Order{Type:"B", BasisAmount:200,   Price:USATOSHI},     100,    100)
+    testTrade(&Order{Type:"A", Amount:100,},        &Order{Type:"B", BasisAmount:50,    Price:USATOSHI},      50,     50)
+    testTrade(&Order{Type:"A", Amount:100,},        &Order{Type:"B", BasisAmount:50,    Price:USATOSHI/2},   100,     50)
 
 
     // Mixed limits...
-    testTrade(&Order{Amount:100,            BasisAmount:50},                    &Order{Amount:200, BasisAmount:200, Price:1.0},   50,50)
-    testTrade(&Order{Amount:100, Filled:60, BasisAmount:50},                    &Order{Amount:200, BasisAmount:200, Price:1.0},   40,40)
-    testTrade(&Order{Amount:100, Filled:60, BasisAmount:50, BasisFilled:30},    &Order{Amount:200, BasisAmount:200, Price:1.0},   20,20)
+    testTrade(&Order{Amount:100,            BasisAmount:50},                    &Order{Amount:200, BasisAmount:200, Price:USATOSHI},   50,50)
+    testTrade(&Order{Amount:100, Filled:60, BasisAmount:50},                    &Order{Amount:200, BasisAmount:200, Price:USATOSHI},   40,40)
+    testTrade(&Order{Amount:100, Filled:60, BasisAmount:50, BasisFilled:30},    &Order{Amount:200, BasisAmount:200, Price:USATOSHI},   20,20)
 
-    testTrade(&Order{Amount:100}, &Order{BasisAmount:200, Price:2.0}, 100,200)
-    testTrade(&Order{Amount:90},  &Order{BasisAmount:200, Price:2.0}, 90, 180)
-    testTrade(&Order{Amount:100}, &Order{BasisAmount:190, Price:2.0}, 95, 190)
-    testTrade(&Order{Amount:100}, &Order{Amount:96,BasisAmount:190, Price:2.0}, 95, 190)
-    testTrade(&Order{Amount:100}, &Order{Amount:94,BasisAmount:190, Price:2.0}, 94, 188)
+    testTrade(&Order{Amount:100}, &Order{BasisAmount:200, Price:2*USATOSHI}, 100,200)
+    testTrade(&Order{Amount:90},  &Order{BasisAmount:200, Price:2*USATOSHI}, 90, 180)
+    testTrade(&Order{Amount:100}, &Order{BasisAmount:190, Price:2*USATOSHI}, 95, 190)
+    testTrade(&Order{Amount:100}, &Order{Amount:96,BasisAmount:190, Price:2*USATOSHI}, 95, 190)
+    testTrade(&Order{Amount:100}, &Order{Amount:94,BasisAmount:190, Price:2*USATOSHI}, 94, 188)
 
-    testTrade(&Order{BasisAmount:100},              &Order{Amount:200, Price:2.0},  50,100)
-    testTrade(&Order{BasisAmount:100},              &Order{Amount:200, Price:0.5}, 200,100)
-    testTrade(&Order{Amount:199,BasisAmount:100},   &Order{Amount:200, Price:0.5}, 199,100)
+    testTrade(&Order{BasisAmount:100},              &Order{Amount:200, Price:2*USATOSHI},  50,100)
+    testTrade(&Order{BasisAmount:100},              &Order{Amount:200, Price:USATOSHI/2}, 200,100)
+    testTrade(&Order{Amount:199,BasisAmount:100},   &Order{Amount:200, Price:USATOSHI/2}, 199,100)
 
 }
+
+func TestIcebergSlices(t *testing.T) {
+    iceberg := &Order{Type:"A", Amount:250, DisplayAmount:100, Price:USATOSHI, Priority:1}
+    if BookAmount(iceberg) != 100 { t.Errorf("Expected the book to show one slice, got %v", BookAmount(iceberg)) }
+
+    // Takers only get the visible slice, unless slices don't matter.
+    if ta, _ := (&Order{Type:"B", BasisAmount:200}).ComputeTrade(iceberg); ta != 100 { t.Errorf("Expected to trade the slice, got %v", ta) }
+    if ta, _ := (&Order{Type:"B", BasisAmount:200}).ComputeTrade(iceberg.withHidden()); ta != 200 { t.Errorf("Expected to trade past the slice, got %v", ta) }
+
+    iceberg.Filled = 60
+    if iceberg.SliceFilled() || BookAmount(iceberg) != 40 { t.Errorf("Expected 40 left of the slice, got %v", BookAmount(iceberg)) }
+    iceberg.Filled = 200
+    if !iceberg.SliceFilled() || BookAmount(iceberg) != 50 { t.Errorf("Expected the last 50 to show, got %v", BookAmount(iceberg)) }
+    iceberg.Filled = 250
+    if iceberg.SliceFilled() { t.Errorf("Expected a complete iceberg to have no more slices") }
+
+    // A refreshed slice goes behind orders at the same price.
+    other := &Order{Id:5, Type:"A", Amount:100, Price:USATOSHI, Priority:5}
+    if !iceberg.Less(other) { t.Errorf("Expected the iceberg to go first") }
+    iceberg.Priority = 6
+    if !other.Less(iceberg) { t.Errorf("Expected the refreshed iceberg to go last") }
+}
+
+// Property test: however orders get matched, fills never exceed what
+// each order reserved, and every trade completes at least one order.
+func TestReservedFundsCoverFills(t *testing.T) {
+    rnd := rand.New(rand.NewSource(1))
+    randUint64 := func(max uint64) uint64 { return uint64(rnd.Int63n(int64(max))) + 1 }
+    randTier := func() *FeeTier {
+        return &FeeTier{
+            MakerRatio: float64(rnd.Intn(4000) - 1000) / FEE_RATIO_SCALE,
+            TakerRatio: float64(rnd.Intn(5000)) / FEE_RATIO_SCALE,
+        }
+    }
+    maxRatio := func(tiers ...*FeeTier) float64 {
+        max := float64(0)
+        for _, tier := range tiers {
+            if tier.MakerRatio > max { max = tier.MakerRatio }
+            if tier.TakerRatio > max { max = tier.TakerRatio }
+        }
+        return max
+    }
+    newBid := func(price uint64, ratio float64) *Order {
+        bid := &Order{Type:"B", BasisAmount:randUint64(1000*USATOSHI), Price:price}
+        if rnd.Intn(2) == 0 { bid.Amount = randUint64(100*USATOSHI) }
+        bid.BasisFeeRatio = ratio
+        bid.BasisFee = ComputeFeeReserve(bid.BasisAmount, ratio)
+        return bid
+    }
+    newAsk := func(price uint64) *Order {
+        return &Order{Type:"A", Amount:randUint64(100*USATOSHI), Price:price}
+    }
+    checkReserves := func(order *Order) {
+        if order.Amount > 0 && order.Filled > order.Amount {
+            t.Fatalf("Order filled %v but only reserved amount %v", order.Filled, order.Amount)
+        }
+        if order.Type == "B" && int64(order.BasisFilled) + order.BasisFeeFilled > int64(order.BasisAmount + order.BasisFee) {
+            t.Fatalf("Bid paid %v + %v fees but only reserved %v + %v", order.BasisFilled, order.BasisFeeFilled, order.BasisAmount, order.BasisFee)
+        }
+        if order.Type == "A" && order.BasisFeeFilled > int64(order.BasisFilled) {
+            t.Fatalf("Ask paid %v fees but only received %v", order.BasisFeeFilled, order.BasisFilled)
+        }
+    }
+
+    for i:=0; i<2000; i++ {
+        tickSize := []uint64{1, 100000, 1000000}[rnd.Intn(3)]
+        takerTier, makerTier := randTier(), randTier()
+        ratio := maxRatio(takerTier, makerTier)
+        takerPrice := tickSize * randUint64(1000*USATOSHI/tickSize)
+
+        // A taker against a book of makers, which all cross.
+        var taker *Order
+        var makers []*Order
+        if rnd.Intn(2) == 0 {
+            taker = newBid(takerPrice, ratio)
+            for j:=0; j<5; j++ { makers = append(makers, newAsk(tickSize * randUint64(takerPrice/tickSize))) }
+        } else {
+            taker = newAsk(takerPrice)
+            for j:=0; j<5; j++ { makers = append(makers, newBid(takerPrice + tickSize * randUint64(1000), ratio)) }
+        }
+
+        for _, maker := range makers {
+            if taker.Complete() { break }
+            tradeAmount, tradeBasis, bidBasisFee, askBasisFee := taker.ComputeTradeAndFeesForTiers(maker, maker.Price, takerTier, makerTier)
+            bid, ask := taker.SortBidAsk(maker)
+            bid.Filled += tradeAmount
+            bid.BasisFilled += tradeBasis
+            bid.BasisFeeFilled += bidBasisFee
+            ask.Filled += tradeAmount
+            ask.BasisFilled += tradeBasis
+            ask.BasisFeeFilled += askBasisFee
+            checkReserves(taker)
+            checkReserves(maker)
+            if !taker.Complete() && !maker.Complete() {
+                t.Fatalf("Neither order was completed by trade of %v for %v", tradeAmount, tradeBasis)
+            }
+        }
+    }
+}
@@ -0,0 +1,30 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+)
+
+// Prices are fixed-point, in basis coin satoshis per whole coin,
+// the same way amounts are in satoshis. A price of 10.5 is 1050000000.
+// Each market only accepts prices that are a multiple of its TickSize.
+const PRICE_SCALE = USATOSHI
+
+// The basis value of amount at price, rounded half up.
+func BasisForAmount(amount uint64, price uint64) uint64 {
+    return MulDivRoundUint64(amount, price, PRICE_SCALE)
+}
+
+// The amount that basis buys at price, rounded half up.
+func AmountForBasis(basis uint64, price uint64) uint64 {
+    if price == 0 { panic(NewError("Cannot compute amount at price 0")) }
+    return MulDivRoundUint64(basis, PRICE_SCALE, price)
+}
+
+// For display & parameters.
+func PriceToF64(price uint64) float64 {
+    return UI64ToF64(price)
+}
+
+func F64ToPrice(f float64) uint64 {
+    return F64ToUI64(f)
+}
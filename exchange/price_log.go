@@ -1,84 +1,151 @@
 /*
-NOTE: If the server restarts, it'll lose PriceLogger.current, a minute's worth of data.
-TODO: Delete all but the last X rows from smaller intervals.
+Price logs (candles) get built from trades at the basis interval, the first of
+the market's CandleIntervals. Each finalized basis entry gets rolled up into the
+longer intervals as it's saved. RollupPriceLogs derives whole entries from basis
+entries in the DB, for intervals that were added to the config later.
+Old entries get deleted as per each interval's Retention, see Prune().
+The basis entry in progress (PriceLogger.current) only lives in memory, so
+Initialize() rebuilds it from the trades that no saved basis entry includes.
 */
 
 package exchange
 
 import (
-    // . "ftnox.com/common"
+    . "ftnox.com/common"
+    . "ftnox.com/config"
     "ftnox.com/db"
+    "sync"
     "time"
-    "math"
 )
 
-var Intervals = []int64{
-    60,         // minute (basis)
-    60*5,       // 5 minutes
-    60*60,      // hour
-}
-var BasisInterval = Intervals[0]
-var LongInterval  = Intervals[len(Intervals)-1]
+// Most entries that PriceLogHandler returns at once.
+const MAX_PRICE_LOGS = 500
 
 type PriceLogger struct {
-    Market  string
-    entries []*PriceLog // of basis time interval
-    current *PriceLog
+    Market      string
+    Coin        string
+    BasisCoin   string
+    Intervals   []*CandleInterval   // ascending, the first is the basis
+    Ticker      *Ticker
+    last        *PriceLog           // the last finalized basis entry
+    current     *PriceLog           // the basis entry still taking trades
+    rollups     map[int64]*PriceLog // the latest entry of each longer interval
+    mtx         sync.Mutex          // guards last & current, which LastPrice() reads from other goroutines
 }
 
-// Initialize by loading basis entries from the DB
-func (logger *PriceLogger) Initialize() {
-    logger.entries = LoadLastPriceLogs(logger.Market, Intervals[0], int(LongInterval/BasisInterval))
+func NewPriceLogger(basisCoin string, coin string) *PriceLogger {
+    market := MarketName(coin, basisCoin)
+    return &PriceLogger{
+        Market:     market,
+        Coin:       coin,
+        BasisCoin:  basisCoin,
+        Intervals:  Config.GetCandleIntervals(market),
+    }
+}
+
+func (logger *PriceLogger) BasisInterval() int64 {
+    return logger.Intervals[0].Interval
+}
+
+func (logger *PriceLogger) IntervalList() []int64 {
+    intervals := []int64{}
+    for _, ci := range logger.Intervals {
+        intervals = append(intervals, ci.Interval)
+    }
+    return intervals
 }
 
-// Assuming that all the PriceLog entries for the time range given with (t, interval)
-// are in logger.entries, compute the finalized PriceLog for this interval.
-// Returns nil if no trades were in range of (t, interval)
-func (logger *PriceLogger) computeForInterval(t int64, interval int64) *PriceLog {
-    startTime := t / interval * interval
-    endTime   := startTime + interval
-    inRange   := []*PriceLog{}
-    for _, plog := range logger.entries {
-        if plog.Time < startTime || endTime < (plog.Time + plog.Interval) { continue }
-        inRange = append(inRange, plog)
+func (logger *PriceLogger) HasInterval(interval int64) bool {
+    for _, ci := range logger.Intervals {
+        if ci.Interval == interval { return true }
     }
-    if len(inRange) == 0 { return nil }
-    newPlog := PriceLog{
-        Market:     logger.Market,
-        Interval:   interval,
-        Time:       startTime,
-        Timestamp:  time.Unix(startTime, 0),
-        High:       float64(0),
-        Low:        math.MaxUint64,
-        Open:       inRange[0].Open,
-        Close:      inRange[len(inRange)-1].Close,
+    return false
+}
+
+// Initialize by rolling up intervals that are missing entries,
+// then loading the latest entries from the DB,
+// then replaying the trades that came after the last basis entry.
+// Those were in PriceLogger.current, or had yet to be added when the server stopped.
+func (logger *PriceLogger) Initialize() {
+    basis := logger.BasisInterval()
+    logger.rollups = map[int64]*PriceLog{}
+    for _, ci := range logger.Intervals[1:] {
+        count := logger.RollupPriceLogs(ci.Interval)
+        if count > 0 { Info("[%v] Rolled up %v price logs of interval %v", logger.Market, count, ci.Interval) }
+        logger.rollups[ci.Interval] = LoadLastPriceLog(logger.Market, ci.Interval)
+    }
+    last := LoadLastPriceLog(logger.Market, basis)
+    logger.mtx.Lock()
+    logger.last = last
+    logger.mtx.Unlock()
+
+    now := time.Now().Unix()
+    logger.Ticker = &Ticker{Market:logger.Market, Interval:basis}
+    logger.Ticker.Initialize(LoadPriceLogs(logger.Market, basis, now - TICKER_WINDOW, now + 1))
+
+    since := int64(0)
+    if last != nil { since = last.Time + basis }
+    trades := LoadTradesSince(logger.BasisCoin, logger.Coin, since)
+    for _, trade := range trades {
+        logger.AddTrade(trade.TakerType, trade.TradeAmount, trade.TradeBasis, trade.Price, trade.Time)
     }
-    for _, plog := range inRange {
-        if plog.Low < newPlog.Low { newPlog.Low = plog.Low }
-        if newPlog.High < plog.High { newPlog.High = plog.High }
-        newPlog.AskVolume += plog.AskVolume
-        newPlog.BidVolume += plog.BidVolume
+    if len(trades) > 0 { Info("[%v] Replayed %v trades into the price log", logger.Market, len(trades)) }
+}
+
+// Derives entries of interval from basis entries in the DB, for every window
+// after the last existing entry of interval. Existing entries are left alone.
+// Returns the number of entries saved.
+func (logger *PriceLogger) RollupPriceLogs(interval int64) int {
+    start := int64(0)
+    last := LoadLastPriceLog(logger.Market, interval)
+    if last != nil { start = last.Time + interval }
+    plogs := LoadRolledUpPriceLogs(logger.Market, logger.BasisInterval(), interval, start)
+    if len(plogs) == 0 { return 0 }
+    err := db.DoBegin("", func(tx *db.ModelTx) {
+        for _, plog := range plogs {
+            SaveOrUpdatePriceLog(tx, plog)
+        }
+    })
+    if err != nil { panic(err) }
+    return len(plogs)
+}
+
+// Merges the finalized basis entry plog into the entry of interval that contains it.
+// Returns the updated entry, to be saved.
+func (logger *PriceLogger) rollup(plog *PriceLog, interval int64) *PriceLog {
+    startTime := plog.Time / interval * interval
+    rollup := logger.rollups[interval]
+    if rollup == nil || rollup.Time != startTime {
+        rollup = &PriceLog{
+            Market:     logger.Market,
+            Interval:   interval,
+            Time:       startTime,
+            Timestamp:  time.Unix(startTime, 0),
+            Low:        plog.Low,
+            High:       plog.High,
+            Open:       plog.Open,
+        }
+        logger.rollups[interval] = rollup
     }
-    return &newPlog
+    if plog.Low < rollup.Low { rollup.Low = plog.Low }
+    if rollup.High < plog.High { rollup.High = plog.High }
+    rollup.Close = plog.Close
+    rollup.AskVolume += plog.AskVolume
+    rollup.BidVolume += plog.BidVolume
+    rollup.BasisVolume += plog.BasisVolume
+    return rollup
 }
 
 // plog: The basis PriceLog entry to save
-// nextTime: The next PriceLog entry will have this time.
-//  * This is how we know whether to finalize parent blogs.
-func (logger *PriceLogger) addPriceLog(plog *PriceLog, nextTime int64) {
-    if plog.Interval != BasisInterval   { panic("addPriceLog() expects smallest interval") }
+// Longer intervals get updated in the same transaction.
+func (logger *PriceLogger) addPriceLog(plog *PriceLog) {
+    if plog.Interval != logger.BasisInterval() { panic("addPriceLog() expects the basis interval") }
     if plog.Time % plog.Interval != 0   { panic("plog.Time % Interval should be zero") }
     if plog.Market != logger.Market     { panic("plog.Market wasn't logger.market") }
 
-    logger.entries = append(logger.entries, plog)
-
     toSave := []*PriceLog{plog}
-    for i, interval := range Intervals {
-        if i == 0 { continue }
-        // If this interval window has closed...
-        //if (plog.Time / interval) < (nextTime / interval) {
-        toSave = append(toSave, logger.computeForInterval(plog.Time, interval))
-        //}
+    for _, ci := range logger.Intervals[1:] {
+        toSave = append(toSave, logger.rollup(plog, ci.Interval))
     }
 
     // TODO: this doesn't have to be serializable
@@ -88,12 +155,14 @@ func (logger *PriceLogger) addPriceLog(plog *PriceLog, nextTime int64) {
         }
     })
     if err != nil { panic(err) }
-
 }
 
 // Main function for adding datapoints.
-func (logger *PriceLogger) AddTrade(orderType string, amount uint64, price float64, t int64) {
-    t = t / BasisInterval * BasisInterval
+// orderType is the taker's, basis is the trade's basis amount.
+func (logger *PriceLogger) AddTrade(orderType string, amount uint64, basis uint64, price uint64, t int64) {
+    logger.Ticker.AddTrade(orderType, amount, basis, price, t)
+    basisInterval := logger.BasisInterval()
+    t = t / basisInterval * basisInterval
     var bidVolume, askVolume uint64
     if orderType == ORDER_TYPE_BID {
         bidVolume = amount
@@ -102,18 +171,20 @@ func (logger *PriceLogger) AddTrade(orderType string, amount uint64, price float
     }
     // Add & finalize basis & more intervals as necessary.
     if logger.current != nil && logger.current.Time < t {
-        diff := t - logger.current.Time
-        if diff % BasisInterval != 0 { panic("diff % BasisInterval != 0") }
-        logger.addPriceLog(logger.current, t)
-        logger.current = nil
+        logger.addPriceLog(logger.current)
+        logger.mtx.Lock()
+        logger.last, logger.current = logger.current, nil
+        logger.mtx.Unlock()
     }
+    logger.mtx.Lock()
+    defer logger.mtx.Unlock()
     if logger.current == nil {
         logger.current = &PriceLog{
             Market:     logger.Market,
             Low:        price,
             High:       price,
             Open:       price,
-            Interval:   BasisInterval,
+            Interval:   basisInterval,
             Time:       t,
             Timestamp:  time.Unix(t, 0),
         }
@@ -123,6 +194,7 @@ func (logger *PriceLogger) AddTrade(orderType string, amount uint64, price float
     if current.High < price { current.High = price }
     current.AskVolume += askVolume
     current.BidVolume += bidVolume
+    current.BasisVolume += basis
     current.Close = price
 }
 
@@ -133,12 +205,34 @@ func (logger *PriceLogger) LoadPrices(interval int64, start int64, end int64) []
     return plogs
 }
 
+// The shortest interval that covers start to end in at most MAX_PRICE_LOGS entries,
+// or the longest interval if none do.
+func (logger *PriceLogger) PickInterval(start int64, end int64) int64 {
+    for _, ci := range logger.Intervals {
+        if (end - start) / ci.Interval <= MAX_PRICE_LOGS { return ci.Interval }
+    }
+    return logger.Intervals[len(logger.Intervals)-1].Interval
+}
+
+// Deletes entries that are older than their interval's Retention.
+// Returns the number of entries deleted.
+func (logger *PriceLogger) Prune(now int64) int64 {
+    deleted := int64(0)
+    for _, ci := range logger.Intervals {
+        if ci.Retention == 0 { continue }
+        deleted += DeletePriceLogsBefore(logger.Market, ci.Interval, now - ci.Retention)
+    }
+    return deleted
+}
+
 // Returns 0 if none.
-func (logger *PriceLogger) LastPrice() float64 {
+func (logger *PriceLogger) LastPrice() uint64 {
+    logger.mtx.Lock()
+    defer logger.mtx.Unlock()
     if logger.current != nil {
         return logger.current.Close
-    } else if len(logger.entries) > 0 {
-        return logger.entries[len(logger.entries)-1].Close
+    } else if logger.last != nil {
+        return logger.last.Close
     }
     return 0
 }
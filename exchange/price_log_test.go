@@ -2,21 +2,26 @@ package exchange
 
 import (
     . "ftnox.com/common"
+    . "ftnox.com/config"
     "ftnox.com/db"
     "testing"
 )
 
-func checkPlog(t *testing.T, plog *PriceLog, low, high, op, cl float64, asks, bids uint64) {
-    if CompareF64(plog.Low, low, 5) != 0    { t.Fatalf("Expected low of %v, got %v",   low,  plog.Low) }
-    if CompareF64(plog.High, high, 5) != 0  { t.Fatalf("Expected high of %v, got %v",  high, plog.High) }
-    if CompareF64(plog.Open, op, 5) != 0    { t.Fatalf("Expected open of %v, got %v",  op,   plog.Open) }
-    if CompareF64(plog.Close, cl, 5) != 0   { t.Fatalf("Expected close of %v, got %v", cl,   plog.Close) }
+func checkPlog(t *testing.T, plog *PriceLog, low, high, op, cl uint64, asks, bids uint64) {
+    if plog.Low != low                      { t.Fatalf("Expected low of %v, got %v",   low,  plog.Low) }
+    if plog.High != high                    { t.Fatalf("Expected high of %v, got %v",  high, plog.High) }
+    if plog.Open != op                      { t.Fatalf("Expected open of %v, got %v",  op,   plog.Open) }
+    if plog.Close != cl                     { t.Fatalf("Expected close of %v, got %v", cl,   plog.Close) }
     if plog.AskVolume != asks               { t.Fatalf("Expected asks of %v, got %v",  asks, plog.AskVolume) }
     if plog.BidVolume != bids               { t.Fatalf("Expected bids of %v, got %v",  bids, plog.BidVolume) }
 }
 
 func TestPriceLog(t *testing.T) {
-    logger := &PriceLogger{ Market: RandId(12) }
+    logger := &PriceLogger{ Market: RandId(12), Intervals: []*CandleInterval{
+        &CandleInterval{Interval:60},
+        &CandleInterval{Interval:60*5},
+        &CandleInterval{Interval:60*60},
+    }}
     logger.Initialize()
 
     defer func() {
@@ -28,23 +33,23 @@ func TestPriceLog(t *testing.T) {
     }()
 
     // Add some entries.
-    //             Type, Amount,  Price,  Time
-    logger.AddTrade("B",    100,    100,     0) // Minute 0
-    logger.AddTrade("B",    100,     99,    10)
-    logger.AddTrade("B",    100,    102,    20)
+    //             Type, Amount,  Basis,  Price,  Time
+    logger.AddTrade("B",    100,     10,    100,     0) // Minute 0
+    logger.AddTrade("B",    100,     10,     99,    10)
+    logger.AddTrade("B",    100,     10,    102,    20)
 
     prices := logger.LoadPrices(60*1, 0, 60*1)
     if len(prices) != 0 { t.Fatalf("Expected 0 prices, got %v", len(prices)) }
     prices = logger.LoadPrices(60*5, 0, 60*5)
     if len(prices) != 0 { t.Fatalf("Expected 0 prices, got %v", len(prices)) }
 
-    logger.AddTrade("B",    100,    105,    60) // Minute 1
+    logger.AddTrade("B",    100,     10,    105,    60) // Minute 1
 
     prices = logger.LoadPrices(60*1, 0, 60*1)
     if len(prices) != 1 { t.Fatalf("Expected 1 prices, got %v", len(prices)) }
     checkPlog(t, prices[0], 99, 102, 100, 102, 0, 300)
 
-    logger.AddTrade("B",    100,    104,  60*2) // Minute 2
+    logger.AddTrade("B",    100,     10,    104,  60*2) // Minute 2
 
     prices = logger.LoadPrices(60*1, 0, 60*2)
     if len(prices) != 2 { t.Fatalf("Expected 2 prices, got %v", len(prices)) }
@@ -53,7 +58,7 @@ func TestPriceLog(t *testing.T) {
     prices = logger.LoadPrices(60*5, 0, 60*5)
     if len(prices) != 1 { t.Fatalf("Expected 1 prices, got %v", len(prices)) }
 
-    logger.AddTrade("B",    100,    100,  60*6) // Minute 6
+    logger.AddTrade("B",    100,     10,    100,  60*6) // Minute 6
 
     prices = logger.LoadPrices(60*1, 0, 60*6)
     if len(prices) != 3 { t.Fatalf("Expected 3 prices, got %v", len(prices)) }
@@ -63,4 +68,88 @@ func TestPriceLog(t *testing.T) {
     prices = logger.LoadPrices(60*5, 0, 60*5)
     if len(prices) != 1 { t.Fatalf("Expected 1 prices, got %v", len(prices)) }
     checkPlog(t, prices[0],  99, 105, 100, 104, 0, 500)
+    if prices[0].BasisVolume != 50 { t.Fatalf("Expected basis volume of 50, got %v", prices[0].BasisVolume) }
+
+    // Intervals added later get rolled up from the basis entries.
+    if count := logger.RollupPriceLogs(60*15); count != 1 { t.Fatalf("Expected 1 rolled up price, got %v", count) }
+    prices = logger.LoadPrices(60*15, 0, 60*15)
+    if len(prices) != 1 { t.Fatalf("Expected 1 prices, got %v", len(prices)) }
+    checkPlog(t, prices[0],  99, 105, 100, 104, 0, 500)
+    if count := logger.RollupPriceLogs(60*15); count != 0 { t.Fatalf("Expected nothing more to roll up, got %v", count) }
+
+    // Basis entries past their retention get deleted, the rest stay.
+    logger.Intervals[0].Retention = 60*4
+    if deleted := logger.Prune(60*6); deleted != 2 { t.Fatalf("Expected 2 pruned prices, got %v", deleted) }
+    prices = logger.LoadPrices(60*1, 0, 60*6)
+    if len(prices) != 1 { t.Fatalf("Expected 1 prices, got %v", len(prices)) }
+    prices = logger.LoadPrices(60*5, 0, 60*5)
+    if len(prices) != 1 { t.Fatalf("Expected 1 prices, got %v", len(prices)) }
+}
+
+// A logger that crashes mid-interval should end up with the same
+// price logs as one that never stopped.
+func TestPriceLogRecovery(t *testing.T) {
+    intervals := []*CandleInterval{
+        &CandleInterval{Interval:60},
+        &CandleInterval{Interval:60*5},
+    }
+    newLogger := func() *PriceLogger {
+        logger := &PriceLogger{Coin:RandId(4), BasisCoin:RandId(4), Intervals:intervals}
+        logger.Market = logger.Coin+"/"+logger.BasisCoin
+        return logger
+    }
+    uninterrupted, crashed := newLogger(), newLogger()
+    defer func() {
+        for _, logger := range []*PriceLogger{uninterrupted, crashed} {
+            db.Exec(`DELETE FROM exchange_price_log WHERE market=?`, logger.Market)
+            db.Exec(`DELETE FROM exchange_trade WHERE basis_coin=? AND coin=?`, logger.BasisCoin, logger.Coin)
+        }
+    }()
+    uninterrupted.Initialize()
+    crashed.Initialize()
+
+    // Saves the trade like ProcessOrderExecution would, and adds it unless skipAdd.
+    addTrade := func(logger *PriceLogger, trade Trade, skipAdd bool) {
+        trade.Coin, trade.BasisCoin = logger.Coin, logger.BasisCoin
+        err := db.DoBeginSerializable(func(tx *db.ModelTx) { SaveTrade(tx, &trade) })
+        if err != nil { t.Fatal(err) }
+        if skipAdd { return }
+        logger.AddTrade(trade.TakerType, trade.TradeAmount, trade.TradeBasis, trade.Price, trade.Time)
+    }
+
+    trades := []Trade{
+        Trade{TakerType:"B", TradeAmount:100, TradeBasis:10, Price:100, Time:0},   // Minute 0
+        Trade{TakerType:"A", TradeAmount:100, TradeBasis:10, Price: 99, Time:10},
+        Trade{TakerType:"B", TradeAmount:100, TradeBasis:10, Price:102, Time:70},  // Minute 1
+        Trade{TakerType:"A", TradeAmount:100, TradeBasis:10, Price:101, Time:80},
+        Trade{TakerType:"B", TradeAmount:100, TradeBasis:10, Price:103, Time:90},
+        Trade{TakerType:"B", TradeAmount:100, TradeBasis:10, Price:104, Time:200}, // Minute 3
+        Trade{TakerType:"A", TradeAmount:100, TradeBasis:10, Price: 98, Time:400}, // Minute 6
+    }
+    for _, trade := range trades {
+        addTrade(uninterrupted, trade, false)
+    }
+
+    // Crash in minute 1, after the last trade was saved but before it got added.
+    for _, trade := range trades[:3] { addTrade(crashed, trade, false) }
+    addTrade(crashed, trades[3], true)
+    crashed = &PriceLogger{Market:crashed.Market, Coin:crashed.Coin, BasisCoin:crashed.BasisCoin, Intervals:intervals}
+    crashed.Initialize()
+    if crashed.LastPrice() != 101 { t.Fatalf("Expected the recovered last price to be 101, got %v", crashed.LastPrice()) }
+    for _, trade := range trades[4:] { addTrade(crashed, trade, false) }
+
+    if crashed.LastPrice() != uninterrupted.LastPrice() { t.Errorf("Expected last price %v, got %v", uninterrupted.LastPrice(), crashed.LastPrice()) }
+    for _, ci := range intervals {
+        expected := uninterrupted.LoadPrices(ci.Interval, 0, 600)
+        actual := crashed.LoadPrices(ci.Interval, 0, 600)
+        if len(expected) == 0 || len(expected) != len(actual) {
+            t.Fatalf("Expected %v prices of interval %v, got %v", len(expected), ci.Interval, len(actual))
+        }
+        for i, plog := range expected {
+            checkPlog(t, actual[i], plog.Low, plog.High, plog.Open, plog.Close, plog.AskVolume, plog.BidVolume)
+            if actual[i].Time != plog.Time || actual[i].BasisVolume != plog.BasisVolume {
+                t.Errorf("Expected %v but got %v", plog, actual[i])
+            }
+        }
+    }
 }
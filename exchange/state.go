@@ -0,0 +1,142 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/kvstore"
+    "time"
+)
+
+// Market states, set by admins through the treasury.
+// Only open markets take & match new orders. Auctions take orders without matching
+// them until the uncross, see auction.go. Cancel-only markets still take cancellations.
+// Halted markets take neither, e.g. while a coin's daemon misbehaves.
+// Delisting cancels all pending orders, and there's no coming back from it.
+const (
+    MARKET_STATE_OPEN =         "O"
+    MARKET_STATE_AUCTION =      "A"
+    MARKET_STATE_CANCEL_ONLY =  "C"
+    MARKET_STATE_HALTED =       "H"
+    MARKET_STATE_DELISTED =     "D"
+)
+
+// The states each state can go to, besides itself.
+var marketStateTransitions = map[string][]string{
+    MARKET_STATE_OPEN:          []string{MARKET_STATE_AUCTION, MARKET_STATE_CANCEL_ONLY, MARKET_STATE_HALTED, MARKET_STATE_DELISTED},
+    MARKET_STATE_AUCTION:       []string{MARKET_STATE_OPEN, MARKET_STATE_CANCEL_ONLY, MARKET_STATE_HALTED, MARKET_STATE_DELISTED},
+    MARKET_STATE_CANCEL_ONLY:   []string{MARKET_STATE_OPEN, MARKET_STATE_AUCTION, MARKET_STATE_HALTED, MARKET_STATE_DELISTED},
+    MARKET_STATE_HALTED:        []string{MARKET_STATE_OPEN, MARKET_STATE_AUCTION, MARKET_STATE_CANCEL_ONLY, MARKET_STATE_DELISTED},
+    MARKET_STATE_DELISTED:      []string{},
+}
+
+func marketStateKey(marketName string) string {
+    return "exchange/market_state/"+marketName
+}
+
+// Returns MARKET_STATE_OPEN if the state was never set.
+func LoadMarketState(marketName string) string {
+    state := kvstore.Get(marketStateKey(marketName))
+    if state == "" { return MARKET_STATE_OPEN }
+    return state
+}
+
+func (market *Market) State() string {
+    market.stateMtx.Lock()
+    defer market.stateMtx.Unlock()
+    return market.state
+}
+
+func (market *Market) CanAddOrder() bool {
+    state := market.State()
+    return state == MARKET_STATE_OPEN || state == MARKET_STATE_AUCTION
+}
+
+func (market *Market) CanCancelOrder() bool {
+    return market.State() != MARKET_STATE_HALTED
+}
+
+func (market *Market) CanTransition(state string) bool {
+    current := market.State()
+    if state == current { return true }
+    for _, next := range marketStateTransitions[current] {
+        if next == state { return true }
+    }
+    return false
+}
+
+// Saves the new state, which takes effect for orders added from now on,
+// and ends any timed halt.
+// Orders that were already queued get canceled as they're processed, see ProcessOrder().
+// Opening a halted or cancel-only market starts an auction instead,
+// and opening an auction uncrosses it.
+// Delisting queues cancellations for all pending orders, which releases their funds.
+// Returns the number of orders queued for cancellation.
+func (market *Market) SetState(state string) int {
+    market.stateMtx.Lock()
+    current, timed := market.state, market.haltedUntil != 0
+    market.stateMtx.Unlock()
+    if !market.CanTransition(state) {
+        panic(NewError("[%v] Cannot go from state %v to %v", market.Name(), current, state))
+    }
+    if state == current && !timed { return 0 }
+
+    resuming := false
+    if state == MARKET_STATE_OPEN {
+        switch current {
+        case MARKET_STATE_AUCTION:
+            market.endAuction()
+            return 0
+        case MARKET_STATE_HALTED, MARKET_STATE_CANCEL_ONLY:
+            state, resuming = MARKET_STATE_AUCTION, true
+        }
+    }
+
+    kvstore.Set(marketStateKey(market.Name()), state)
+    market.stateMtx.Lock()
+    market.state = state
+    market.haltedUntil = 0
+    market.auctionEnd = 0
+    if state == MARKET_STATE_AUCTION { market.scheduleUncross(resuming) }
+    market.stateMtx.Unlock()
+    Info("[%v] Market state changed from %v to %v", market.Name(), current, state)
+
+    if state != MARKET_STATE_DELISTED { return 0 }
+    orders := LoadPendingOrdersSince(market.BasisCoin, market.Coin, 0)
+    for _, order := range orders {
+        CancelOrder(order)
+    }
+    Info("[%v] Queued %v orders for cancellation", market.Name(), len(orders))
+    return len(orders)
+}
+
+// When the timed halt ends, or 0 if there isn't one.
+func (market *Market) HaltedUntil() int64 {
+    market.stateMtx.Lock()
+    defer market.stateMtx.Unlock()
+    return market.haltedUntil
+}
+
+// Halts an open market for seconds, after which it resumes through an auction,
+// unless SetState() was called in the meantime.
+// The halt isn't saved, so restarting the server ends it.
+// Returns false if the market wasn't open.
+func (market *Market) HaltFor(seconds int64) bool {
+    market.stateMtx.Lock()
+    defer market.stateMtx.Unlock()
+    if market.state != MARKET_STATE_OPEN { return false }
+    market.state = MARKET_STATE_HALTED
+    market.haltedUntil = time.Now().Unix() + seconds
+    time.AfterFunc(time.Duration(seconds) * time.Second, market.endTimedHalt)
+    Warn("[%v] Halted for %vs", market.Name(), seconds)
+    return true
+}
+
+func (market *Market) endTimedHalt() {
+    market.stateMtx.Lock()
+    defer market.stateMtx.Unlock()
+    // Ended by SetState(), or a later halt took over.
+    if market.haltedUntil == 0 || time.Now().Unix() < market.haltedUntil { return }
+    market.state = MARKET_STATE_AUCTION
+    market.haltedUntil = 0
+    market.scheduleUncross(true)
+    Info("[%v] Timed halt ended", market.Name())
+}
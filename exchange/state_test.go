@@ -0,0 +1,25 @@
+package exchange
+
+import (
+    "testing"
+)
+
+func TestMarketStateTransitions(t *testing.T) {
+    testTransition := func(from string, to string, expected bool) {
+        market := &Market{state:from}
+        if market.CanTransition(to) != expected { t.Errorf("Expected transition from %v to %v to be %v", from, to, expected) }
+    }
+    testTransition(MARKET_STATE_OPEN,        MARKET_STATE_HALTED,      true)
+    testTransition(MARKET_STATE_HALTED,      MARKET_STATE_CANCEL_ONLY, true)
+    testTransition(MARKET_STATE_CANCEL_ONLY, MARKET_STATE_OPEN,        true)
+    testTransition(MARKET_STATE_HALTED,      MARKET_STATE_DELISTED,    true)
+    testTransition(MARKET_STATE_OPEN,        MARKET_STATE_OPEN,        true)
+    testTransition(MARKET_STATE_DELISTED,    MARKET_STATE_OPEN,        false)
+    testTransition(MARKET_STATE_DELISTED,    MARKET_STATE_HALTED,      false)
+    testTransition(MARKET_STATE_OPEN,        "X",                      false)
+
+    market := &Market{state:MARKET_STATE_CANCEL_ONLY}
+    if market.CanAddOrder() || !market.CanCancelOrder() { t.Errorf("Cancel-only markets should take only cancellations") }
+    market = &Market{state:MARKET_STATE_HALTED}
+    if market.CanAddOrder() || market.CanCancelOrder() { t.Errorf("Halted markets should take neither orders nor cancellations") }
+}
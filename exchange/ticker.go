@@ -0,0 +1,121 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "sync"
+)
+
+const TICKER_WINDOW = 24*60*60 // seconds
+
+// Rolling statistics over the last TICKER_WINDOW, at Interval resolution.
+// Updated from the market's goroutine, read from handlers, hence the lock.
+type Ticker struct {
+    Market      string
+    Interval    int64       // the PriceLogger's basis interval
+    buckets     []*PriceLog // of Interval, time ASC
+    mtx         sync.Mutex
+}
+
+type TickerStats struct {
+    Open        uint64  `json:"open"`
+    High        uint64  `json:"high"`
+    Low         uint64  `json:"low"`
+    Close       uint64  `json:"close"`
+    Volume      uint64  `json:"volume"`         // in coin
+    BasisVolume uint64  `json:"basisVolume"`    // in basis coin
+    VWAP        uint64  `json:"vwap"`
+    Change      float64 `json:"change"`         // percent, from open to close
+    Start       int64   `json:"start"`
+    End         int64   `json:"end"`
+}
+
+// Seeds the ticker from basis PriceLog entries, which must be in time ASC order.
+func (ticker *Ticker) Initialize(plogs []*PriceLog) {
+    ticker.mtx.Lock()
+    defer ticker.mtx.Unlock()
+    ticker.buckets = nil
+    for _, plog := range plogs {
+        bucket := *plog
+        ticker.buckets = append(ticker.buckets, &bucket)
+    }
+}
+
+// t should be in non-decreasing order, as trades are.
+func (ticker *Ticker) AddTrade(orderType string, amount uint64, basis uint64, price uint64, t int64) {
+    t = t / ticker.Interval * ticker.Interval
+    ticker.mtx.Lock()
+    defer ticker.mtx.Unlock()
+
+    var last *PriceLog
+    if len(ticker.buckets) > 0 { last = ticker.buckets[len(ticker.buckets)-1] }
+    if last == nil || last.Time < t {
+        last = &PriceLog{
+            Market:     ticker.Market,
+            Interval:   ticker.Interval,
+            Time:       t,
+            Low:        price,
+            High:       price,
+            Open:       price,
+        }
+        ticker.buckets = append(ticker.buckets, last)
+        ticker.prune(t)
+    }
+    if price < last.Low { last.Low = price }
+    if last.High < price { last.High = price }
+    last.Close = price
+    if orderType == ORDER_TYPE_BID {
+        last.BidVolume += amount
+    } else {
+        last.AskVolume += amount
+    }
+    last.BasisVolume += basis
+}
+
+// Drops buckets that are out of the window ending at now.
+// Must hold ticker.mtx.
+func (ticker *Ticker) prune(now int64) {
+    i := 0
+    for i < len(ticker.buckets) && ticker.buckets[i].Time + ticker.Interval <= now - TICKER_WINDOW { i++ }
+    ticker.buckets = ticker.buckets[i:]
+}
+
+// The lowest & highest prices since start, at Interval resolution.
+// Returns zeros if there were no trades.
+func (ticker *Ticker) Range(start int64) (low uint64, high uint64) {
+    ticker.mtx.Lock()
+    defer ticker.mtx.Unlock()
+    for _, bucket := range ticker.buckets {
+        if bucket.Time + ticker.Interval <= start { continue }
+        if low == 0 || bucket.Low < low { low = bucket.Low }
+        if high < bucket.High { high = bucket.High }
+    }
+    return
+}
+
+// The statistics for the window ending at now.
+// Returns zeros except for Start & End if there were no trades.
+func (ticker *Ticker) Stats(now int64) *TickerStats {
+    ticker.mtx.Lock()
+    defer ticker.mtx.Unlock()
+    ticker.prune(now)
+
+    stats := &TickerStats{Start: now - TICKER_WINDOW, End: now}
+    for _, bucket := range ticker.buckets {
+        if bucket.Time > now { break }
+        if stats.Open == 0 {
+            stats.Open, stats.Low = bucket.Open, bucket.Low
+        }
+        if bucket.Low < stats.Low { stats.Low = bucket.Low }
+        if stats.High < bucket.High { stats.High = bucket.High }
+        stats.Close = bucket.Close
+        stats.Volume += bucket.AskVolume + bucket.BidVolume
+        stats.BasisVolume += bucket.BasisVolume
+    }
+    if stats.Volume > 0 {
+        stats.VWAP = MulDivRoundUint64(stats.BasisVolume, PRICE_SCALE, stats.Volume)
+    }
+    if stats.Open > 0 {
+        stats.Change = (PriceToF64(stats.Close) - PriceToF64(stats.Open)) / PriceToF64(stats.Open) * 100
+    }
+    return stats
+}
@@ -0,0 +1,34 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "testing"
+)
+
+func TestTicker(t *testing.T) {
+    ticker := &Ticker{Market:"TEST", Interval:60}
+    ticker.Initialize([]*PriceLog{
+        &PriceLog{Interval:60, Time:0,  Open:10*USATOSHI, High:12*USATOSHI, Low:9*USATOSHI, Close:11*USATOSHI, BidVolume:USATOSHI, BasisVolume:11*USATOSHI},
+    })
+    //              Type, Amount,     Basis,        Price,        Time
+    ticker.AddTrade("A",  USATOSHI,   12*USATOSHI,  12*USATOSHI,  60)
+    ticker.AddTrade("B",  2*USATOSHI, 26*USATOSHI,  13*USATOSHI,  90)
+
+    stats := ticker.Stats(100)
+    if stats.Open != 10*USATOSHI || stats.High != 13*USATOSHI || stats.Low != 9*USATOSHI || stats.Close != 13*USATOSHI {
+        t.Errorf("Unexpected prices %v", *stats)
+    }
+    if stats.Volume != 4*USATOSHI || stats.BasisVolume != 49*USATOSHI { t.Errorf("Unexpected volume %v", *stats) }
+    if stats.VWAP != 1225*USATOSHI/100 { t.Errorf("Expected VWAP 12.25 but got %v", stats.VWAP) }
+    if stats.Change != 30 { t.Errorf("Expected 30%% change but got %v", stats.Change) }
+
+    // A day later, only the trades in the second minute are in the window.
+    stats = ticker.Stats(60 + TICKER_WINDOW)
+    if stats.Open != 12*USATOSHI || stats.Low != 12*USATOSHI || stats.Volume != 3*USATOSHI {
+        t.Errorf("Expected the first minute to roll out of the window, got %v", *stats)
+    }
+
+    // And then nothing.
+    stats = ticker.Stats(120 + TICKER_WINDOW)
+    if stats.Volume != 0 || stats.Open != 0 || stats.VWAP != 0 { t.Errorf("Expected an empty window, got %v", *stats) }
+}
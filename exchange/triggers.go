@@ -0,0 +1,90 @@
+package exchange
+
+import (
+    . "ftnox.com/common"
+    "github.com/jaekwon/GoLLRB/llrb"
+)
+
+// Stop orders wait here, with their funds already reserved, until the
+// last trade price reaches their StopPrice.
+// Only the market's goroutine should touch this.
+type TriggerBook struct {
+    Bids *llrb.LLRB // of stopBid, min is the lowest StopPrice
+    Asks *llrb.LLRB // of stopAsk, min is the highest StopPrice
+}
+
+// Buy stops trigger when the price rises to StopPrice.
+type stopBid struct{ *Order }
+
+func (sb stopBid) Less(than llrb.Item) bool {
+    other, ok := than.(stopBid)
+    if !ok { panic("Cannot compare stopBid with something else") }
+    if sb.Id == other.Id { return false }
+    if sb.StopPrice == other.StopPrice { return sb.Id < other.Id }
+    return sb.StopPrice < other.StopPrice
+}
+
+// Sell stops trigger when the price falls to StopPrice.
+type stopAsk struct{ *Order }
+
+func (sa stopAsk) Less(than llrb.Item) bool {
+    other, ok := than.(stopAsk)
+    if !ok { panic("Cannot compare stopAsk with something else") }
+    if sa.Id == other.Id { return false }
+    if sa.StopPrice == other.StopPrice { return sa.Id < other.Id }
+    return sa.StopPrice > other.StopPrice
+}
+
+func NewTriggerBook() *TriggerBook {
+    return &TriggerBook{
+        Bids:   llrb.New(),
+        Asks:   llrb.New(),
+    }
+}
+
+func (book *TriggerBook) Len() int {
+    return book.Bids.Len() + book.Asks.Len()
+}
+
+func (book *TriggerBook) Insert(order *Order) {
+    if !order.IsStop() { panic(NewError("Expected a stop order but got kind %v", order.Kind)) }
+    if order.Type == ORDER_TYPE_BID {
+        book.Bids.InsertNoReplace(stopBid{order})
+    } else if order.Type == ORDER_TYPE_ASK {
+        book.Asks.InsertNoReplace(stopAsk{order})
+    } else {
+        panic(NewError("Unexpected order type %v", order.Type))
+    }
+}
+
+// Returns the removed order, or nil if it wasn't in the book.
+func (book *TriggerBook) Remove(order *Order) *Order {
+    if order.Type == ORDER_TYPE_BID {
+        removed, ok := book.Bids.Delete(stopBid{order}).(stopBid)
+        if ok { return removed.Order }
+    } else if order.Type == ORDER_TYPE_ASK {
+        removed, ok := book.Asks.Delete(stopAsk{order}).(stopAsk)
+        if ok { return removed.Order }
+    } else {
+        panic(NewError("Unexpected order type %v", order.Type))
+    }
+    return nil
+}
+
+// Removes & returns all the stop orders triggered by a trade at lastPrice.
+func (book *TriggerBook) PopTriggered(lastPrice uint64) []*Order {
+    triggered := []*Order{}
+    for book.Bids.Len() > 0 {
+        sb := book.Bids.Min().(stopBid)
+        if lastPrice < sb.StopPrice { break }
+        book.Bids.DeleteMin()
+        triggered = append(triggered, sb.Order)
+    }
+    for book.Asks.Len() > 0 {
+        sa := book.Asks.Min().(stopAsk)
+        if sa.StopPrice < lastPrice { break }
+        book.Asks.DeleteMin()
+        triggered = append(triggered, sa.Order)
+    }
+    return triggered
+}
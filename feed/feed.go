@@ -0,0 +1,158 @@
+package feed
+
+import (
+    . "ftnox.com/common"
+    "fmt"
+    "sync"
+)
+
+const (
+    // Events a subscriber can fall behind by before it gets dropped.
+    SUBSCRIBER_BUFFER = 256
+
+    CHANNEL_BOOK =      "book"      // L2 book deltas, per market
+    CHANNEL_TRADES =    "trades"    // trades, per market
+    CHANNEL_AUCTION =   "auction"   // indicative price & volume during call auctions, per market
+    CHANNEL_ORDERS =    "orders"    // order status changes, per user
+    CHANNEL_BALANCES =  "balances"  // balance updates, per user
+)
+
+// Each channel numbers its events 1, 2, 3... from server start.
+// A client that sees a gap in Seq missed something and should resync.
+type Event struct {
+    Channel     string      `json:"channel"`
+    Seq         int64       `json:"seq"`
+    Type        string      `json:"type"`
+    Data        interface{} `json:"data"`
+}
+
+type channel struct {
+    seq         int64
+    subscribers map[*Subscriber]struct{}
+}
+
+// Receives events from the channels it subscribed to, in order.
+// If it falls SUBSCRIBER_BUFFER events behind, Events gets closed,
+// and the subscriber has to resubscribe & resync.
+type Subscriber struct {
+    Events      chan *Event
+    channels    map[string]struct{}
+    closed      bool
+}
+
+var channels = map[string]*channel{}
+var channelsMtx = sync.Mutex{}
+
+func MarketChannel(kind string, market string) string {
+    return kind+":"+market
+}
+
+func UserChannel(kind string, userId int64) string {
+    return fmt.Sprintf("%v:%v", kind, userId)
+}
+
+func NewSubscriber() *Subscriber {
+    return &Subscriber{
+        Events:     make(chan *Event, SUBSCRIBER_BUFFER),
+        channels:   map[string]struct{}{},
+    }
+}
+
+func getChannel(name string) *channel {
+    ch := channels[name]
+    if ch == nil {
+        ch = &channel{subscribers: map[*Subscriber]struct{}{}}
+        channels[name] = ch
+    }
+    return ch
+}
+
+// Publishes an event & returns its sequence number.
+// Never blocks, so it's safe to call from a market's goroutine.
+func Publish(name string, eventType string, data interface{}) int64 {
+    channelsMtx.Lock()
+    defer channelsMtx.Unlock()
+    ch := getChannel(name)
+    ch.seq += 1
+    event := &Event{name, ch.seq, eventType, data}
+    for sub, _ := range ch.subscribers {
+        select {
+        case sub.Events <- event:
+        default:
+            Warn("[feed] Dropping slow subscriber of %v", name)
+            sub.close()
+        }
+    }
+    return ch.seq
+}
+
+// The sequence number of the last event published to the channel.
+// Snapshots (e.g. the orderbook) return this so clients know
+// which events are already reflected in the snapshot.
+func Seq(name string) int64 {
+    channelsMtx.Lock()
+    defer channelsMtx.Unlock()
+    ch := channels[name]
+    if ch == nil { return 0 }
+    return ch.seq
+}
+
+// Returns the sequence number of the last event published before subscribing.
+func (sub *Subscriber) Subscribe(name string) int64 {
+    channelsMtx.Lock()
+    defer channelsMtx.Unlock()
+    if sub.closed { return 0 }
+    ch := getChannel(name)
+    ch.subscribers[sub] = struct{}{}
+    sub.channels[name] = struct{}{}
+    return ch.seq
+}
+
+func (sub *Subscriber) Unsubscribe(name string) {
+    channelsMtx.Lock()
+    defer channelsMtx.Unlock()
+    sub.unsubscribe(name)
+}
+
+func (sub *Subscriber) Close() {
+    channelsMtx.Lock()
+    defer channelsMtx.Unlock()
+    sub.close()
+}
+
+// Sends an event that isn't part of any channel's sequence, like a reply.
+// Returns false if the subscriber is closed, or was dropped for being slow.
+func (sub *Subscriber) Send(event *Event) bool {
+    channelsMtx.Lock()
+    defer channelsMtx.Unlock()
+    if sub.closed { return false }
+    select {
+    case sub.Events <- event:
+        return true
+    default:
+        sub.close()
+        return false
+    }
+}
+
+// Must hold channelsMtx.
+// Channels nothing was ever published to get forgotten, so clients can't
+// grow the map by subscribing to made up names.
+func (sub *Subscriber) unsubscribe(name string) {
+    ch := channels[name]
+    if ch != nil {
+        delete(ch.subscribers, sub)
+        if ch.seq == 0 && len(ch.subscribers) == 0 { delete(channels, name) }
+    }
+    delete(sub.channels, name)
+}
+
+// Must hold channelsMtx.
+func (sub *Subscriber) close() {
+    if sub.closed { return }
+    for name, _ := range sub.channels {
+        sub.unsubscribe(name)
+    }
+    sub.closed = true
+    close(sub.Events)
+}
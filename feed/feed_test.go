@@ -0,0 +1,36 @@
+package feed
+
+import (
+    "testing"
+)
+
+func TestPublishSequence(t *testing.T) {
+    sub := NewSubscriber()
+    defer sub.Close()
+    Publish("test:a", "x", 1)
+    if seq := sub.Subscribe("test:a"); seq != 1 { t.Fatalf("Expected seq 1 on subscribe but got %v", seq) }
+    Publish("test:a", "x", 2)
+    Publish("test:b", "x", 1)
+    Publish("test:a", "x", 3)
+
+    for _, expected := range []int64{2, 3} {
+        event := <-sub.Events
+        if event.Channel != "test:a" || event.Seq != expected {
+            t.Errorf("Expected test:a seq %v but got %v seq %v", expected, event.Channel, event.Seq)
+        }
+    }
+    if len(sub.Events) != 0 { t.Errorf("Expected no events from test:b") }
+    if Seq("test:b") != 1 { t.Errorf("Expected test:b seq 1 but got %v", Seq("test:b")) }
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+    sub := NewSubscriber()
+    sub.Subscribe("test:slow")
+    for i := 0; i < SUBSCRIBER_BUFFER+1; i++ {
+        Publish("test:slow", "x", i)
+    }
+    for i := 0; i < SUBSCRIBER_BUFFER; i++ { <-sub.Events }
+    if _, ok := <-sub.Events; ok { t.Errorf("Expected Events to be closed") }
+    if sub.Send(&Event{}) { t.Errorf("Expected Send to a dropped subscriber to fail") }
+    if sub.Subscribe("test:slow") != 0 { t.Errorf("Expected Subscribe to a dropped subscriber to do nothing") }
+}
@@ -0,0 +1,109 @@
+package feed
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/auth"
+    "code.google.com/p/go.net/websocket"
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+// What clients send over the socket.
+// op is "subscribe" or "unsubscribe".
+// channel is "book:BTC/USD", "trades:BTC/USD", "auction:BTC/USD", "orders" or "balances".
+// The last two are the authenticated user's own, and need an api_key.
+type request struct {
+    Op          string  `json:"op"`
+    Channel     string  `json:"channel"`
+}
+
+// Replies to requests go on the same stream as events, with Type "subscribed",
+// "unsubscribed" or "error". Seq of "subscribed" is the channel's last Seq.
+func FeedHandler(w http.ResponseWriter, r *http.Request) {
+    // The feed is a long-lived connection, so it authenticates
+    // with the api_key parameter rather than the session cookie.
+    user := auth.GetUser(r, true)
+    server := websocket.Server{
+        Handshake:  checkOrigin,
+        Handler:    func(ws *websocket.Conn) { serveFeed(ws, user) },
+    }
+    server.ServeHTTP(w, r)
+}
+
+// Browsers must come from ftnox.com, API clients don't send an Origin.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+    origin := r.Header.Get("Origin")
+    if origin == "" { return nil }
+    originUrl, err := url.Parse(origin)
+    if err != nil { return err }
+    originHost := strings.Split(originUrl.Host, ":")[0]
+    if originHost != "ftnox.com" && !strings.HasSuffix(originHost, ".ftnox.com") {
+        return NewError("Origin %v not allowed", origin)
+    }
+    return nil
+}
+
+func serveFeed(ws *websocket.Conn, user *auth.User) {
+    defer ws.Close()
+    sub := NewSubscriber()
+    defer sub.Close()
+
+    // Write events until the subscriber gets dropped or the socket closes.
+    done := make(chan struct{})
+    go func() {
+        defer Recover("FeedWriter")
+        defer ws.Close()
+        for {
+            select {
+            case event, ok := <-sub.Events:
+                if !ok { return }
+                if websocket.JSON.Send(ws, event) != nil { return }
+            case <-done:
+                return
+            }
+        }
+    }()
+    defer close(done)
+
+    // Read requests.
+    for {
+        var req request
+        if websocket.JSON.Receive(ws, &req) != nil { return }
+        name, err := resolveChannel(req.Channel, user)
+        if err != nil {
+            if !reply(sub, req.Channel, 0, "error", err.Error()) { return }
+            continue
+        }
+        switch req.Op {
+        case "subscribe":
+            seq := sub.Subscribe(name)
+            if !reply(sub, req.Channel, seq, "subscribed", nil) { return }
+        case "unsubscribe":
+            sub.Unsubscribe(name)
+            if !reply(sub, req.Channel, 0, "unsubscribed", nil) { return }
+        default:
+            if !reply(sub, req.Channel, 0, "error", "Unknown op "+req.Op) { return }
+        }
+    }
+}
+
+// Queues a reply behind the events already sent to sub.
+// Returns false if the subscriber is gone.
+func reply(sub *Subscriber, channel string, seq int64, replyType string, data interface{}) bool {
+    return sub.Send(&Event{channel, seq, replyType, data})
+}
+
+// Translates the channel a client asked for into the internal channel name.
+func resolveChannel(channel string, user *auth.User) (string, error) {
+    switch channel {
+    case CHANNEL_ORDERS, CHANNEL_BALANCES:
+        if user == nil { return "", NewError("Channel %v requires an api_key", channel) }
+        return UserChannel(channel, user.Id), nil
+    }
+    parts := strings.SplitN(channel, ":", 2)
+    if len(parts) != 2 || (parts[0] != CHANNEL_BOOK && parts[0] != CHANNEL_TRADES && parts[0] != CHANNEL_AUCTION) {
+        return "", NewError("Unknown channel %v", channel)
+    }
+    return channel, nil
+}
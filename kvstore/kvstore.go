@@ -24,7 +24,7 @@ func Set(key, value string) {
     case db.ERR_DUPLICATE_ENTRY:
         // Update instead
         _, err := db.Exec(
-            `UPDATE kvstore SET value=? WHERE key=?`,
+            `UPDATE kvstore SET value=? WHERE key_=?`,
             value, key,
         )
         if err != nil { panic(err) }
@@ -0,0 +1,1089 @@
+package tests
+
+import (
+    . "ftnox.com/common"
+    "ftnox.com/account"
+    "ftnox.com/auth"
+    "ftnox.com/config"
+    "ftnox.com/exchange"
+    "ftnox.com/feed"
+    "fmt"
+    "net/http"
+    "net/url"
+    "testing"
+    "sync"
+    "time"
+    "github.com/jaekwon/GoLLRB/llrb"
+)
+
+func ensureOrderStatus(t *testing.T, order *exchange.Order, status uint32) {
+    loaded := exchange.LoadOrder(order.Id)
+    if loaded.Status != status {
+        t.Errorf("Expected order %v to have status %v but got %v", order.Id, status, loaded.Status)
+    }
+}
+
+func TestMarketsProcessConcurrently(t *testing.T) {
+    btcMarket := exchange.Markets["BTC/USD"]
+    ltcMarket := exchange.Markets["LTC/USD"]
+
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "BTC", USATOSHI)
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 200*USATOSHI)
+
+    // Queue up a LTC trade, but don't process it yet.
+    ltcAsk := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI,          BasisCoin:"USD", Price:10*USATOSHI}
+    ltcBid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,  Coin:"LTC", BasisAmount:10*USATOSHI,  BasisCoin:"USD", Price:10*USATOSHI}
+    exchange.AddOrder(ltcAsk)
+    exchange.AddOrder(ltcBid)
+    if ltcMarket.QueueDepth() != 2 { t.Fatalf("Expected 2 queued LTC orders, got %v", ltcMarket.QueueDepth()) }
+    if btcMarket.QueueDepth() != 0 { t.Fatalf("Expected 0 queued BTC orders, got %v", btcMarket.QueueDepth()) }
+
+    // The BTC market shouldn't have to wait for the LTC market.
+    btcAsk := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI,          BasisCoin:"USD", Price:100*USATOSHI}
+    btcBid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,  Coin:"BTC", BasisAmount:100*USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    exchange.AddOrder(btcAsk)
+    exchange.AddOrder(btcBid)
+    if btcMarket.QueueDepth() != 2 { t.Fatalf("Expected 2 queued BTC orders, got %v", btcMarket.QueueDepth()) }
+
+    btcMarket.ProcessNextOrder()
+    btcMarket.ProcessNextOrder()
+    ensureOrderStatus(t, btcAsk, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, btcBid, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, ltcAsk, exchange.ORDER_STATUS_PENDING)
+    ensureOrderStatus(t, ltcBid, exchange.ORDER_STATUS_PENDING)
+    if ltcMarket.QueueDepth() != 2 { t.Fatalf("Expected 2 queued LTC orders, got %v", ltcMarket.QueueDepth()) }
+
+    // Now run both markets at the same time.
+    btcAsk2 := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI/2,        BasisCoin:"USD", Price:100*USATOSHI}
+    btcBid2 := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,  Coin:"BTC", BasisAmount:50*USATOSHI,  BasisCoin:"USD", Price:100*USATOSHI}
+    DepositMoneyForUser(seller, "BTC", USATOSHI/2)
+    DepositMoneyForUser(buyer, "USD", 50*USATOSHI)
+    exchange.AddOrder(btcAsk2)
+    exchange.AddOrder(btcBid2)
+
+    var wg sync.WaitGroup
+    for _, market := range []*exchange.Market{btcMarket, ltcMarket} {
+        wg.Add(1)
+        go func(market *exchange.Market) {
+            defer wg.Done()
+            for i:=0; i<2; i++ {
+                order := market.ProcessNextOrder()
+                if order.MarketName() != market.Name() {
+                    t.Errorf("Market %v processed order for market %v", market.Name(), order.MarketName())
+                }
+            }
+        }(market)
+    }
+    wg.Wait()
+
+    ensureOrderStatus(t, ltcAsk, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, ltcBid, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, btcAsk2, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, btcBid2, exchange.ORDER_STATUS_COMPLETE)
+
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{
+        "USD": 160*SATOSHI,
+    })
+    EnsureBalances(t, buyer.Id, account.WALLET_MAIN, map[string]int64{
+        "BTC": SATOSHI+SATOSHI/2,
+        "LTC": SATOSHI,
+        "USD": 90*SATOSHI,
+    })
+}
+
+func addAndProcessOrder(order *exchange.Order) {
+    exchange.AddOrder(order)
+    order.Market().ProcessNextOrder()
+}
+
+func TestMarketOrderSweepsBook(t *testing.T) {
+    market := exchange.Markets["BTC/USD"]
+
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "BTC", 2*USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 200*USATOSHI)
+
+    ask1 := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    ask2 := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:110*USATOSHI}
+    addAndProcessOrder(ask1)
+    addAndProcessOrder(ask2)
+
+    // Buy 1.5 BTC at whatever it costs.
+    bid := &exchange.Order{Type:"B", Kind:"M", UserId:buyer.Id, Coin:"BTC", Amount:USATOSHI+USATOSHI/2, BasisCoin:"USD"}
+    if !market.EstimateMarketOrder(bid) { t.Fatal("Expected the book to fill the market order") }
+    if bid.BasisAmount < 155*USATOSHI { t.Fatalf("Market order reserved too little: %v", bid.BasisAmount) }
+    addAndProcessOrder(bid)
+
+    ensureOrderStatus(t, ask1, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, ask2, exchange.ORDER_STATUS_PENDING)
+    ensureOrderStatus(t, bid,  exchange.ORDER_STATUS_COMPLETE)
+
+    // The unused reservation should have been released.
+    EnsureBalances(t, buyer.Id, account.WALLET_MAIN, map[string]int64{
+        "BTC": SATOSHI+SATOSHI/2,
+        "USD": 45*SATOSHI,
+    })
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+
+    // Selling into an empty book cancels the remainder.
+    exchange.CancelOrder(ask2)
+    market.ProcessNextOrder()
+    ask3 := &exchange.Order{Type:"A", Kind:"M", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI/2, BasisCoin:"USD"}
+    addAndProcessOrder(ask3)
+    ensureOrderStatus(t, ask3, exchange.ORDER_STATUS_CANCELED)
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestPriceBandStopsSweep(t *testing.T) {
+    market := exchange.Markets["BTC/USD"]
+    defer func(pct float64, reference uint64) {
+        market.PriceBandPct, market.ReferencePrice = pct, reference
+    }(market.PriceBandPct, market.ReferencePrice)
+    market.PriceBandPct = 10
+    market.ReferencePrice = 100*USATOSHI
+    reference := market.BandReferencePrice()
+    farPrice := (reference + reference/5) / market.TickSize * market.TickSize
+
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "BTC", 2*USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 3*farPrice)
+
+    ask1 := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:reference}
+    ask2 := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:farPrice}
+    addAndProcessOrder(ask1)
+    addAndProcessOrder(ask2)
+
+    // The sweep stops short of ask2, which is 20% away.
+    bid := &exchange.Order{Type:"B", Kind:"M", UserId:buyer.Id, Coin:"BTC", Amount:2*USATOSHI, BasisCoin:"USD"}
+    if !market.EstimateMarketOrder(bid) { t.Fatal("Expected the book to fill the market order") }
+    addAndProcessOrder(bid)
+
+    ensureOrderStatus(t, ask1, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, ask2, exchange.ORDER_STATUS_PENDING)
+    ensureOrderStatus(t, bid,  exchange.ORDER_STATUS_CANCELED)
+    EnsureBalances(t, buyer.Id, account.WALLET_MAIN, map[string]int64{
+        "BTC": SATOSHI,
+        "USD": int64(3*farPrice - reference),
+    })
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+
+    exchange.CancelOrder(ask2)
+    market.ProcessNextOrder()
+}
+
+func TestTimeInForce(t *testing.T) {
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", 2*USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 100*USATOSHI)
+
+    ask := &exchange.Order{Type:"A", Kind:"L", TimeInForce:"G", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(ask)
+
+    // Post-only orders that would take get canceled.
+    postOnly := &exchange.Order{Type:"B", Kind:"L", TimeInForce:"P", UserId:buyer.Id, Coin:"LTC", BasisAmount:10*USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(postOnly)
+    ensureOrderStatus(t, postOnly, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_PENDING)
+
+    // Fill or kill orders that can't fill completely get canceled.
+    fok := &exchange.Order{Type:"B", Kind:"L", TimeInForce:"F", UserId:buyer.Id, Coin:"LTC", BasisAmount:20*USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(fok)
+    ensureOrderStatus(t, fok, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_PENDING)
+
+    // Immediate or cancel orders fill what they can, and the rest gets canceled.
+    ioc := &exchange.Order{Type:"B", Kind:"L", TimeInForce:"I", UserId:buyer.Id, Coin:"LTC", BasisAmount:20*USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(ioc)
+    ensureOrderStatus(t, ioc, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_COMPLETE)
+
+    // Expired good till time orders get canceled.
+    gtt := &exchange.Order{Type:"A", Kind:"L", TimeInForce:"T", ExpireTime:1, UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(gtt)
+    ensureOrderStatus(t, gtt, exchange.ORDER_STATUS_CANCELED)
+
+    EnsureBalances(t, buyer.Id, account.WALLET_MAIN, map[string]int64{
+        "LTC": SATOSHI,
+        "USD": 90*SATOSHI,
+    })
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func expectPanic(t *testing.T, msg string, f func()) {
+    defer func() {
+        if recover() == nil { t.Error(msg) }
+    }()
+    f()
+}
+
+// Opening a market may go through an auction, which uncrosses on the market's goroutine.
+func openMarket(market *exchange.Market) {
+    market.SetState(exchange.MARKET_STATE_OPEN)
+    if market.State() == exchange.MARKET_STATE_AUCTION { market.ProcessNextOrder() }
+}
+
+func TestMarketStates(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+    defer openMarket(market)
+
+    seller := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", 2*USATOSHI)
+
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(ask)
+
+    // Halted markets take neither orders nor cancellations.
+    market.SetState(exchange.MARKET_STATE_HALTED)
+    ask2 := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    expectPanic(t, "Expected AddOrder to fail for a halted market", func() { exchange.AddOrder(ask2) })
+    if ask2.Id != 0 { t.Errorf("Expected the order not to be saved") }
+    expectPanic(t, "Expected CancelOrder to fail for a halted market", func() { exchange.CancelOrder(ask) })
+
+    // Cancel-only markets take cancellations.
+    market.SetState(exchange.MARKET_STATE_CANCEL_ONLY)
+    expectPanic(t, "Expected AddOrder to fail for a cancel-only market", func() { exchange.AddOrder(ask2) })
+    exchange.CancelOrder(ask)
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_CANCELED)
+
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{"LTC": 2*SATOSHI})
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestCallAuction(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+    defer openMarket(market)
+
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", 2*USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 23*USATOSHI)
+
+    // Nothing matches during the auction, so the book crosses.
+    market.SetState(exchange.MARKET_STATE_AUCTION)
+    ask1 := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    ask2 := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:11*USATOSHI}
+    bid1 := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,  Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:12*USATOSHI}
+    bid2 := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,  Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:11*USATOSHI}
+    for _, order := range []*exchange.Order{ask1, ask2, bid1, bid2} {
+        addAndProcessOrder(order)
+        ensureOrderStatus(t, order, exchange.ORDER_STATUS_PENDING)
+    }
+    indicative := market.Indicative()
+    if indicative == nil || indicative.Price != 11*USATOSHI || indicative.Volume != 2*USATOSHI {
+        t.Fatalf("Expected to uncross 2 at 11, got %v", indicative)
+    }
+
+    // Everything trades at 11, then continuous trading resumes.
+    openMarket(market)
+    if market.State() != exchange.MARKET_STATE_OPEN { t.Errorf("Expected the market to be open") }
+    if market.Indicative() != nil { t.Errorf("Expected no indicative price after the uncross") }
+    for _, order := range []*exchange.Order{ask1, ask2, bid1, bid2} {
+        ensureOrderStatus(t, order, exchange.ORDER_STATUS_COMPLETE)
+    }
+    EnsureBalances(t, buyer.Id, account.WALLET_MAIN, map[string]int64{
+        "LTC": 2*SATOSHI,
+        "USD": 1*SATOSHI,
+    })
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{
+        "USD": 22*SATOSHI,
+    })
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestIcebergOrder(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+
+    seller := GenerateRandomUser()
+    seller2 := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", 3*USATOSHI)
+    DepositMoneyForUser(seller2, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 30*USATOSHI)
+
+    iceberg := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:3*USATOSHI, DisplayAmount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:seller2.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(iceberg)
+    addAndProcessOrder(ask)
+    if amount := levelAmount(market.Asks, 10*USATOSHI); amount != 2*USATOSHI {
+        t.Errorf("Expected the book to show 2 at 10, got %v", amount)
+    }
+
+    // The iceberg's slice fills first, then the refreshed slice waits behind ask.
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:15*USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(bid)
+    ensureOrderStatus(t, bid, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_PENDING)
+    if loaded := exchange.LoadOrder(iceberg.Id); loaded.Filled != USATOSHI || loaded.Priority <= ask.Id {
+        t.Errorf("Expected the iceberg to fill one slice & lose priority, got %v filled at priority %v", loaded.Filled, loaded.Priority)
+    }
+    if loaded := exchange.LoadOrder(ask.Id); loaded.Filled != USATOSHI/2 {
+        t.Errorf("Expected ask to fill the rest, got %v", loaded.Filled)
+    }
+    if amount := levelAmount(market.Asks, 10*USATOSHI); amount != USATOSHI + USATOSHI/2 {
+        t.Errorf("Expected the book to show 1.5 at 10, got %v", amount)
+    }
+
+    exchange.CancelOrder(iceberg)
+    market.ProcessNextOrder()
+    exchange.CancelOrder(ask)
+    market.ProcessNextOrder()
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{
+        "LTC": 2*SATOSHI,
+        "USD": 10*SATOSHI,
+    })
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+// The total shown in the book at price.
+func levelAmount(book *llrb.LLRB, price uint64) uint64 {
+    total := uint64(0)
+    book.AscendGreaterOrEqual(book.Min(), func(i llrb.Item) bool {
+        order := i.(*exchange.Order)
+        if order.Price == price { total += exchange.BookAmount(order) }
+        return true
+    })
+    return total
+}
+
+func TestOrderGroup(t *testing.T) {
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    // Enough for one member, since the group reserves once.
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 20*USATOSHI)
+
+    // Take profit at 20, or stop the loss at 5.
+    takeProfit := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:20*USATOSHI}
+    stopLoss := &exchange.Order{Type:"A", Kind:"S", StopPrice:5*USATOSHI, UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD"}
+    group := exchange.AddOrderGroup(exchange.ORDER_GROUP_BRACKET, []*exchange.Order{takeProfit, stopLoss})
+    market := takeProfit.Market()
+    market.ProcessNextOrder()
+    market.ProcessNextOrder()
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"LTC": SATOSHI})
+
+    // Half the take-profit fills, so half the stop-loss goes.
+    addAndProcessOrder(&exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:10*USATOSHI, BasisCoin:"USD", Price:20*USATOSHI})
+    if loaded := exchange.LoadOrder(stopLoss.Id); loaded.Status != exchange.ORDER_STATUS_PENDING || loaded.Amount != USATOSHI/2 {
+        t.Errorf("Expected the stop-loss to shrink to 0.5, got %v with status %v", loaded.Amount, loaded.Status)
+    }
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"LTC": SATOSHI/2})
+
+    // The rest fills, which cancels the stop-loss.
+    addAndProcessOrder(&exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:10*USATOSHI, BasisCoin:"USD", Price:20*USATOSHI})
+    ensureOrderStatus(t, takeProfit, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, stopLoss, exchange.ORDER_STATUS_CANCELED)
+    if groups := exchange.LoadPendingOrderGroupsByUser(seller.Id, "USD", "LTC"); len(groups) != 0 {
+        t.Errorf("Expected group %v to be done, got %v pending", group.Id, len(groups))
+    }
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{"USD": 20*SATOSHI})
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestAmendOrder(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+
+    seller := GenerateRandomUser()
+    seller2 := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(seller2, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 10*USATOSHI)
+
+    first := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    second := &exchange.Order{Type:"A", Kind:"L", UserId:seller2.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(first)
+    addAndProcessOrder(second)
+
+    // Halving first releases half its reserve & keeps its place.
+    exchange.AmendOrder(first, &exchange.Amendment{Amount:USATOSHI/2})
+    market.ProcessNextOrder()
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"LTC": SATOSHI/2})
+    if amount := levelAmount(market.Asks, 10*USATOSHI); amount != USATOSHI + USATOSHI/2 {
+        t.Errorf("Expected the book to show 1.5 at 10, got %v", amount)
+    }
+    addAndProcessOrder(&exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:5*USATOSHI, BasisCoin:"USD", Price:10*USATOSHI})
+    ensureOrderStatus(t, first, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, second, exchange.ORDER_STATUS_PENDING)
+
+    // Increases need the funds.
+    expectPanic(t, "Expected an increase past the balance to fail", func() {
+        exchange.AmendOrder(exchange.LoadOrder(second.Id), &exchange.Amendment{Amount:2*USATOSHI})
+    })
+
+    // Repricing second makes it cross the bid at 9.
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:9*USATOSHI/2, BasisCoin:"USD", Price:9*USATOSHI}
+    addAndProcessOrder(bid)
+    exchange.AmendOrder(exchange.LoadOrder(second.Id), &exchange.Amendment{Price:9*USATOSHI})
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, bid, exchange.ORDER_STATUS_COMPLETE)
+    if loaded := exchange.LoadOrder(second.Id); loaded.Price != 9*USATOSHI || loaded.Filled != USATOSHI/2 {
+        t.Errorf("Expected second to fill 0.5 at 9, got %v at %v", loaded.Filled, loaded.Price)
+    }
+
+    exchange.CancelOrder(second)
+    market.ProcessNextOrder()
+    EnsureBalances(t, seller2.Id, account.WALLET_MAIN, map[string]int64{
+        "LTC": SATOSHI/2,
+        "USD": 9*SATOSHI/2,
+    })
+    EnsureBalances(t, seller2.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestClientOrderId(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+
+    seller := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+
+    // A retried submission gets the first order back, and reserves nothing more.
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI, ClientId:"retry-1"}
+    addAndProcessOrder(ask)
+    retry := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI, ClientId:"retry-1"}
+    if saved := exchange.AddOrder(retry); saved.Id != ask.Id {
+        t.Errorf("Expected the retry to return order %v, got %v", ask.Id, saved.Id)
+    }
+    if market.QueueDepth() != 0 { t.Errorf("Expected the retry not to get queued") }
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"LTC": SATOSHI})
+
+    // Client ids are per user.
+    other := GenerateRandomUser()
+    DepositMoneyForUser(other, "LTC", USATOSHI)
+    otherAsk := &exchange.Order{Type:"A", Kind:"L", UserId:other.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI, ClientId:"retry-1"}
+    addAndProcessOrder(otherAsk)
+    if otherAsk.Id == ask.Id { t.Errorf("Expected another user's order with the same client id to get saved") }
+
+    for _, order := range []*exchange.Order{ask, otherAsk} {
+        exchange.CancelOrder(exchange.LoadOrderByClientId(order.UserId, "retry-1"))
+        market.ProcessNextOrder()
+        ensureOrderStatus(t, order, exchange.ORDER_STATUS_CANCELED)
+    }
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+// Calls handler with params, & returns the response it panics with, see ReturnJSON().
+func callHandler(handler func(http.ResponseWriter, *http.Request, *auth.User), user *auth.User, params url.Values) (res APIResponse) {
+    defer func() { res = recover().(APIResponse) }()
+    handler(nil, &http.Request{Method:"GET", URL:&url.URL{RawQuery:params.Encode()}, Header:http.Header{}}, user)
+    return
+}
+
+// Processes what's queued in market.
+func drainQueue(market *exchange.Market) {
+    for market.QueueDepth() > 0 { market.ProcessNextOrder() }
+}
+
+func TestExpireOrders(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+    btcMarket := exchange.Markets["BTC/USD"]
+    defer openMarket(btcMarket)
+
+    // More than a page of them, & one in a market that gets halted.
+    user := GenerateRandomUser()
+    DepositMoneyForUser(user, "LTC", 2*USATOSHI)
+    DepositMoneyForUser(user, "BTC", USATOSHI)
+    now := time.Now().Unix()
+    gtts := []*exchange.Order{}
+    for i := 0; i < exchange.EXPIRE_ORDERS_PAGE+1; i++ {
+        gtt := &exchange.Order{Type:"A", Kind:"L", TimeInForce:"T", ExpireTime:now+100, UserId:user.Id, Coin:"LTC", Amount:USATOSHI/100, BasisCoin:"USD", Price:1000*USATOSHI}
+        addAndProcessOrder(gtt)
+        gtts = append(gtts, gtt)
+    }
+    halted := &exchange.Order{Type:"A", Kind:"L", TimeInForce:"T", ExpireTime:now+100, UserId:user.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:100000*USATOSHI}
+    addAndProcessOrder(halted)
+    btcMarket.SetState(exchange.MARKET_STATE_HALTED)
+
+    // Nothing has expired yet.
+    expirer := exchange.NewOrderExpirer()
+    if expired := expirer.ExpireOrders(now); expired["LTC/USD"] != 0 {
+        t.Errorf("Expected nothing to expire yet, got %v", expired)
+    }
+
+    // All of them expire, past the first page, but not in the halted market.
+    expired := expirer.ExpireOrders(now+200)
+    if expired["LTC/USD"] < len(gtts) || expired["BTC/USD"] != 0 {
+        t.Errorf("Expected at least %v LTC orders & no BTC orders to expire, got %v", len(gtts), expired)
+    }
+    // The ones queued don't get queued again.
+    if again := expirer.ExpireOrders(now+200); again["LTC/USD"] != 0 {
+        t.Errorf("Expected queued orders to stay queued once, got %v more", again["LTC/USD"])
+    }
+    drainQueue(market)
+    for _, gtt := range gtts { ensureOrderStatus(t, gtt, exchange.ORDER_STATUS_CANCELED) }
+    ensureOrderStatus(t, halted, exchange.ORDER_STATUS_PENDING)
+    EnsureBalances(t, user.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"BTC": SATOSHI})
+
+    // The halted market's order expires once it reopens.
+    openMarket(btcMarket)
+    if expired := expirer.ExpireOrders(now+200); expired["BTC/USD"] < 1 {
+        t.Errorf("Expected the BTC order to expire, got %v", expired)
+    }
+    drainQueue(btcMarket)
+    ensureOrderStatus(t, halted, exchange.ORDER_STATUS_CANCELED)
+    EnsureBalances(t, user.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestBatchOrders(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+    btcMarket := exchange.Markets["BTC/USD"]
+
+    user := GenerateRandomUser()
+    DepositMoneyForUser(user, "LTC", USATOSHI)
+    DepositMoneyForUser(user, "BTC", USATOSHI)
+    resting := &exchange.Order{Type:"A", Kind:"L", UserId:user.Id, Coin:"LTC", Amount:USATOSHI/2, BasisCoin:"USD", Price:1000*USATOSHI}
+    elsewhere := &exchange.Order{Type:"A", Kind:"L", UserId:user.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:100000*USATOSHI}
+    addAndProcessOrder(resting)
+    addAndProcessOrder(elsewhere)
+
+    // An add, a cancel, a cancel from another market, a bad item, & an add past the balance.
+    items := fmt.Sprintf(`[
+        {"action":"add", "order_type":"A", "amount":%v, "price":1001},
+        {"action":"cancel", "id":%v},
+        {"action":"cancel", "id":%v},
+        {"action":"move"},
+        {"action":"add", "order_type":"A", "amount":%v, "price":1002}
+    ]`, 4*USATOSHI/10, resting.Id, elsewhere.Id, USATOSHI)
+    res := callHandler(exchange.BatchOrdersHandler, user, url.Values{"market":{"LTC/USD"}, "items":{items}})
+    if res.Status != API_OK { t.Fatalf("Expected the batch to go through, got %v", res) }
+    results := res.Data.([]exchange.BatchResult)
+    if len(results) != 5 { t.Fatalf("Expected a result per item, got %v", results) }
+    for i, failed := range []bool{false, false, true, true, true} {
+        if (results[i].Error != "") != failed { t.Errorf("Expected item %v to fail: %v, got %v", i, failed, results[i]) }
+    }
+    if results[4].Error != "Insufficient funds" { t.Errorf("Expected the last add to be underfunded, got %v", results[4].Error) }
+
+    // Only the add & the cancel got queued, & the failed items left nothing behind.
+    if market.QueueDepth() != 2 || btcMarket.QueueDepth() != 0 {
+        t.Fatalf("Expected 2 queued LTC orders & no BTC ones, got %v & %v", market.QueueDepth(), btcMarket.QueueDepth())
+    }
+    market.ProcessNextOrder()
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, results[0].Order, exchange.ORDER_STATUS_PENDING)
+    ensureOrderStatus(t, resting, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, elsewhere, exchange.ORDER_STATUS_PENDING)
+    if pending := exchange.LoadPendingOrdersByUser(user.Id, "USD", "LTC"); len(pending) != 1 {
+        t.Errorf("Expected only the first add to be pending, got %v", len(pending))
+    }
+    EnsureBalances(t, user.Id, account.WALLET_RESERVED_ORDER, map[string]int64{
+        "LTC": 4*SATOSHI/10,
+        "BTC": SATOSHI,
+    })
+    exchange.CancelAllOrders(user.Id, []*exchange.Market{market, btcMarket}, "")
+    market.ProcessNextOrder()
+    btcMarket.ProcessNextOrder()
+}
+
+func TestCancelAllOrders(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+
+    user := GenerateRandomUser()
+    DepositMoneyForUser(user, "LTC", 2*USATOSHI)
+    DepositMoneyForUser(user, "USD", 10*USATOSHI)
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:user.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    ask2 := &exchange.Order{Type:"A", Kind:"L", UserId:user.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:101*USATOSHI}
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:user.Id, Coin:"LTC", BasisAmount:USATOSHI, BasisCoin:"USD", Price:USATOSHI}
+    addAndProcessOrder(ask)
+    addAndProcessOrder(ask2)
+    addAndProcessOrder(bid)
+
+    // Only the asks.
+    canceled, halted := exchange.CancelAllOrders(user.Id, []*exchange.Market{market}, "A")
+    if len(canceled) != 2 || len(halted) != 0 { t.Fatalf("Expected 2 asks to get canceled, got %v (%v halted)", len(canceled), len(halted)) }
+    market.ProcessNextOrder()
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, ask2, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, bid, exchange.ORDER_STATUS_PENDING)
+
+    // Halted markets keep their orders.
+    market.SetState(exchange.MARKET_STATE_HALTED)
+    canceled, halted = exchange.CancelAllOrders(user.Id, []*exchange.Market{market}, "")
+    openMarket(market)
+    if len(canceled) != 0 || len(halted) != 1 { t.Errorf("Expected the bid to stay while halted, got %v canceled", len(canceled)) }
+
+    exchange.CancelAllOrders(user.Id, []*exchange.Market{market}, "")
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, bid, exchange.ORDER_STATUS_CANCELED)
+    EnsureBalances(t, user.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestLoadMore(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+
+    // Asks above the rest of the book, so that ask0 ends up last in the mempool.
+    seller := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", 4*USATOSHI)
+    asks := []*exchange.Order{}
+    for i := uint64(0); i < 4; i++ {
+        ask := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:(10000+i)*USATOSHI}
+        addAndProcessOrder(ask)
+        asks = append(asks, ask)
+    }
+
+    // Leave the last two out of the mempool, as if it didn't hold the whole book.
+    market.DropOrderFromMempool(asks[2])
+    market.DropOrderFromMempool(asks[3])
+    market.HasMoreAsks = true
+
+    // Canceling asks[1] refills the asks, including those after it.
+    exchange.CancelOrder(asks[1])
+    market.ProcessNextOrder()
+    for _, ask := range asks[2:] {
+        if levelAmount(market.Asks, ask.Price) != ask.Amount { t.Errorf("Expected ask %v to be loaded back into the mempool", ask.Id) }
+    }
+    if market.HasMoreAsks { t.Errorf("Expected no more asks to load") }
+
+    exchange.CancelAllOrders(seller.Id, []*exchange.Market{market}, "")
+    drainQueue(market)
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestHeartbeat(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+
+    user := GenerateRandomUser()
+    DepositMoneyForUser(user, "LTC", USATOSHI)
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:user.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    addAndProcessOrder(ask)
+    apiKey := auth.LoadAPIKeysByUser(user.Id)[0].Key
+
+    // Fires only once a deadline passes without a heartbeat.
+    firedFor := func(now int64) (fired *exchange.AutoCancel) {
+        for _, autoCancel := range exchange.FireHeartbeats(now) {
+            if autoCancel.UserId == user.Id { fired = autoCancel }
+        }
+        return
+    }
+    now := time.Now().Unix()
+    exchange.SendHeartbeat(user.Id, apiKey, 60, now)
+    if firedFor(now + 59) != nil { t.Errorf("Expected nothing to fire before the deadline") }
+    exchange.SendHeartbeat(user.Id, apiKey, 60, now + 30)
+    if firedFor(now + 60) != nil { t.Errorf("Expected the renewed heartbeat not to fire") }
+    fired := firedFor(now + 90)
+    if fired == nil || fired.Canceled != 1 { t.Fatalf("Expected the missed heartbeat to cancel 1 order, got %v", fired) }
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_CANCELED)
+    if firedFor(now + 200) != nil { t.Errorf("Expected the switch to disarm once fired") }
+    if autoCancels := exchange.LoadAutoCancelsByUser(user.Id, 10); len(autoCancels) != 1 {
+        t.Errorf("Expected 1 auto cancel on record, got %v", len(autoCancels))
+    }
+
+    // Orders in halted markets get canceled too, or they'd trade once it reopens.
+    defer openMarket(market)
+    ask2 := &exchange.Order{Type:"A", Kind:"L", UserId:user.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    addAndProcessOrder(ask2)
+    exchange.SendHeartbeat(user.Id, apiKey, 60, now + 300)
+    market.SetState(exchange.MARKET_STATE_HALTED)
+    fired = firedFor(now + 400)
+    if fired == nil || fired.Canceled != 1 || fired.Halted != 1 {
+        t.Fatalf("Expected the missed heartbeat to cancel 1 order in a halted market, got %v", fired)
+    }
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, ask2, exchange.ORDER_STATUS_CANCELED)
+    EnsureBalances(t, user.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestStopOrders(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+
+    seller := GenerateRandomUser()
+    seller2 := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(seller2, "LTC", USATOSHI+USATOSHI/2)
+    DepositMoneyForUser(buyer, "USD", 100*USATOSHI)
+
+    // Trade at 10.
+    addAndProcessOrder(&exchange.Order{Type:"A", Kind:"L", UserId:seller2.Id, Coin:"LTC", Amount:USATOSHI,        BasisCoin:"USD", Price:10*USATOSHI})
+    addAndProcessOrder(&exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,   Coin:"LTC", BasisAmount:10*USATOSHI, BasisCoin:"USD", Price:10*USATOSHI})
+
+    // Sell if the price falls to 9.
+    stop := &exchange.Order{Type:"A", Kind:"S", StopPrice:9*USATOSHI, UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD"}
+    addAndProcessOrder(stop)
+    if market.Triggers.Len() != 1 { t.Fatalf("Expected 1 stop order waiting, got %v", market.Triggers.Len()) }
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"LTC": SATOSHI})
+
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:9*USATOSHI, BasisCoin:"USD", Price:9*USATOSHI}
+    addAndProcessOrder(bid)
+    ensureOrderStatus(t, stop, exchange.ORDER_STATUS_PENDING)
+
+    // Trade at 9, which triggers the stop.
+    addAndProcessOrder(&exchange.Order{Type:"A", Kind:"L", UserId:seller2.Id, Coin:"LTC", Amount:USATOSHI/2, BasisCoin:"USD", Price:9*USATOSHI})
+    if market.Triggers.Len() != 0 { t.Fatalf("Expected no stop orders waiting, got %v", market.Triggers.Len()) }
+    if market.QueueDepth() != 1 { t.Fatalf("Expected the triggered stop order to be queued") }
+    market.ProcessNextOrder()
+
+    // The stop became a market order, which filled what it could & canceled the rest.
+    ensureOrderStatus(t, bid, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, stop, exchange.ORDER_STATUS_CANCELED)
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{
+        "LTC": SATOSHI/2,
+        "USD": 45*SATOSHI/10,
+    })
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+
+    // Untriggered stop orders can be canceled.
+    stopLimit := &exchange.Order{Type:"B", Kind:"T", StopPrice:20*USATOSHI, Price:21*USATOSHI, UserId:buyer.Id, Coin:"LTC", BasisAmount:21*USATOSHI, BasisCoin:"USD"}
+    addAndProcessOrder(stopLimit)
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"USD": 21*SATOSHI})
+    exchange.CancelOrder(stopLimit)
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, stopLimit, exchange.ORDER_STATUS_CANCELED)
+    if market.Triggers.Len() != 0 { t.Fatalf("Expected no stop orders waiting, got %v", market.Triggers.Len()) }
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+    market := exchange.Markets["BTC/USD"]
+
+    user := GenerateRandomUser()
+    DepositMoneyForUser(user, "BTC", 2*USATOSHI)
+    DepositMoneyForUser(user, "USD", 300*USATOSHI)
+
+    // By default the newest order gets canceled.
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:user.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    addAndProcessOrder(ask)
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:user.Id, Coin:"BTC", BasisAmount:100*USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    addAndProcessOrder(bid)
+    ensureOrderStatus(t, bid, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_PENDING)
+
+    // Cancel oldest.
+    bid2 := &exchange.Order{Type:"B", Kind:"L", SelfTradePolicy:"O", UserId:user.Id, Coin:"BTC", BasisAmount:100*USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    addAndProcessOrder(bid2)
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, bid2, exchange.ORDER_STATUS_PENDING)
+
+    // Cancel both.
+    ask2 := &exchange.Order{Type:"A", Kind:"L", SelfTradePolicy:"B", UserId:user.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    addAndProcessOrder(ask2)
+    ensureOrderStatus(t, ask2, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, bid2, exchange.ORDER_STATUS_CANCELED)
+
+    // Decrement shrinks the larger order & cancels the smaller one.
+    ask3 := &exchange.Order{Type:"A", Kind:"L", UserId:user.Id, Coin:"BTC", Amount:USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    addAndProcessOrder(ask3)
+    bid3 := &exchange.Order{Type:"B", Kind:"L", SelfTradePolicy:"D", UserId:user.Id, Coin:"BTC", BasisAmount:50*USATOSHI, BasisCoin:"USD", Price:100*USATOSHI}
+    addAndProcessOrder(bid3)
+    ensureOrderStatus(t, bid3, exchange.ORDER_STATUS_CANCELED)
+    ensureOrderStatus(t, ask3, exchange.ORDER_STATUS_PENDING)
+    if amount := exchange.LoadOrder(ask3.Id).Amount; amount != USATOSHI/2 {
+        t.Errorf("Expected ask to be decremented to %v but got %v", USATOSHI/2, amount)
+    }
+    EnsureBalances(t, user.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"BTC": SATOSHI/2})
+    exchange.CancelOrder(ask3)
+    market.ProcessNextOrder()
+
+    // Nothing traded, and every prevented trade got recorded.
+    EnsureBalances(t, user.Id, account.WALLET_MAIN, map[string]int64{
+        "BTC": 2*SATOSHI,
+        "USD": 300*SATOSHI,
+    })
+    EnsureBalances(t, user.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+    if selfTrades := exchange.LoadSelfTradesByUser(user.Id, 10); len(selfTrades) != 4 {
+        t.Errorf("Expected 4 self trades to be recorded but got %v", len(selfTrades))
+    }
+}
+
+func TestMakerTakerFees(t *testing.T) {
+    defer func(schedule map[string][]*config.FeeTier) { config.Config.FeeSchedule = schedule }(config.Config.FeeSchedule)
+    config.Config.FeeSchedule = map[string][]*config.FeeTier{
+        "USD": []*config.FeeTier{
+            &config.FeeTier{MinVolume:0, MakerRatio:-0.001, TakerRatio:0.002},
+        },
+    }
+
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 100*USATOSHI)
+
+    feesBefore := account.LoadBalances(account.SYSTEM_USER_ID, account.WALLET_FEES)["USD"]
+
+    // The seller makes, the buyer takes.
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    addAndProcessOrder(ask)
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:10*USATOSHI, BasisCoin:"USD", Price:10*USATOSHI}
+    exchange.AddOrder(bid)
+    if bid.BasisFee != 2*USATOSHI/100 { t.Errorf("Expected the bid to reserve the taker fee, got %v", bid.BasisFee) }
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"USD": 1002*SATOSHI/100})
+    bid.Market().ProcessNextOrder()
+
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_COMPLETE)
+    ensureOrderStatus(t, bid, exchange.ORDER_STATUS_COMPLETE)
+
+    // The taker pays 0.2%, the maker gets a 0.1% rebate.
+    EnsureBalances(t, buyer.Id, account.WALLET_MAIN, map[string]int64{
+        "LTC": SATOSHI,
+        "USD": 8998*SATOSHI/100,
+    })
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{
+        "USD": 1001*SATOSHI/100,
+    })
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+
+    // The exchange keeps the difference.
+    feesAfter := account.LoadBalances(account.SYSTEM_USER_ID, account.WALLET_FEES)["USD"]
+    if feesAfter - feesBefore != SATOSHI/100 {
+        t.Errorf("Expected %v USD in fees but got %v", SATOSHI/100, feesAfter - feesBefore)
+    }
+}
+
+func TestCrossPairMarket(t *testing.T) {
+    market := exchange.Markets["LTC/BTC"]
+    if market == nil { t.Fatalf("Expected the LTC/BTC market to be loaded") }
+    if market.BasisMinTrade != config.Config.GetCoin("BTC").MinTrade {
+        t.Errorf("Expected the BTC MinTrade of %v but got %v", config.Config.GetCoin("BTC").MinTrade, market.BasisMinTrade)
+    }
+    if market.PriceLogger.Market != "LTC/BTC" { t.Errorf("Expected the price log for LTC/BTC but got %v", market.PriceLogger.Market) }
+
+    defer func(schedule map[string][]*config.FeeTier) { config.Config.FeeSchedule = schedule }(config.Config.FeeSchedule)
+    config.Config.FeeSchedule = map[string][]*config.FeeTier{
+        "BTC": []*config.FeeTier{
+            &config.FeeTier{MinVolume:0, MakerRatio:0.001, TakerRatio:0.002},
+        },
+    }
+
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "BTC", 5*USATOSHI/100)
+
+    feesBefore := account.LoadBalances(account.SYSTEM_USER_ID, account.WALLET_FEES)["BTC"]
+
+    // 1 LTC at 0.02 BTC, of which the buyer takes 0.01 BTC worth.
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"BTC", Price:2*USATOSHI/100}
+    addAndProcessOrder(ask)
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"LTC": SATOSHI})
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:USATOSHI/100, BasisCoin:"BTC", Price:2*USATOSHI/100}
+    exchange.AddOrder(bid)
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"BTC": 1002000})
+    bid.Market().ProcessNextOrder()
+
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_PENDING)
+    ensureOrderStatus(t, bid, exchange.ORDER_STATUS_COMPLETE)
+
+    // Fees are in BTC, the basis coin: 0.2% for the taker, 0.1% for the maker.
+    EnsureBalances(t, buyer.Id, account.WALLET_MAIN, map[string]int64{
+        "LTC": SATOSHI/2,
+        "BTC": 3998000,
+    })
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{
+        "BTC": 999000,
+    })
+    EnsureBalances(t, buyer.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{"LTC": SATOSHI/2})
+    feesAfter := account.LoadBalances(account.SYSTEM_USER_ID, account.WALLET_FEES)["BTC"]
+    if feesAfter - feesBefore != 3000 {
+        t.Errorf("Expected 3000 BTC satoshis in fees but got %v", feesAfter - feesBefore)
+    }
+    if market.PriceLogger.LastPrice() != 2*USATOSHI/100 {
+        t.Errorf("Expected the last price to be %v but got %v", 2*USATOSHI/100, market.PriceLogger.LastPrice())
+    }
+
+    // Canceling the rest releases the LTC.
+    exchange.CancelOrder(ask)
+    market.ProcessNextOrder()
+    ensureOrderStatus(t, ask, exchange.ORDER_STATUS_CANCELED)
+    EnsureBalances(t, seller.Id, account.WALLET_RESERVED_ORDER, map[string]int64{})
+    EnsureBalances(t, seller.Id, account.WALLET_MAIN, map[string]int64{
+        "LTC": SATOSHI/2,
+        "BTC": 999000,
+    })
+}
+
+func TestJournal(t *testing.T) {
+    market := exchange.Markets["LTC/BTC"]
+
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "BTC", USATOSHI/10)
+
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"BTC", Price:2*USATOSHI/100}
+    addAndProcessOrder(ask)
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", Amount:4*USATOSHI/10, BasisCoin:"BTC", Price:2*USATOSHI/100}
+    addAndProcessOrder(bid)
+    exchange.AmendOrder(exchange.LoadOrder(ask.Id), &exchange.Amendment{Amount:8*USATOSHI/10})
+    market.ProcessNextOrder()
+    rest := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", Amount:USATOSHI/10, BasisCoin:"BTC", Price:USATOSHI/100}
+    addAndProcessOrder(rest)
+    exchange.CancelOrder(rest)
+    market.ProcessNextOrder()
+
+    // The journal adds up to what the DB has.
+    check := exchange.CheckJournal("BTC", "LTC")
+    if problems := check.Problems(); len(problems) != 0 { t.Errorf("Expected the journal to add up, got %v", problems) }
+    if diffs := check.Diff(); len(diffs) != 0 { t.Errorf("Expected the journal to match the DB, got %v", diffs) }
+    trade := exchange.LoadRecentTrades("BTC", "LTC", 1)[0]
+    if check.Trades[trade.Id] == nil || trade.BidOrderId != bid.Id { t.Errorf("Expected the trade to be journaled") }
+    if checked := check.Orders[rest.Id]; checked == nil || checked.Status != exchange.ORDER_STATUS_CANCELED {
+        t.Errorf("Expected the cancellation to be journaled, got %v", checked)
+    }
+
+    // And rebuilds the book the market has.
+    asks, _ := check.LimitOrders(exchange.ORDER_TYPE_ASK, 1000, ask.Id)
+    found := false
+    for _, checked := range asks {
+        if checked.Id != ask.Id { continue }
+        found = true
+        if checked.Amount != 8*USATOSHI/10 || checked.Filled != 4*USATOSHI/10 {
+            t.Errorf("Expected the ask to have 0.4 of 0.8 filled, got %v of %v", checked.Filled, checked.Amount)
+        }
+    }
+    if !found { t.Errorf("Expected the ask to be in the rebuilt book") }
+    if bids, _ := check.LimitOrders(exchange.ORDER_TYPE_BID, 1000, rest.Id); len(bids) != market.Bids.Len() {
+        t.Errorf("Expected %v bids in the rebuilt book, got %v", market.Bids.Len(), len(bids))
+    }
+
+    exchange.CancelOrder(ask)
+    market.ProcessNextOrder()
+}
+
+// Returns the next event on channel, failing if there isn't one.
+// Events on other channels are skipped.
+func nextFeedEvent(t *testing.T, sub *feed.Subscriber, channel string) *feed.Event {
+    for {
+        select {
+        case event := <-sub.Events:
+            if event.Channel == channel { return event }
+        default:
+            t.Fatalf("Expected an event on %v", channel)
+        }
+    }
+}
+
+func TestFeed(t *testing.T) {
+    market := exchange.Markets["LTC/USD"]
+
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 100*USATOSHI)
+
+    // Rest inside the spread, so nothing else is at our price level.
+    price := market.BestBidPrice() + market.TickSize
+    if market.BestBidPrice() == 0 { price = 10*USATOSHI }
+    if market.BestAskPrice() != 0 && market.BestAskPrice() <= price { t.Fatalf("No room in the spread for the test") }
+
+    bookChannel := feed.MarketChannel(feed.CHANNEL_BOOK, "LTC/USD")
+    tradesChannel := feed.MarketChannel(feed.CHANNEL_TRADES, "LTC/USD")
+    ordersChannel := feed.UserChannel(feed.CHANNEL_ORDERS, seller.Id)
+    balancesChannel := feed.UserChannel(feed.CHANNEL_BALANCES, buyer.Id)
+    sub := feed.NewSubscriber()
+    defer sub.Close()
+    bookSeq := sub.Subscribe(bookChannel)
+    tradesSeq := sub.Subscribe(tradesChannel)
+    ordersSeq := sub.Subscribe(ordersChannel)
+    balancesSeq := sub.Subscribe(balancesChannel)
+
+    checkSeq := func(event *feed.Event, lastSeq *int64) {
+        if event.Seq != *lastSeq + 1 { t.Errorf("Expected seq %v on %v but got %v", *lastSeq + 1, event.Channel, event.Seq) }
+        *lastSeq = event.Seq
+    }
+
+    // The ask gets saved, then rests on the book.
+    ask := &exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:price}
+    addAndProcessOrder(ask)
+    event := nextFeedEvent(t, sub, ordersChannel)
+    checkSeq(event, &ordersSeq)
+    if event.Data.(*exchange.Order).Id != ask.Id { t.Errorf("Expected an order event for the ask") }
+    event = nextFeedEvent(t, sub, bookChannel)
+    checkSeq(event, &bookSeq)
+    if *event.Data.(*exchange.BookDelta) != (exchange.BookDelta{Type:"A", Price:price, Amount:USATOSHI}) {
+        t.Errorf("Unexpected book delta %v", *event.Data.(*exchange.BookDelta))
+    }
+
+    // Half of it gets bought.
+    bid := &exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id, Coin:"LTC", BasisAmount:exchange.BasisForAmount(USATOSHI/2, price), BasisCoin:"USD", Price:price}
+    addAndProcessOrder(bid)
+    event = nextFeedEvent(t, sub, tradesChannel)
+    checkSeq(event, &tradesSeq)
+    trade := event.Data.(*exchange.STrade)
+    if trade.Type != "B" || trade.Amount != USATOSHI/2 || trade.Price != price {
+        t.Errorf("Unexpected trade %v", *trade)
+    }
+    event = nextFeedEvent(t, sub, ordersChannel)
+    checkSeq(event, &ordersSeq)
+    if event.Data.(*exchange.Order).Filled != USATOSHI/2 { t.Errorf("Expected the ask to be half filled") }
+    event = nextFeedEvent(t, sub, bookChannel)
+    checkSeq(event, &bookSeq)
+    if event.Data.(*exchange.BookDelta).Amount != USATOSHI/2 { t.Errorf("Expected half the level to remain") }
+
+    // The buyer saw every balance change, ending with the LTC.
+    var lastBalance *account.Balance
+    for {
+        select {
+        case event = <-sub.Events:
+            if event.Channel != balancesChannel { continue }
+            checkSeq(event, &balancesSeq)
+            lastBalance = event.Data.(*account.Balance)
+            continue
+        default:
+        }
+        break
+    }
+    if lastBalance == nil { t.Fatalf("Expected balance events for the buyer") }
+    if lastBalance.Coin != "LTC" || lastBalance.Wallet != account.WALLET_MAIN || lastBalance.Amount != SATOSHI/2 {
+        t.Errorf("Unexpected last balance %v", *lastBalance)
+    }
+
+    // Canceling the rest empties the level.
+    exchange.CancelOrder(ask)
+    market.ProcessNextOrder()
+    event = nextFeedEvent(t, sub, bookChannel)
+    checkSeq(event, &bookSeq)
+    if event.Data.(*exchange.BookDelta).Amount != 0 { t.Errorf("Expected the level to be gone") }
+    event = nextFeedEvent(t, sub, ordersChannel)
+    checkSeq(event, &ordersSeq)
+    if event.Data.(*exchange.Order).Status != exchange.ORDER_STATUS_CANCELED { t.Errorf("Expected the ask to be canceled") }
+}
+
+func TestTradeHistory(t *testing.T) {
+    seller := GenerateRandomUser()
+    buyer := GenerateRandomUser()
+    DepositMoneyForUser(seller, "BTC", USATOSHI)
+    DepositMoneyForUser(seller, "LTC", USATOSHI)
+    DepositMoneyForUser(buyer, "USD", 300*USATOSHI)
+
+    // The seller makes twice in BTC/USD and takes once in LTC/USD.
+    addAndProcessOrder(&exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI/2, BasisCoin:"USD", Price:100*USATOSHI})
+    addAndProcessOrder(&exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,  Coin:"BTC", BasisAmount:50*USATOSHI, BasisCoin:"USD", Price:100*USATOSHI})
+    addAndProcessOrder(&exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"BTC", Amount:USATOSHI/2, BasisCoin:"USD", Price:100*USATOSHI})
+    addAndProcessOrder(&exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,  Coin:"BTC", BasisAmount:50*USATOSHI, BasisCoin:"USD", Price:100*USATOSHI})
+    addAndProcessOrder(&exchange.Order{Type:"B", Kind:"L", UserId:buyer.Id,  Coin:"LTC", BasisAmount:10*USATOSHI, BasisCoin:"USD", Price:10*USATOSHI})
+    addAndProcessOrder(&exchange.Order{Type:"A", Kind:"L", UserId:seller.Id, Coin:"LTC", Amount:USATOSHI, BasisCoin:"USD", Price:10*USATOSHI})
+
+    // Page through all of them, two at a time.
+    page1 := exchange.LoadTradeHistory(seller.Id, "", "", 0, 0, 0, 2)
+    if len(page1) != 2 { t.Fatalf("Expected 2 trades on the first page, got %v", len(page1)) }
+    page2 := exchange.LoadTradeHistory(seller.Id, "", "", 0, 0, page1[1].Id, 2)
+    if len(page2) != 1 { t.Fatalf("Expected 1 trade on the second page, got %v", len(page2)) }
+    if !(page1[0].Id > page1[1].Id && page1[1].Id > page2[0].Id) { t.Errorf("Expected trades newest first") }
+
+    latest := page1[0].ForUser(seller.Id)
+    if latest.Coin != "LTC" || latest.Type != "A" || latest.Liquidity != exchange.TRADE_LIQUIDITY_TAKER {
+        t.Errorf("Expected the seller to have taken in LTC/USD, got %v", *latest)
+    }
+    oldest := page2[0].ForUser(buyer.Id)
+    if oldest.Coin != "BTC" || oldest.Type != "B" || oldest.Liquidity != exchange.TRADE_LIQUIDITY_TAKER {
+        t.Errorf("Expected the buyer to have taken in BTC/USD, got %v", *oldest)
+    }
+    if page2[0].ForUser(seller.Id).Liquidity != exchange.TRADE_LIQUIDITY_MAKER { t.Errorf("Expected the seller to have made") }
+
+    // Filter by market.
+    btcTrades := exchange.LoadTradeHistory(seller.Id, "USD", "BTC", 0, 0, 0, 10)
+    if len(btcTrades) != 2 { t.Errorf("Expected 2 BTC/USD trades, got %v", len(btcTrades)) }
+
+    // Filter by time.
+    future := exchange.LoadTradeHistory(seller.Id, "", "", latest.Time+1, 0, 0, 10)
+    if len(future) != 0 { t.Errorf("Expected no trades after the last one, got %v", len(future)) }
+}
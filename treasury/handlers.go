@@ -5,8 +5,10 @@ import (
     "ftnox.com/account"
     "ftnox.com/bitcoin"
     "ftnox.com/auth"
+    "ftnox.com/exchange"
     "net/http"
     "strings"
+    "time"
     "fmt"
 )
 
@@ -42,7 +44,7 @@ func StorePrivateKeyHandler(w http.ResponseWriter, r *http.Request, user *auth.U
 func CreditUserHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
     if !user.HasRole("treasury") { ReturnJSON(API_UNAUTHORIZED, UNAUTH_MSG) } // All handlers here should have this.
 
-    coin :=     GetParamRegexp(r, "coin", RE_COIN,  true)
+    coin :=     GetParamCoin(r, "coin", true)
     email :=    GetParamRegexp(r, "email", RE_EMAIL, true)
     amountFloat :=  GetParamFloat64(r, "amountFloat")
     amount := F64ToUI64(amountFloat)
@@ -67,7 +69,7 @@ func CreditUserHandler(w http.ResponseWriter, r *http.Request, user *auth.User)
 func GetWithdrawalsHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
     if !user.HasRole("treasury") { ReturnJSON(API_UNAUTHORIZED, UNAUTH_MSG) } // All handlers here should have this.
 
-    coin :=     GetParamRegexp(r, "coin", RE_COIN,  false)
+    coin :=     GetParamCoin(r, "coin", false)
     limit :=    GetParamInt32(r, "limit")
     if coin == "" {
         withdrawals := account.LoadWithdrawals(uint(limit))
@@ -94,11 +96,63 @@ func GetDepositsHandler(w http.ResponseWriter, r *http.Request, user *auth.User)
     ReturnJSON(API_OK, deposits)
 }
 
+// Fees collected between start & end, per basis coin.
+// end defaults to now, and negative values are relative to now.
+func GetFeeRevenueHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    if !user.HasRole("treasury") { ReturnJSON(API_UNAUTHORIZED, UNAUTH_MSG) } // All handlers here should have this.
+
+    coin :=     GetParamCoin(r, "coin", false)
+    start :=    GetParamInt64(r, "start")
+    end, _ :=   GetParamInt64Safe(r, "end")
+
+    now := time.Now().Unix()
+    if end <= 0   { end = now + end }
+    if start < 0  { start = now + start }
+
+    revenue := exchange.LoadFeeRevenue(coin, start, end)
+    balance := account.LoadBalances(account.SYSTEM_USER_ID, account.WALLET_FEES)
+
+    ReturnJSON(API_OK, map[string]interface{}{
+        "revenue":  revenue,
+        "balance":  balance,
+    })
+}
+
+// The state of each market, see exchange.MARKET_STATE_*.
+func GetMarketStatesHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    if !user.HasRole("treasury") { ReturnJSON(API_UNAUTHORIZED, UNAUTH_MSG) } // All handlers here should have this.
+
+    states := map[string]string{}
+    for _, marketName := range exchange.MarketNames {
+        states[marketName] = exchange.Markets[marketName].State()
+    }
+    ReturnJSON(API_OK, states)
+}
+
+// Opens, halts, or delists "market". Delisting cancels all of its pending orders.
+func SetMarketStateHandler(w http.ResponseWriter, r *http.Request, user *auth.User) {
+    if !user.HasRole("treasury") { ReturnJSON(API_UNAUTHORIZED, UNAUTH_MSG) } // All handlers here should have this.
+
+    market :=   exchange.GetParamMarket(r, "market")
+    state :=    GetParamRegexp(r, "state", RE_MARKET_STATE, true)
+
+    if !market.CanTransition(state) {
+        ReturnJSON(API_INVALID_PARAM, fmt.Sprintf("Market %v cannot go from state %v to %v", market.Name(), market.State(), state))
+    }
+    Warn("User %v set market %v from state %v to %v", user.Id, market.Name(), market.State(), state)
+    canceled := market.SetState(state)
+
+    ReturnJSON(API_OK, map[string]interface{}{
+        "state":    state,
+        "canceled": canceled,
+    })
+}
+
 func GetSpendablePayments(w http.ResponseWriter, r *http.Request, user *auth.User) {
     if !user.HasRole("treasury") { ReturnJSON(API_UNAUTHORIZED, UNAUTH_MSG) } // All handlers here should have this.
 
     mpkId :=    GetParamInt64(r,  "mpk_id")
-    coin :=     GetParamRegexp(r, "coin", RE_COIN,  false)
+    coin :=     GetParamCoin(r, "coin", false)
     min :=      GetParamUint64(r, "min")
     max :=      GetParamUint64(r, "max")
     limit :=    GetParamInt32(r,  "limit")